@@ -1,11 +1,12 @@
 USE otel;
 
-DROP TABLE IF EXISTS NodeDictionary;
 DROP TABLE IF EXISTS NodeDictionaryMV;
 DROP TABLE IF EXISTS TraceNodeMap;
 DROP TABLE IF EXISTS TraceNodeMapMV;
 
-CREATE TABLE NodeDictionary
+-- Таблица не пересоздается, чтобы повторная миграция не теряла накопленную статистику;
+-- колонки, добавленные позже, дописываются через ALTER TABLE ниже
+CREATE TABLE IF NOT EXISTS NodeDictionary
 (
     `NodeId` UInt32,
     `NodeUniqueName` String,
@@ -21,6 +22,12 @@ CREATE TABLE NodeDictionary
 ENGINE = AggregatingMergeTree
 ORDER BY NodeId;
 
+-- Отклоненные лимитами и сбросом нагрузки (error.type), не ошибки
+ALTER TABLE NodeDictionary ADD COLUMN IF NOT EXISTS `ShedCount` AggregateFunction(sum, UInt64);
+-- Вызовы, отклоненные circuit breaker и bulkhead без обращения к сервису (входят в ErrorCount)
+ALTER TABLE NodeDictionary ADD COLUMN IF NOT EXISTS `FastFailCount` AggregateFunction(sum, UInt64);
+
+-- MV создается после ALTER TABLE, чтобы заполнять все колонки таблицы
 CREATE MATERIALIZED VIEW NodeDictionaryMV TO NodeDictionary
 AS SELECT
     cityHash64(CONCAT(ServiceName, SpanAttributes['function.name'], '.', SpanName)) AS NodeId,
@@ -32,7 +39,9 @@ AS SELECT
     quantilesState(0.5)(Duration) AS P50Duration,
     quantilesState(0.9)(Duration) AS P90Duration,
     quantilesState(0.99)(Duration) AS P99Duration,
-    sumState(toUInt64(if(StatusCode = 'Error', 1, 0))) AS ErrorCount
+    sumState(toUInt64(if(StatusCode = 'Error', 1, 0))) AS ErrorCount,
+    sumState(toUInt64(if(SpanAttributes['error.type'] IN ('rate_limited', 'load_shed'), 1, 0))) AS ShedCount,
+    sumState(toUInt64(if(SpanAttributes['error.type'] IN ('circuit_open', 'bulkhead_full'), 1, 0))) AS FastFailCount
 FROM otel_traces
 GROUP BY
     NodeId,
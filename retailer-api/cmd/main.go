@@ -1,42 +1,242 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/internal/config"
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/internal/handler"
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/internal/infrastructure"
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/internal/usecase"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	// Загружаем конфиг
+	cfg := config.LoadConfig()
 
-	cfg := tracing.TraceConfig{
-		ExporterURL: os.Getenv("OTEL_EXPORTER_URL"),
-		SampleRate:  1.0,
-	}
-	appInfo := tracing.AppInfo{
-		Environment:       os.Getenv("APP_ENV"),             // Окружение (dev, staging, production)
-		DomainName:        os.Getenv("APP_DOMAIN"),          // Домен приложения / системы
-		ServiceName:       os.Getenv("APP_SERVICE_NAME"),    // Название сервиса
-		ServiceVersion:    os.Getenv("APP_SERVICE_VERSION"), // Версия сервиса
-		ServiceInstanceID: os.Getenv("APP_INSTANCE_ID"),     // Уникальный ID экземпляра сервиса
+	// Инициализация трейсинга
+	shutdownTracer := tracing.InitTracer(cfg.Trace, cfg.App)
 
+	orderPublisher, shutdownPublisher, err := newOrderPublisher(cfg)
+	if err != nil {
+		log.Fatalf("Ошибка инициализации публикатора заказов: %v", err)
 	}
 
-	// Инициализация трейсинга
-	shutdown := tracing.InitTracer(cfg, appInfo)
-	defer shutdown()
-
-	kafkaBrokers := strings.Split(os.Getenv("KAFKA_BROKER"), ",")
-	topic := os.Getenv("KAFKA_ORDERS_TOPIC")
-	orderRepo := infrastructure.NewOrderRepository(kafkaBrokers, topic)
-	orderUC := usecase.NewOrderUseCase(orderRepo)
+	statusStore := infrastructure.NewOrderStatusStore()
+	idempotencyStore := infrastructure.NewIdempotencyStore(cfg.IdempotencyTTL)
+	eventHub := infrastructure.NewOrderEventHub()
+	orderUC := usecase.NewOrderUseCase(orderPublisher, statusStore, idempotencyStore, eventHub)
 	orderHandler := handler.NewOrderHandler(orderUC)
 
+	// Фоновые задачи живут до начала остановки сервиса
+	ctx, cancel := context.WithCancel(context.Background())
+	go idempotencyStore.Run(ctx)
+
+	// Read-модель статусов заказов наполняется событиями от OMS
+	var statusConsumer *handler.OrderStatusConsumer
+	if len(cfg.Kafka.Brokers) > 0 {
+		statusConsumer, err = handler.NewOrderStatusConsumer(cfg.Kafka.Brokers, cfg.Kafka.OrderStatusTopic, orderUC)
+		if err != nil {
+			log.Fatalf("Ошибка инициализации консьюмера статусов: %v", err)
+		}
+		go statusConsumer.StartListening(ctx)
+	} else {
+		log.Println("KAFKA_BROKER не задан, статусы заказов от OMS не читаются")
+	}
+
+	// Проверки готовности: метаданные Kafka (если публикуем в Kafka) и доступность OTLP-коллектора
+	checks := []handler.HealthCheck{{Name: "otel-exporter", Check: func(context.Context) error { return tracing.ExporterStatus() }}}
+	if pinger, ok := orderPublisher.(interface{ Ping(context.Context) error }); ok {
+		checks = append(checks, handler.HealthCheck{Name: "kafka", Check: pinger.Ping})
+	}
+	healthHandler := handler.NewHealthHandler(checks...)
+
 	router := gin.Default()
-	router.POST("/orders", orderHandler.CreateOrder)
-	router.Run(":8081")
+	// c.ClientIP() берет адрес из X-Forwarded-For только от доверенных прокси, по умолчанию - ни от каких
+	if err := router.SetTrustedProxies(cfg.RateLimit.TrustedProxies); err != nil {
+		log.Fatalf("Некорректный TRUSTED_PROXIES: %v", err)
+	}
+	router.GET("/healthz", healthHandler.Healthz)
+	router.GET("/readyz", healthHandler.Readyz)
+
+	// Пробы здоровья остаются открытыми, API заказов при включенной аутентификации требует JWT
+	orders := router.Group("")
+
+	// Лимиты проверяются до аутентификации, чтобы поток запросов не нагружал проверку токенов
+	var perClient, perAPIKey handler.RateLimiter
+	if cfg.RateLimit.ClientRPS > 0 {
+		limiter := infrastructure.NewRateLimiter(cfg.RateLimit.ClientRPS, cfg.RateLimit.ClientBurst, cfg.RateLimit.IdleLimiterExpiry)
+		go limiter.Run(ctx)
+		perClient = limiter
+	}
+	if cfg.RateLimit.APIKeyRPS > 0 && len(cfg.RateLimit.APIKeys) == 0 {
+		log.Println("RATE_LIMIT_API_KEYS не задан, лимит по API-ключу не применяется")
+	} else if cfg.RateLimit.APIKeyRPS > 0 {
+		limiter := infrastructure.NewRateLimiter(cfg.RateLimit.APIKeyRPS, cfg.RateLimit.APIKeyBurst, cfg.RateLimit.IdleLimiterExpiry)
+		go limiter.Run(ctx)
+		perAPIKey = limiter
+	}
+	if perClient != nil || perAPIKey != nil {
+		orders.Use(handler.RateLimitMiddleware(perClient, perAPIKey, cfg.RateLimit.APIKeys))
+	}
+
+	if cfg.Auth.Mode != config.AuthModeNone {
+		verifier, err := newJWTVerifier(cfg.Auth)
+		if err != nil {
+			log.Fatalf("Ошибка инициализации аутентификации: %v", err)
+		}
+		orders.Use(handler.AuthMiddleware(verifier))
+		log.Printf("Аутентификация JWT включена (режим %s)", cfg.Auth.Mode)
+	}
+
+	// Новые заказы отклоняются, пока Kafka не разберет накопившуюся очередь
+	writes := orders.Group("")
+	if backlog, ok := orderPublisher.(interface{ Backlog() int64 }); ok && cfg.RateLimit.ShedMaxBacklog > 0 {
+		writes.Use(handler.LoadShedMiddleware(backlog.Backlog, cfg.RateLimit.ShedMaxBacklog, cfg.RateLimit.ShedRetryAfter))
+	}
+	writes.POST("/orders", orderHandler.CreateOrder)
+	writes.POST("/orders:method", orderHandler.OrderMethod) // POST /orders:batch
+	orders.POST("/orders/:id/cancel", orderHandler.CancelOrder)
+	orders.GET("/orders", orderHandler.ListOrders)
+	orders.GET("/orders/events", orderHandler.StreamOrdersEvents)
+	orders.GET("/orders/:id", orderHandler.GetOrder)
+	orders.GET("/orders/:id/events", orderHandler.StreamOrderEvents)
+
+	srv := &http.Server{
+		Addr:    cfg.ListenAddress,
+		Handler: router,
+	}
+	// SSE-соединения не завершаются сами, поэтому при остановке сервера подписки закрываются явно
+	srv.RegisterOnShutdown(eventHub.Close)
+
+	go func() {
+		log.Printf("retailer-api слушает %s", cfg.ListenAddress)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Ошибка HTTP-сервера: %v", err)
+		}
+	}()
+
+	// Ожидание сигнала завершения работы
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Завершаем работу...")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+
+	// 1. Перестаем принимать запросы и дожидаемся текущих
+	healthHandler.SetShuttingDown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP-сервер не успел обработать запросы: %v", err)
+	}
+
+	// 2. Останавливаем фоновые задачи
+	cancel()
+	if statusConsumer != nil {
+		statusConsumer.Close()
+	}
+
+	// 3. Досылаем принятые заказы
+	if err := shutdownPublisher(shutdownCtx); err != nil {
+		log.Printf("Публикатор заказов остановлен с ошибкой: %v", err)
+	}
+
+	// 4. Отправляем оставшиеся спаны
+	shutdownTracer()
+	log.Println("retailer-api остановлен")
+}
+
+// newOrderPublisher выбирает реализацию OrderPublisher по конфигу и возвращает функцию ее остановки
+func newOrderPublisher(cfg config.Config) (usecase.OrderPublisher, func(context.Context) error, error) {
+	switch cfg.Publisher {
+	case config.PublisherKafka:
+		// Заказы сначала сохраняются в локальный outbox, чтобы не потерять их при недоступности Kafka
+		outbox, err := infrastructure.OpenOutbox(cfg.OutboxPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		producer := cfg.Kafka.Producer
+		client, err := infrastructure.NewKafkaClient(infrastructure.KafkaProducerOptions{
+			Brokers:         cfg.Kafka.Brokers,
+			DefaultTopic:    cfg.Kafka.OrdersTopic,
+			Acks:            producer.Acks,
+			Idempotent:      producer.Idempotent,
+			Compression:     producer.Compression,
+			Linger:          producer.Linger,
+			BatchMaxBytes:   producer.BatchMaxBytes,
+			RequestTimeout:  producer.RequestTimeout,
+			DeliveryTimeout: producer.DeliveryTimeout,
+		})
+		if err != nil {
+			outbox.Close()
+			return nil, nil, err
+		}
+		publisher, err := infrastructure.NewKafkaOrderPublisher(client, infrastructure.KafkaPublisherOptions{
+			OrdersTopic:   cfg.Kafka.OrdersTopic,
+			CommandsTopic: cfg.Kafka.OrderCommandsTopic,
+			Topic: infrastructure.KafkaTopicOptions{
+				Partitions:        cfg.Kafka.Topic.Partitions,
+				ReplicationFactor: cfg.Kafka.Topic.ReplicationFactor,
+				Configs:           cfg.Kafka.Topic.Configs,
+			},
+			PartitionKey: producer.PartitionKey,
+			Source:       events.Source(cfg.App),
+		}, outbox)
+		if err != nil {
+			client.Close()
+			outbox.Close()
+			return nil, nil, err
+		}
+		return publisher, func(ctx context.Context) error {
+			err := publisher.Shutdown(ctx)
+			client.Close()
+			return errors.Join(err, outbox.Close())
+		}, nil
+
+	case config.PublisherFile:
+		publisher, err := infrastructure.NewFileOrderPublisher(cfg.PublisherFilePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return publisher, func(context.Context) error { return publisher.Close() }, nil
+
+	case config.PublisherMemory:
+		return infrastructure.NewMemoryOrderPublisher(), func(context.Context) error { return nil }, nil
+	}
+	return nil, nil, fmt.Errorf("неизвестный ORDER_PUBLISHER %q", cfg.Publisher)
+}
+
+// newJWTVerifier создает проверку JWT с ключом, выбранным AUTH_MODE
+func newJWTVerifier(cfg config.AuthConfig) (*infrastructure.JWTVerifier, error) {
+	opts := infrastructure.JWTOptions{
+		Issuer:        cfg.Issuer,
+		Audience:      cfg.Audience,
+		CustomerClaim: cfg.CustomerClaim,
+		Leeway:        cfg.Leeway,
+	}
+	switch cfg.Mode {
+	case config.AuthModeStatic:
+		if cfg.StaticKey == "" {
+			return nil, errors.New("AUTH_STATIC_KEY не задан")
+		}
+		opts.StaticKey = cfg.StaticKey
+	case config.AuthModeJWKS:
+		if cfg.JWKSFile == "" {
+			return nil, errors.New("AUTH_JWKS_FILE не задан")
+		}
+		opts.JWKSFile = cfg.JWKSFile
+	default:
+		return nil, fmt.Errorf("неизвестный AUTH_MODE %q", cfg.Mode)
+	}
+	return infrastructure.NewJWTVerifier(opts)
 }
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+)
+
+type KafkaConfig struct {
+	Brokers            []string
+	OrdersTopic        string
+	OrderStatusTopic   string
+	OrderCommandsTopic string // Команды для OMS (отмена заказа)
+	Topic              TopicConfig
+	Producer           ProducerConfig
+}
+
+// TopicConfig - желаемая конфигурация топика заказов, к которой приводится существующий топик
+type TopicConfig struct {
+	Partitions        int32
+	ReplicationFactor int16
+	Configs           map[string]string // Параметры топика (min.insync.replicas, retention.ms и т.п.)
+}
+
+// ProducerConfig - параметры Kafka-продюсера
+type ProducerConfig struct {
+	Acks            string // all, leader, none
+	Idempotent      bool
+	Compression     string // none, gzip, snappy, lz4, zstd
+	Linger          time.Duration
+	BatchMaxBytes   int32
+	RequestTimeout  time.Duration
+	DeliveryTimeout time.Duration
+	PartitionKey    string // order_id, customer_id
+}
+
+// Реализации OrderPublisher, выбираемые переменной ORDER_PUBLISHER
+const (
+	PublisherKafka  = "kafka"
+	PublisherMemory = "memory"
+	PublisherFile   = "file"
+)
+
+// Режимы аутентификации, выбираемые переменной AUTH_MODE
+const (
+	AuthModeNone   = "none"   // Аутентификация отключена
+	AuthModeStatic = "static" // JWT подписаны общим секретом (HS256/HS384/HS512)
+	AuthModeJWKS   = "jwks"   // JWT проверяются открытыми ключами из локального JWKS-файла
+)
+
+// AuthConfig - параметры проверки JWT
+type AuthConfig struct {
+	Mode          string
+	StaticKey     string
+	JWKSFile      string
+	Issuer        string // Пусто - iss не проверяется
+	Audience      string // Пусто - aud не проверяется
+	CustomerClaim string // Claim с идентификатором покупателя
+	Leeway        time.Duration
+}
+
+// RateLimitConfig - лимиты запросов и порог сброса нагрузки; нулевое значение отключает ограничение
+type RateLimitConfig struct {
+	ClientRPS         float64 // Запросов в секунду с одного IP
+	ClientBurst       int
+	APIKeyRPS         float64 // Запросов в секунду по одному X-API-Key
+	APIKeyBurst       int
+	APIKeys           []string // Известные API-ключи; лимит по ключу применяется только к ним
+	ShedMaxBacklog    int64    // Число неотправленных в Kafka заказов, при котором новые заказы отклоняются
+	ShedRetryAfter    time.Duration
+	IdleLimiterExpiry time.Duration // Через сколько удалять бакеты неактивных клиентов
+	// TrustedProxies - прокси (IP или CIDR), которым доверяется X-Forwarded-For при определении IP клиента.
+	// Пусто - заголовку не доверяется: иначе клиент менял бы его и получал новый бакет на каждый запрос
+	TrustedProxies []string
+}
+
+type Config struct {
+	ListenAddress     string
+	ShutdownTimeout   time.Duration
+	Trace             tracing.TraceConfig
+	App               tracing.AppInfo
+	Kafka             KafkaConfig
+	Publisher         string
+	PublisherFilePath string
+	OutboxPath        string
+	IdempotencyTTL    time.Duration
+	Auth              AuthConfig
+	RateLimit         RateLimitConfig
+}
+
+func LoadConfig() Config {
+	return Config{
+		ListenAddress:   getEnv("LISTEN_ADDRESS", ":8081"),
+		ShutdownTimeout: getEnvAsDuration("SHUTDOWN_TIMEOUT", 15*time.Second),
+		Trace: tracing.TraceConfig{
+			ExporterURL: os.Getenv("OTEL_EXPORTER_URL"),
+			SampleRate:  1.0,
+		},
+		App: tracing.AppInfo{
+			Environment:       os.Getenv("APP_ENV"),             // Окружение (dev, staging, production)
+			DomainName:        os.Getenv("APP_DOMAIN"),          // Домен приложения / системы
+			ServiceName:       os.Getenv("APP_SERVICE_NAME"),    // Название сервиса
+			ServiceVersion:    os.Getenv("APP_SERVICE_VERSION"), // Версия сервиса
+			ServiceInstanceID: os.Getenv("APP_INSTANCE_ID"),     // Уникальный ID экземпляра сервиса
+		},
+		Kafka: KafkaConfig{
+			Brokers:            getEnvAsList("KAFKA_BROKER"),
+			OrdersTopic:        os.Getenv("KAFKA_ORDERS_TOPIC"),
+			OrderStatusTopic:   getEnv("KAFKA_ORDER_STATUS_TOPIC", "order-status"),
+			OrderCommandsTopic: getEnv("KAFKA_ORDER_COMMANDS_TOPIC", "order-commands"),
+			Topic: TopicConfig{
+				Partitions:        int32(getEnvAsInt("KAFKA_ORDERS_PARTITIONS", 1)),
+				ReplicationFactor: int16(getEnvAsInt("KAFKA_ORDERS_REPLICATION_FACTOR", 1)),
+				Configs:           getEnvAsMap("KAFKA_ORDERS_TOPIC_CONFIG", map[string]string{"min.insync.replicas": "1"}),
+			},
+			Producer: ProducerConfig{
+				Acks:            getEnv("KAFKA_PRODUCER_ACKS", "all"),
+				Idempotent:      getEnvAsBool("KAFKA_PRODUCER_IDEMPOTENT", true),
+				Compression:     getEnv("KAFKA_PRODUCER_COMPRESSION", "none"),
+				Linger:          getEnvAsDuration("KAFKA_PRODUCER_LINGER", 0),
+				BatchMaxBytes:   int32(getEnvAsInt("KAFKA_PRODUCER_BATCH_MAX_BYTES", 1000012)),
+				RequestTimeout:  getEnvAsDuration("KAFKA_PRODUCER_REQUEST_TIMEOUT", 10*time.Second),
+				DeliveryTimeout: getEnvAsDuration("KAFKA_PRODUCER_DELIVERY_TIMEOUT", 30*time.Second),
+				PartitionKey:    getEnv("KAFKA_PARTITION_KEY", "order_id"),
+			},
+		},
+		Publisher:         getEnv("ORDER_PUBLISHER", PublisherKafka),
+		PublisherFilePath: getEnv("ORDER_PUBLISHER_FILE", "orders.jsonl"),
+		OutboxPath:        getEnv("OUTBOX_PATH", "outbox.db"),
+		IdempotencyTTL:    getEnvAsDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		Auth: AuthConfig{
+			Mode:          getEnv("AUTH_MODE", AuthModeNone),
+			StaticKey:     os.Getenv("AUTH_STATIC_KEY"),
+			JWKSFile:      os.Getenv("AUTH_JWKS_FILE"),
+			Issuer:        os.Getenv("AUTH_ISSUER"),
+			Audience:      os.Getenv("AUTH_AUDIENCE"),
+			CustomerClaim: getEnv("AUTH_CUSTOMER_CLAIM", "sub"),
+			Leeway:        getEnvAsDuration("AUTH_LEEWAY", 30*time.Second),
+		},
+		RateLimit: RateLimitConfig{
+			ClientRPS:         getEnvAsFloat("RATE_LIMIT_CLIENT_RPS", 0),
+			ClientBurst:       getEnvAsInt("RATE_LIMIT_CLIENT_BURST", 20),
+			APIKeyRPS:         getEnvAsFloat("RATE_LIMIT_API_KEY_RPS", 0),
+			APIKeyBurst:       getEnvAsInt("RATE_LIMIT_API_KEY_BURST", 100),
+			APIKeys:           getEnvAsList("RATE_LIMIT_API_KEYS"),
+			ShedMaxBacklog:    int64(getEnvAsInt("LOAD_SHED_MAX_BACKLOG", 0)),
+			ShedRetryAfter:    getEnvAsDuration("LOAD_SHED_RETRY_AFTER", time.Second),
+			IdleLimiterExpiry: getEnvAsDuration("RATE_LIMIT_IDLE_EXPIRY", 10*time.Minute),
+			TrustedProxies:    getEnvAsList("TRUSTED_PROXIES"),
+		},
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := getEnv(key, "")
+	if value, err := time.ParseDuration(valueStr); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(getEnv(key, "")); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value, err := strconv.ParseFloat(getEnv(key, ""), 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(getEnv(key, "")); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvAsMap разбирает значение вида "key1=value1,key2=value2"
+func getEnvAsMap(key string, defaultValue map[string]string) map[string]string {
+	list := getEnvAsList(key)
+	if len(list) == 0 {
+		return defaultValue
+	}
+	values := make(map[string]string, len(list))
+	for _, item := range list {
+		if k, v, ok := strings.Cut(item, "="); ok {
+			values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return values
+}
+
+func getEnvAsList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Значения атрибута error.type для отклоненных запросов.
+// Такие спаны не помечаются ошибкой: анализатор считает их отдельно от сбоев.
+const (
+	ErrorTypeRateLimited = "rate_limited"
+	ErrorTypeLoadShed    = "load_shed"
+)
+
+// RateLimiter - token bucket по произвольному ключу
+type RateLimiter interface {
+	Allow(key string) (bool, time.Duration)
+}
+
+// RateLimitMiddleware ограничивает частоту запросов с одного IP и, если клиент передал известный X-API-Key,
+// по этому ключу. Неизвестные ключи не получают своего бакета: иначе, меняя значение заголовка, клиент обходил бы
+// лимит и без ограничения наращивал число бакетов; такие запросы ограничиваются только по IP.
+// nil вместо лимитера отключает соответствующее ограничение.
+func RateLimitMiddleware(perClient, perAPIKey RateLimiter, apiKeys []string) gin.HandlerFunc {
+	known := make(map[string]bool, len(apiKeys))
+	for _, key := range apiKeys {
+		known[key] = true
+	}
+	return func(c *gin.Context) {
+		if perClient != nil {
+			if ok, retryAfter := perClient.Allow(c.ClientIP()); !ok {
+				reject(c, "RateLimit", ErrorTypeRateLimited, retryAfter, attribute.String("ratelimit.scope", "client"))
+				return
+			}
+		}
+		if apiKey := c.GetHeader("X-API-Key"); known[apiKey] && perAPIKey != nil {
+			if ok, retryAfter := perAPIKey.Allow(apiKey); !ok {
+				reject(c, "RateLimit", ErrorTypeRateLimited, retryAfter, attribute.String("ratelimit.scope", "api_key"))
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// LoadShedMiddleware отклоняет новые заказы, когда очередь неотправленных в Kafka заказов растет.
+// До половины maxBacklog принимается все, дальше доля отклоненных запросов растет линейно
+// и достигает 100% на maxBacklog, чтобы нагрузка снижалась плавно, а не обрывалась.
+func LoadShedMiddleware(backlog func() int64, maxBacklog int64, retryAfter time.Duration) gin.HandlerFunc {
+	soft := maxBacklog / 2
+	return func(c *gin.Context) {
+		depth := backlog()
+		if depth > soft {
+			probability := float64(depth-soft) / float64(maxBacklog-soft)
+			if rand.Float64() < probability {
+				reject(c, "LoadShed", ErrorTypeLoadShed, retryAfter,
+					attribute.Int64("loadshed.backlog", depth),
+					attribute.Float64("loadshed.probability", math.Min(probability, 1)),
+				)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// reject отвечает 429 с Retry-After и оставляет спан с типом отказа
+func reject(c *gin.Context, operation, errorType string, retryAfter time.Duration, attrs ...attribute.KeyValue) {
+	_, span := tracing.StartPresentation(c.Request.Context(), operation, tracing.SubLayerHTTP)
+	defer span.End()
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	span.SetAttributes(attrs...)
+	span.SetAttributes(
+		attribute.String("error.type", errorType),
+		attribute.String("http.route", c.FullPath()),
+		attribute.Int("http.response.status_code", http.StatusTooManyRequests),
+		attribute.Int("http.retry_after", seconds),
+	)
+
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": errorType})
+}
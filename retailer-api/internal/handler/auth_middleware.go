@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// TokenVerifier проверяет bearer-токен и возвращает покупателя, от имени которого выполняется запрос
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (domain.Customer, error)
+}
+
+// AuthMiddleware пропускает только запросы с действительным JWT и кладет покупателя в контекст запроса.
+// Спан Authenticate завершается до вызова обработчика, а покупатель кладется в исходный контекст запроса:
+// спаны обработчика - соседи Authenticate в том же трейсе, а не потомки завершенного спана.
+func AuthMiddleware(verifier TokenVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, span := tracing.StartPresentation(c.Request.Context(), "Authenticate", tracing.SubLayerHTTP)
+
+		span.SetAttributes(attribute.String("http.route", c.FullPath()))
+
+		token := ""
+		if scheme, value, ok := strings.Cut(c.GetHeader("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(value)
+		}
+
+		customer, err := verifier.Verify(ctx, token)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "unauthorized")
+			log.Printf("Запрос %s %s отклонен: %v", c.Request.Method, c.Request.URL.Path, err)
+			c.Header("WWW-Authenticate", `Bearer realm="retailer-api", error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			span.End()
+			return
+		}
+
+		span.SetAttributes(attribute.String("enduser.id", customer.ID))
+		span.End()
+
+		c.Request = c.Request.WithContext(domain.ContextWithCustomer(c.Request.Context(), customer))
+		c.Next()
+	}
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+// HealthCheck - проверка готовности одной зависимости сервиса
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// HealthHandler обслуживает /healthz и /readyz для docker-compose и оркестратора.
+// Пробы вызываются часто, поэтому спаны для них не создаются.
+type HealthHandler struct {
+	checks       []HealthCheck
+	shuttingDown atomic.Bool
+}
+
+func NewHealthHandler(checks ...HealthCheck) *HealthHandler {
+	return &HealthHandler{checks: checks}
+}
+
+// Healthz - liveness: процесс жив и обрабатывает HTTP
+func (h *HealthHandler) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz - readiness: сервис не останавливается и все зависимости доступны
+func (h *HealthHandler) Readyz(c *gin.Context) {
+	if h.shuttingDown.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	status := http.StatusOK
+	results := make(map[string]string, len(h.checks))
+	for _, check := range h.checks {
+		if err := check.Check(ctx); err != nil {
+			status = http.StatusServiceUnavailable
+			results[check.Name] = err.Error()
+			continue
+		}
+		results[check.Name] = "ok"
+	}
+
+	c.JSON(status, gin.H{"status": http.StatusText(status), "checks": results})
+}
+
+// SetShuttingDown переводит /readyz в 503, чтобы балансировщик перестал присылать новые запросы
+func (h *HealthHandler) SetShuttingDown() {
+	h.shuttingDown.Store(true)
+}
@@ -1,13 +1,39 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/internal/usecase"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	maxIdempotencyKeyLength = 255
+	maxBatchSize            = 1000
+)
+
+// batchRequest - тело POST /orders:batch; каждый элемент - тело обычного POST /orders
+type batchRequest struct {
+	Orders []json.RawMessage `json:"orders"`
+}
+
+// cancelRequest - необязательное тело POST /orders/:id/cancel
+type cancelRequest struct {
+	Reason string `json:"reason"`
+}
+
+// batchItemResponse - результат по одному элементу пачки
+type batchItemResponse struct {
+	Index    int    `json:"index"`
+	OrderID  string `json:"order_id,omitempty"`
+	Replayed bool   `json:"replayed,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
 type OrderHandler struct {
 	orderUC *usecase.OrderUseCase
 }
@@ -27,11 +53,188 @@ func (h *OrderHandler) CreateOrder(c *gin.Context) {
 		return
 	}
 
-	orderID, err := h.orderUC.CreateOrder(ctx, req)
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "idempotency key is too long"})
+		return
+	}
+
+	orderID, replayed, err := h.orderUC.CreateOrder(ctx, idempotencyKey, req)
+	if errors.Is(err, usecase.ErrIdempotencyConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "idempotency key was already used with a different request"})
+		return
+	}
+	// Исходный запрос еще не завершен: клиент повторяет позже и получает его результат
+	if errors.Is(err, usecase.ErrIdempotencyInFlight) {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusConflict, gin.H{"error": "request with the same idempotency key is in progress"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process order"})
 		return
 	}
 
+	// Повтор с тем же ключом получает тот же ответ, что и исходный запрос
+	if replayed {
+		c.Header("Idempotent-Replayed", "true")
+	}
 	c.JSON(http.StatusAccepted, gin.H{"order_id": orderID})
 }
+
+// OrderMethod обрабатывает пользовательские методы коллекции заказов вида POST /orders:<method>.
+// gin не различает /orders:batch и /orders<suffix>, поэтому метод выбирается по параметру маршрута.
+func (h *OrderHandler) OrderMethod(c *gin.Context) {
+	switch c.Param("method") {
+	case ":batch":
+		h.CreateOrders(c)
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown method"})
+	}
+}
+
+// CreateOrders принимает пачку заказов и возвращает результат по каждому элементу.
+// Если хотя бы один элемент не принят, ответ - 207 Multi-Status.
+func (h *OrderHandler) CreateOrders(c *gin.Context) {
+	ctx, span := tracing.StartPresentation(c.Request.Context(), "CreateOrders", tracing.SubLayerHTTP)
+	defer span.End()
+
+	var req batchRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+	if len(req.Orders) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "batch is empty"})
+		return
+	}
+	if len(req.Orders) > maxBatchSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "batch is too large"})
+		return
+	}
+
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "idempotency key is too long"})
+		return
+	}
+
+	// Некорректные элементы отклоняются сразу, остальные уходят в use case
+	results := make([]batchItemResponse, len(req.Orders))
+	var payloads []map[string]interface{}
+	var indexes []int
+	for i, raw := range req.Orders {
+		results[i].Index = i
+		var payload map[string]interface{}
+		if err := json.Unmarshal(raw, &payload); err != nil || payload == nil {
+			results[i].Error = "invalid payload"
+			continue
+		}
+		payloads = append(payloads, payload)
+		indexes = append(indexes, i)
+	}
+
+	if len(payloads) > 0 {
+		for j, result := range h.orderUC.CreateOrders(ctx, idempotencyKey, payloads) {
+			item := &results[indexes[j]]
+			switch {
+			case errors.Is(result.Err, usecase.ErrIdempotencyConflict):
+				item.Error = "idempotency key was already used with a different request"
+			case errors.Is(result.Err, usecase.ErrIdempotencyInFlight):
+				item.Error = "request with the same idempotency key is in progress"
+			case result.Err != nil:
+				item.Error = "failed to process order"
+			default:
+				item.OrderID = result.OrderID
+				item.Replayed = result.Replayed
+			}
+		}
+	}
+
+	accepted := 0
+	for _, item := range results {
+		if item.Error == "" {
+			accepted++
+		}
+	}
+
+	status := http.StatusAccepted
+	if accepted < len(results) {
+		status = http.StatusMultiStatus
+	}
+	c.JSON(status, gin.H{
+		"accepted": accepted,
+		"failed":   len(results) - accepted,
+		"results":  results,
+	})
+}
+
+// GetOrder возвращает текущий статус заказа, историю шагов и trace id
+func (h *OrderHandler) GetOrder(c *gin.Context) {
+	ctx, span := tracing.StartPresentation(c.Request.Context(), "GetOrder", tracing.SubLayerHTTP)
+	defer span.End()
+
+	view, err := h.orderUC.GetOrder(ctx, c.Param("id"))
+	if errors.Is(err, domain.ErrOrderNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get order"})
+		return
+	}
+
+	c.JSON(http.StatusOK, view)
+}
+
+// CancelOrder принимает запрос на отмену заказа: POST /orders/:id/cancel.
+// Отмена выполняется сагой OMS асинхронно, результат виден по статусу заказа.
+func (h *OrderHandler) CancelOrder(c *gin.Context) {
+	ctx, span := tracing.StartPresentation(c.Request.Context(), "CancelOrder", tracing.SubLayerHTTP)
+	defer span.End()
+
+	var req cancelRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+			return
+		}
+	}
+
+	orderID := c.Param("id")
+	err := h.orderUC.CancelOrder(ctx, orderID, req.Reason)
+	if errors.Is(err, domain.ErrOrderNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if errors.Is(err, domain.ErrOrderNotCancellable) {
+		c.JSON(http.StatusConflict, gin.H{"error": "order can no longer be cancelled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel order"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"order_id": orderID, "status": "cancel_requested"})
+}
+
+// ListOrders возвращает заказы, при необходимости отфильтрованные по ?status=
+func (h *OrderHandler) ListOrders(c *gin.Context) {
+	ctx, span := tracing.StartPresentation(c.Request.Context(), "ListOrders", tracing.SubLayerHTTP)
+	defer span.End()
+
+	status := domain.OrderStatus(c.Query("status"))
+	if status != "" && !status.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown status"})
+		return
+	}
+
+	views, err := h.orderUC.ListOrders(ctx, status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list orders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"orders": views})
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sseHeartbeatInterval - период комментариев-пингов, которые не дают прокси закрыть простаивающее соединение
+const sseHeartbeatInterval = 15 * time.Second
+
+// StreamOrderEvents - SSE-поток изменений статуса одного заказа: GET /orders/:id/events
+func (h *OrderHandler) StreamOrderEvents(c *gin.Context) {
+	h.streamOrderEvents(c, []string{c.Param("id")})
+}
+
+// StreamOrdersEvents - SSE-поток изменений статусов нескольких заказов: GET /orders/events?ids=a,b.
+// Без ids поток содержит изменения всех заказов покупателя (всех заказов, если аутентификация отключена).
+func (h *OrderHandler) StreamOrdersEvents(c *gin.Context) {
+	var orderIDs []string
+	for _, id := range strings.Split(c.Query("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			orderIDs = append(orderIDs, id)
+		}
+	}
+	h.streamOrderEvents(c, orderIDs)
+}
+
+// streamOrderEvents отправляет снимок заказов (событие snapshot), а затем каждое изменение статуса (событие status).
+// Спан соединения живет, пока клиент подключен; каждое отправленное событие - отдельный спан,
+// связанный со спаном OMS, вызвавшим изменение, и со спаном соединения.
+func (h *OrderHandler) streamOrderEvents(c *gin.Context, orderIDs []string) {
+	ctx, span := tracing.StartPresentation(c.Request.Context(), "StreamOrderEvents", tracing.SubLayerHTTP)
+	defer span.End()
+
+	span.SetAttributes(attribute.StringSlice("order.ids", orderIDs))
+
+	snapshot, updates, cancel, err := h.orderUC.SubscribeOrderEvents(ctx, orderIDs)
+	if errors.Is(err, domain.ErrOrderNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to subscribe to order events"})
+		return
+	}
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Отключаем буферизацию в nginx
+	c.Status(http.StatusOK)
+
+	for _, view := range snapshot {
+		c.SSEvent("snapshot", view)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	sent := 0
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case update, ok := <-updates:
+			if !ok {
+				// Подписка закрыта: клиент не успевал читать или сервис останавливается
+				return false
+			}
+			h.sendOrderEvent(c, span.SpanContext(), update)
+			sent++
+			return true
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			return true
+		}
+	})
+
+	span.SetAttributes(attribute.Int("sse.events.sent", sent))
+}
+
+// sendOrderEvent отправляет одно изменение статуса в собственном спане
+func (h *OrderHandler) sendOrderEvent(c *gin.Context, connection trace.SpanContext, update domain.OrderStatusUpdate) {
+	links := []trace.Link{{
+		SpanContext: connection,
+		Attributes: []attribute.KeyValue{
+			attribute.String("link.type", "stream"),
+			attribute.String("link.protocol", "sse"),
+		},
+	}}
+	if source := spanContextFromChange(update.StatusChange); source.IsValid() {
+		links = append(links, trace.Link{
+			SpanContext: source,
+			Attributes: []attribute.KeyValue{
+				attribute.String("link.type", "async"),
+				attribute.String("link.protocol", "sse"),
+				attribute.String("link.event.type", events.TypeOrderStatusChanged),
+			},
+		})
+	}
+
+	_, span := tracing.StartPresentation(context.Background(), "SendOrderEvent", tracing.SubLayerHTTP,
+		trace.WithNewRoot(), trace.WithLinks(links...))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", update.OrderID),
+		attribute.String("order.status", string(update.Status)),
+	)
+
+	c.SSEvent("status", update)
+}
+
+// spanContextFromChange восстанавливает контекст спана, вызвавшего изменение статуса
+func spanContextFromChange(change domain.StatusChange) trace.SpanContext {
+	traceID, err := trace.TraceIDFromHex(change.TraceID)
+	if err != nil {
+		return trace.SpanContext{}
+	}
+	spanID, err := trace.SpanIDFromHex(change.SpanID)
+	if err != nil {
+		return trace.SpanContext{}
+	}
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+}
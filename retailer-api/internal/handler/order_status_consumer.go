@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/internal/usecase"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OrderStatusConsumer читает события смены статуса заказов и обновляет read-модель
+type OrderStatusConsumer struct {
+	client  *kgo.Client
+	topic   string
+	orderUC *usecase.OrderUseCase
+}
+
+// NewOrderStatusConsumer создает консьюмера событий статусов.
+// Read-модель хранится в памяти каждого экземпляра, поэтому consumer group не используется:
+// каждый экземпляр читает топик целиком с начала и восстанавливает состояние после рестарта.
+func NewOrderStatusConsumer(brokers []string, topic string, orderUC *usecase.OrderUseCase) (*OrderStatusConsumer, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		kgo.ClientID("retailer-api"),
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка инициализации Kafka-консьюмера статусов: %w", err)
+	}
+
+	return &OrderStatusConsumer{
+		client:  client,
+		topic:   topic,
+		orderUC: orderUC,
+	}, nil
+}
+
+// StartListening читает события статусов, пока не будет отменен контекст
+func (sc *OrderStatusConsumer) StartListening(ctx context.Context) {
+	log.Printf("Начато чтение статусов заказов из топика %s", sc.topic)
+
+	for {
+		fetches := sc.client.PollFetches(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			log.Printf("Ошибка чтения топика %s (партиция %d): %v", topic, partition, err)
+		})
+		fetches.EachRecord(func(record *kgo.Record) {
+			sc.processMessage(ctx, record)
+		})
+	}
+}
+
+// processMessage применяет одно событие статуса к read-модели
+func (sc *OrderStatusConsumer) processMessage(ctx context.Context, record *kgo.Record) {
+	source := tracing.SpanContextFromKafka(ctx, record.Headers)
+	links := tracing.ExtractTraceContextFromKafka(ctx, record.Headers)
+	ctx, span := tracing.StartInfrastructure(ctx, "ConsumeOrderStatus", tracing.SubLayerBroker, trace.WithLinks(links...))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("kafka.topic", record.Topic),
+		attribute.Int64("kafka.offset", record.Offset),
+	)
+
+	// Принимаются только CloudEvents нужного типа
+	ce, err := events.FromHeaders(record.Headers)
+	if err == nil {
+		err = ce.Expect(events.TypeOrderStatusChanged)
+	}
+	if err != nil {
+		span.RecordError(err)
+		log.Printf("Отброшено событие статуса (offset %d): %v", record.Offset, err)
+		return
+	}
+	span.SetAttributes(
+		attribute.String("messaging.event.id", ce.ID),
+		attribute.String("messaging.event.source", ce.Source),
+	)
+
+	var event domain.OrderStatusEvent
+	if err := json.Unmarshal(record.Value, &event); err != nil {
+		span.RecordError(err)
+		log.Printf("Ошибка разбора события статуса (offset %d): %v", record.Offset, err)
+		return
+	}
+
+	if err := sc.orderUC.ApplyStatusEvent(ctx, event, source); err != nil {
+		span.RecordError(err)
+		log.Printf("Ошибка применения статуса %s к заказу %s: %v", event.Status, event.OrderID, err)
+	}
+}
+
+// Close закрывает Kafka-клиент
+func (sc *OrderStatusConsumer) Close() {
+	sc.client.Close()
+}
@@ -0,0 +1,98 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// fileOrderRecord - строка JSON Lines файла с заказами; заполнено одно из полей order или cancel
+type fileOrderRecord struct {
+	Order   *domain.Order              `json:"order,omitempty"`
+	Cancel  *domain.CancelOrderCommand `json:"cancel,omitempty"`
+	Headers map[string]string          `json:"headers,omitempty"` // traceparent для связи с обработчиком файла
+}
+
+// FileOrderPublisher дописывает заказы в файл в формате JSON Lines
+type FileOrderPublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileOrderPublisher открывает (или создает) файл для записи заказов
+func NewFileOrderPublisher(path string) (*FileOrderPublisher, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия файла заказов %s: %w", path, err)
+	}
+	return &FileOrderPublisher{file: file}, nil
+}
+
+// PublishOrder дописывает заказ в конец файла
+func (p *FileOrderPublisher) PublishOrder(ctx context.Context, order domain.Order) error {
+	ctx, span := tracing.StartInfrastructure(ctx, "PublishOrder", tracing.SubLayerFilesystem)
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("file.name", p.file.Name()),
+		attribute.String("order.id", order.ID),
+	)
+
+	if err := p.write(ctx, fileOrderRecord{Order: &order}); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка записи заказа %s в файл: %w", order.ID, err)
+	}
+	return nil
+}
+
+// PublishCancel дописывает команду отмены заказа в конец файла
+func (p *FileOrderPublisher) PublishCancel(ctx context.Context, command domain.CancelOrderCommand) error {
+	ctx, span := tracing.StartInfrastructure(ctx, "PublishCancel", tracing.SubLayerFilesystem)
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("file.name", p.file.Name()),
+		attribute.String("order.id", command.OrderID),
+	)
+
+	if err := p.write(ctx, fileOrderRecord{Cancel: &command}); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка записи отмены заказа %s в файл: %w", command.OrderID, err)
+	}
+	return nil
+}
+
+// write добавляет к записи traceparent и дописывает ее строкой в файл
+func (p *FileOrderPublisher) write(ctx context.Context, record fileOrderRecord) error {
+	record.Headers = map[string]string{}
+	for _, h := range tracing.InjectTraceContextToKafka(ctx) {
+		record.Headers[h.Key] = string(h.Value)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := p.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("ошибка сброса файла заказов на диск: %w", err)
+	}
+	return nil
+}
+
+// Close закрывает файл
+func (p *FileOrderPublisher) Close() error {
+	return p.file.Close()
+}
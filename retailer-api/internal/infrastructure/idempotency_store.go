@@ -0,0 +1,107 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const idempotencyPurgeInterval = time.Minute
+
+// IdempotencyStore хранит соответствие Idempotency-Key -> заказ в памяти с TTL.
+// Ключи не переживают перезапуск и не разделяются между репликами: повтор, попавший на другую реплику
+// или пришедший после рестарта, создаст новый заказ. Для нескольких реплик нужен общий стор (например, Redis).
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	records map[string]domain.IdempotencyRecord
+}
+
+// NewIdempotencyStore создает хранилище ключей идемпотентности
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		ttl:     ttl,
+		records: make(map[string]domain.IdempotencyRecord),
+	}
+}
+
+// Reserve атомарно закрепляет ключ за новым заказом.
+// Если ключ уже использован и не истек, возвращается ранее сохраненная запись и false.
+func (s *IdempotencyStore) Reserve(ctx context.Context, record domain.IdempotencyRecord) (domain.IdempotencyRecord, bool) {
+	_, span := tracing.StartInfrastructure(ctx, "ReserveIdempotencyKey", tracing.SubLayerCache)
+	defer span.End()
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.records[record.Key]; ok && now.Before(existing.ExpiresAt) {
+		span.SetAttributes(
+			attribute.Bool("cache.hit", true),
+			attribute.String("order.id", existing.OrderID),
+			attribute.Bool("idempotency.completed", existing.Completed),
+		)
+		return existing, false
+	}
+
+	record.Completed = false
+	record.CreatedAt = now
+	record.ExpiresAt = now.Add(s.ttl)
+	s.records[record.Key] = record
+
+	span.SetAttributes(
+		attribute.Bool("cache.hit", false),
+		attribute.String("order.id", record.OrderID),
+	)
+	return record, true
+}
+
+// Complete отмечает, что заказ по ключу принят: повторы теперь получают его идентификатор
+func (s *IdempotencyStore) Complete(ctx context.Context, key string) {
+	_, span := tracing.StartInfrastructure(ctx, "CompleteIdempotencyKey", tracing.SubLayerCache)
+	defer span.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, ok := s.records[key]; ok {
+		record.Completed = true
+		s.records[key] = record
+	}
+}
+
+// Release освобождает ключ, если заказ так и не был принят, чтобы клиент мог повторить запрос
+func (s *IdempotencyStore) Release(ctx context.Context, key string) {
+	_, span := tracing.StartInfrastructure(ctx, "ReleaseIdempotencyKey", tracing.SubLayerCache)
+	defer span.End()
+
+	s.mu.Lock()
+	delete(s.records, key)
+	s.mu.Unlock()
+}
+
+// Run периодически удаляет истекшие ключи, пока не будет отменен контекст
+func (s *IdempotencyStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(idempotencyPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for key, record := range s.records {
+				if !now.Before(record.ExpiresAt) {
+					delete(s.records, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
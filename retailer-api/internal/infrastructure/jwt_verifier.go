@@ -0,0 +1,288 @@
+package infrastructure
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrInvalidToken возвращается для любого токена, который не прошел проверку
+var ErrInvalidToken = errors.New("invalid token")
+
+// JWTVerifier проверяет подпись и claims JWT и извлекает из них покупателя
+type JWTVerifier struct {
+	parser        *jwt.Parser
+	keyFunc       jwt.Keyfunc
+	customerClaim string
+}
+
+// JWTOptions - параметры проверки JWT. Задается один из ключей: общий секрет StaticKey или JWKS-файл JWKSFile.
+type JWTOptions struct {
+	StaticKey     string
+	JWKSFile      string
+	Issuer        string // Пусто - iss не проверяется
+	Audience      string // Пусто - aud не проверяется
+	CustomerClaim string // Claim с идентификатором покупателя
+	Leeway        time.Duration
+}
+
+// NewJWTVerifier создает проверку токенов по общему секрету или по открытым ключам из JWKS-файла
+func NewJWTVerifier(cfg JWTOptions) (*JWTVerifier, error) {
+	var (
+		keyFunc jwt.Keyfunc
+		methods []string
+	)
+
+	switch {
+	case cfg.StaticKey != "":
+		secret := []byte(cfg.StaticKey)
+		keyFunc = func(*jwt.Token) (interface{}, error) { return secret, nil }
+		methods = []string{"HS256", "HS384", "HS512"}
+
+	case cfg.JWKSFile != "":
+		keys, err := loadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keyFunc = keys.keyFunc
+		methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+	default:
+		return nil, errors.New("не задан ключ проверки JWT")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+
+	return &JWTVerifier{
+		parser:        jwt.NewParser(opts...),
+		keyFunc:       keyFunc,
+		customerClaim: cfg.CustomerClaim,
+	}, nil
+}
+
+// Verify проверяет токен и возвращает покупателя, от имени которого выполняется запрос
+func (v *JWTVerifier) Verify(ctx context.Context, rawToken string) (domain.Customer, error) {
+	_, span := tracing.StartInfrastructure(ctx, "VerifyToken", tracing.SubLayerAuth)
+	defer span.End()
+
+	if rawToken == "" {
+		return domain.Customer{}, failAuth(span, fmt.Errorf("%w: bearer token is missing", ErrInvalidToken))
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := v.parser.ParseWithClaims(rawToken, claims, v.keyFunc)
+	if token != nil {
+		span.SetAttributes(attribute.String("auth.jwt.alg", token.Method.Alg()))
+		if kid, ok := token.Header["kid"].(string); ok {
+			span.SetAttributes(attribute.String("auth.jwt.kid", kid))
+		}
+	}
+	if err != nil {
+		return domain.Customer{}, failAuth(span, fmt.Errorf("%w: %w", ErrInvalidToken, err))
+	}
+
+	customerID, _ := claims[v.customerClaim].(string)
+	if customerID == "" {
+		return domain.Customer{}, failAuth(span, fmt.Errorf("%w: claim %q is missing", ErrInvalidToken, v.customerClaim))
+	}
+
+	customer := domain.Customer{ID: customerID, Scopes: scopes(claims)}
+	span.SetAttributes(attribute.String("enduser.id", customer.ID))
+	span.SetStatus(codes.Ok, "")
+	return customer, nil
+}
+
+// failAuth помечает спан ошибкой, чтобы отказы аутентификации были видны в графе
+func failAuth(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
+
+// scopes извлекает права из claim scope (строка через пробел) или scp (массив)
+func scopes(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	var result []string
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			if str, ok := s.(string); ok {
+				result = append(result, str)
+			}
+		}
+	}
+	return result
+}
+
+// jwk - ключ из JWKS (RFC 7517); поддерживаются RSA и EC
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwksKey - разобранный открытый ключ
+type jwksKey struct {
+	alg string
+	key interface{}
+}
+
+// jwksKeys - открытые ключи по kid
+type jwksKeys map[string]jwksKey
+
+// loadJWKS читает и разбирает локальный JWKS-файл
+func loadJWKS(path string) (jwksKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения JWKS %s: %w", path, err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("ошибка разбора JWKS %s: %w", path, err)
+	}
+
+	keys := make(jwksKeys, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка разбора ключа %q из JWKS: %w", k.Kid, err)
+		}
+		keys[k.Kid] = jwksKey{alg: k.Alg, key: key}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("в JWKS %s нет ключей подписи", path)
+	}
+	return keys, nil
+}
+
+// keyFunc выбирает ключ по kid из заголовка токена.
+// Токен без kid принимается, только если в JWKS ровно один ключ.
+func (keys jwksKeys) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	var (
+		key jwksKey
+		ok  bool
+	)
+	if kid == "" && len(keys) == 1 {
+		for _, key = range keys {
+			ok = true
+		}
+	} else {
+		key, ok = keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	if key.alg != "" && key.alg != token.Method.Alg() {
+		return nil, fmt.Errorf("key %q is for %s, token uses %s", kid, key.alg, token.Method.Alg())
+	}
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, isRSA := key.key.(*rsa.PublicKey); !isRSA {
+			return nil, fmt.Errorf("key %q is not an RSA key", kid)
+		}
+	case *jwt.SigningMethodECDSA:
+		if _, isEC := key.key.(*ecdsa.PublicKey); !isEC {
+			return nil, fmt.Errorf("key %q is not an EC key", kid)
+		}
+	}
+	return key.key, nil
+}
+
+// publicKey собирает открытый ключ из параметров JWK
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("e is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeBigInt декодирует число в base64url без выравнивания
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
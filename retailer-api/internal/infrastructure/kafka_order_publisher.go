@@ -0,0 +1,459 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/messages"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Ключи партиционирования заказов (KAFKA_PARTITION_KEY)
+const (
+	PartitionByOrderID    = "order_id"    // Заказы равномерно распределяются по партициям
+	PartitionByCustomerID = "customer_id" // Заказы одного покупателя попадают в одну партицию и сохраняют порядок
+)
+
+// KafkaProducerOptions - параметры Kafka-продюсера публикатора заказов
+type KafkaProducerOptions struct {
+	Brokers         []string
+	DefaultTopic    string
+	Acks            string // all, leader, none
+	Idempotent      bool
+	Compression     string // none, gzip, snappy, lz4, zstd
+	Linger          time.Duration
+	BatchMaxBytes   int32
+	RequestTimeout  time.Duration
+	DeliveryTimeout time.Duration
+}
+
+// KafkaTopicOptions - желаемая конфигурация топиков, к которой приводятся существующие топики
+type KafkaTopicOptions struct {
+	Partitions        int32
+	ReplicationFactor int16
+	Configs           map[string]string // Параметры топика (min.insync.replicas, retention.ms и т.п.)
+}
+
+// KafkaPublisherOptions - топики и партиционирование публикатора заказов
+type KafkaPublisherOptions struct {
+	OrdersTopic   string
+	CommandsTopic string // Команды для OMS (отмена заказа)
+	Topic         KafkaTopicOptions
+	PartitionKey  string // PartitionByOrderID или PartitionByCustomerID
+	Source        string // Атрибут CloudEvents source публикуемых событий (см. events.Source)
+}
+
+// NewKafkaClient создает Kafka-клиент для публикации заказов
+func NewKafkaClient(producer KafkaProducerOptions) (*kgo.Client, error) {
+	acks, err := producerAcks(producer.Acks)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := producerCompression(producer.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(producer.Brokers...),
+		kgo.DefaultProduceTopic(producer.DefaultTopic),
+		kgo.ProduceRequestTimeout(producer.RequestTimeout),
+		kgo.RecordDeliveryTimeout(producer.DeliveryTimeout), // Дальше повторами управляет relay outbox
+		kgo.RequiredAcks(acks),
+		kgo.ProducerBatchCompression(compression),
+		kgo.ProducerLinger(producer.Linger),
+		kgo.ProducerBatchMaxBytes(producer.BatchMaxBytes),
+		kgo.ClientID("retailer-api"),
+	}
+	if !producer.Idempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	} else if producer.Acks != "all" {
+		// Идемпотентная запись в Kafka возможна только с подтверждением от всех реплик
+		return nil, fmt.Errorf("идемпотентный продюсер требует KAFKA_PRODUCER_ACKS=all, задано %q", producer.Acks)
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка инициализации Kafka-клиента: %w", err)
+	}
+	return client, nil
+}
+
+// producerAcks переводит KAFKA_PRODUCER_ACKS в уровень подтверждения записи
+func producerAcks(value string) (kgo.Acks, error) {
+	switch value {
+	case "all":
+		return kgo.AllISRAcks(), nil // Ждем, пока все реплики подтвердят запись
+	case "leader":
+		return kgo.LeaderAck(), nil
+	case "none":
+		return kgo.NoAck(), nil
+	}
+	return kgo.Acks{}, fmt.Errorf("неизвестное значение KAFKA_PRODUCER_ACKS %q", value)
+}
+
+// producerCompression переводит KAFKA_PRODUCER_COMPRESSION в кодек сжатия пачек
+func producerCompression(value string) (kgo.CompressionCodec, error) {
+	switch value {
+	case "none":
+		return kgo.NoCompression(), nil
+	case "gzip":
+		return kgo.GzipCompression(), nil
+	case "snappy":
+		return kgo.SnappyCompression(), nil
+	case "lz4":
+		return kgo.Lz4Compression(), nil
+	case "zstd":
+		return kgo.ZstdCompression(), nil
+	}
+	return kgo.CompressionCodec{}, fmt.Errorf("неизвестное значение KAFKA_PRODUCER_COMPRESSION %q", value)
+}
+
+// KafkaOrderPublisher публикует заказы в Kafka через transactional outbox
+type KafkaOrderPublisher struct {
+	client        *kgo.Client
+	topic         string
+	commandsTopic string
+	topicConfig   KafkaTopicOptions
+	partitionKey  string
+	source        string
+	admin         *kadm.Client
+	outbox        *Outbox
+	relay         *OutboxRelay
+	stopRelay     context.CancelFunc
+	relayStopped  chan struct{}
+}
+
+// NewKafkaOrderPublisher создает публикатор поверх готового Kafka-клиента и запускает relay outbox.
+// Клиент и outbox принадлежат вызывающему коду и не закрываются в Shutdown.
+func NewKafkaOrderPublisher(client *kgo.Client, opts KafkaPublisherOptions, outbox *Outbox) (*KafkaOrderPublisher, error) {
+	switch opts.PartitionKey {
+	case PartitionByOrderID, PartitionByCustomerID:
+	default:
+		return nil, fmt.Errorf("неизвестное значение KAFKA_PARTITION_KEY %q", opts.PartitionKey)
+	}
+
+	publisher := &KafkaOrderPublisher{
+		client:        client,
+		topic:         opts.OrdersTopic,
+		commandsTopic: opts.CommandsTopic,
+		topicConfig:   opts.Topic,
+		partitionKey:  opts.PartitionKey,
+		source:        opts.Source,
+		admin:         kadm.NewClient(client), // Административный клиент для управления топиками
+		outbox:        outbox,
+		relay:         NewOutboxRelay(outbox, client),
+		relayStopped:  make(chan struct{}),
+	}
+
+	// Создаем топики или приводим существующие к заданной конфигурации
+	for _, topic := range []string{opts.OrdersTopic, opts.CommandsTopic} {
+		if err := publisher.EnsureTopicExists(topic); err != nil {
+			return nil, fmt.Errorf("ошибка подготовки топика %s: %w", topic, err)
+		}
+	}
+
+	// Relay отправляет в Kafka все, что накопилось в outbox, в том числе до рестарта
+	ctx, cancel := context.WithCancel(context.Background())
+	publisher.stopRelay = cancel
+	go func() {
+		defer close(publisher.relayStopped)
+		publisher.relay.Run(ctx)
+	}()
+
+	return publisher, nil
+}
+
+// EnsureTopicExists создает топик, если он отсутствует, а существующий приводит к конфигурации:
+// добавляет недостающие партиции и обновляет отличающиеся параметры топика.
+// Уменьшить число партиций или изменить фактор репликации Kafka не позволяет - об этом только пишем в лог.
+func (p *KafkaOrderPublisher) EnsureTopicExists(topic string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.StartInfrastructure(ctx, "EnsureTopicExists", tracing.SubLayerBroker)
+	defer span.End()
+
+	desired := p.topicConfig
+	span.SetAttributes(
+		attribute.String("kafka.topic", topic),
+		attribute.Int("kafka.topic.partitions", int(desired.Partitions)),
+		attribute.Int("kafka.topic.replication_factor", int(desired.ReplicationFactor)),
+	)
+
+	topicMetadata, err := p.admin.ListTopics(ctx, topic)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка получения списка топиков: %w", err)
+	}
+
+	if !topicMetadata.Has(topic) {
+		configs := make(map[string]*string, len(desired.Configs))
+		for name, value := range desired.Configs {
+			configs[name] = toPtr(value)
+		}
+		resp, err := p.admin.CreateTopic(ctx, desired.Partitions, desired.ReplicationFactor, configs, topic)
+		if err == nil {
+			err = resp.Err
+		}
+		if err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("ошибка создания топика %s: %w", topic, err)
+		}
+
+		span.SetAttributes(attribute.Bool("topic.created", true))
+		log.Printf("Топик %s успешно создан (партиций: %d, реплик: %d)", topic, desired.Partitions, desired.ReplicationFactor)
+		return nil
+	}
+
+	span.SetAttributes(attribute.Bool("topic.exists", true))
+	detail := topicMetadata[topic]
+	if detail.Err != nil {
+		span.RecordError(detail.Err)
+		return fmt.Errorf("ошибка получения метаданных топика %s: %w", topic, detail.Err)
+	}
+
+	// Партиции
+	partitions := int32(len(detail.Partitions))
+	switch {
+	case partitions < desired.Partitions:
+		resp, err := p.admin.UpdatePartitions(ctx, int(desired.Partitions), topic)
+		if err == nil {
+			err = resp[topic].Err
+		}
+		if err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("ошибка увеличения числа партиций топика %s: %w", topic, err)
+		}
+		span.SetAttributes(attribute.Bool("topic.partitions.updated", true))
+		log.Printf("Число партиций топика %s увеличено с %d до %d", topic, partitions, desired.Partitions)
+	case partitions > desired.Partitions:
+		log.Printf("Топик %s имеет %d партиций, больше заданных %d; уменьшение не поддерживается Kafka", topic, partitions, desired.Partitions)
+	}
+
+	// Фактор репликации
+	if replicas := detail.Partitions.NumReplicas(); replicas != int(desired.ReplicationFactor) {
+		log.Printf("Топик %s имеет фактор репликации %d вместо %d; требуется переназначение партиций вручную", topic, replicas, desired.ReplicationFactor)
+	}
+
+	// Параметры топика
+	if err := p.reconcileTopicConfigs(ctx, topic); err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	log.Printf("Топик %s уже существует, конфигурация проверена", topic)
+	return nil
+}
+
+// reconcileTopicConfigs обновляет параметры топика, значения которых отличаются от заданных
+func (p *KafkaOrderPublisher) reconcileTopicConfigs(ctx context.Context, topic string) error {
+	if len(p.topicConfig.Configs) == 0 {
+		return nil
+	}
+
+	described, err := p.admin.DescribeTopicConfigs(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("ошибка получения параметров топика %s: %w", topic, err)
+	}
+	current, err := described.On(topic, nil)
+	if err == nil {
+		err = current.Err
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка получения параметров топика %s: %w", topic, err)
+	}
+
+	actual := make(map[string]string, len(current.Configs))
+	for _, cfg := range current.Configs {
+		if cfg.Value != nil {
+			actual[cfg.Key] = *cfg.Value
+		}
+	}
+
+	var alter []kadm.AlterConfig
+	for name, value := range p.topicConfig.Configs {
+		if actual[name] != value {
+			alter = append(alter, kadm.AlterConfig{Op: kadm.SetConfig, Name: name, Value: toPtr(value)})
+			log.Printf("Параметр %s топика %s: %q -> %q", name, topic, actual[name], value)
+		}
+	}
+	if len(alter) == 0 {
+		return nil
+	}
+
+	resp, err := p.admin.AlterTopicConfigs(ctx, alter, topic)
+	if err == nil {
+		var altered kadm.AlterConfigsResponse
+		altered, err = resp.On(topic, nil)
+		if err == nil {
+			err = altered.Err
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка изменения параметров топика %s: %w", topic, err)
+	}
+	return nil
+}
+
+// Вспомогательная функция для преобразования строки в *string
+func toPtr(val string) *string {
+	return &val
+}
+
+// recordKey возвращает ключ партиционирования заказа.
+// Покупатель берется из JWT, а при отключенной аутентификации - из поля customer_id тела заказа.
+// Если покупатель неизвестен, используется id заказа.
+func (p *KafkaOrderPublisher) recordKey(order domain.Order) (string, string) {
+	if p.partitionKey == PartitionByCustomerID {
+		if order.CustomerID != "" {
+			return order.CustomerID, PartitionByCustomerID
+		}
+		if customerID, ok := order.Payload["customer_id"]; ok && customerID != nil {
+			if key := fmt.Sprint(customerID); key != "" {
+				return key, PartitionByCustomerID
+			}
+		}
+	}
+	return order.ID, PartitionByOrderID
+}
+
+// PublishOrder сохраняет заказ в outbox; в Kafka его отправит relay.
+// Ошибка возвращается, только если заказ не удалось сохранить локально.
+func (p *KafkaOrderPublisher) PublishOrder(ctx context.Context, order domain.Order) error {
+	ctx, span := tracing.StartInfrastructure(ctx, "PublishOrder", tracing.SubLayerBroker)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("kafka.topic", p.topic))
+	span.SetAttributes(attribute.String("order.id", order.ID))
+
+	// traceparent сохраняется в строке outbox, чтобы асинхронная связь с OMS вела к этому спану
+	headers := tracing.InjectTraceContextToKafka(ctx)
+
+	// Тело сериализуется по версионируемой схеме, версия уходит в заголовках
+	data, schemaHeaders, err := messages.EncodeOrder(order, time.Now().UTC())
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	headers = append(headers, schemaHeaders...)
+
+	// Атрибуты CloudEvents (binary mode) делают сообщение самоописываемым
+	event := events.New(p.source, events.TypeOrderCreated, order.ID)
+	event.DataSchema = messages.OrderDataSchema
+	headers = append(headers, event.Headers()...)
+
+	span.SetAttributes(
+		attribute.Int("messaging.schema.version", messages.OrderSchemaLatest),
+		attribute.String("messaging.event.id", event.ID),
+		attribute.String("messaging.event.type", event.Type),
+	)
+
+	// Ключ определяет партицию, а значит и порядок обработки заказов в OMS
+	key, keySource := p.recordKey(order)
+	span.SetAttributes(attribute.String("kafka.partition_key", keySource))
+
+	entry := OutboxEntry{
+		Topic: p.topic,
+		Key:   []byte(key),
+		Value: data,
+	}
+	for _, h := range headers {
+		entry.Headers = append(entry.Headers, OutboxHeader{Key: h.Key, Value: string(h.Value)})
+	}
+
+	if err := p.outbox.Add(ctx, entry); err != nil {
+		span.RecordError(err)
+		log.Printf("Не удалось сохранить заказ %s в outbox: %v", order.ID, err)
+		return err
+	}
+
+	log.Printf("Заказ %s сохранен в outbox (топик: %s)", order.ID, p.topic)
+	return nil
+}
+
+// PublishCancel сохраняет команду отмены заказа в outbox; relay отправит ее в топик команд OMS.
+// Ключ - id заказа, чтобы команды по одному заказу не переупорядочивались.
+func (p *KafkaOrderPublisher) PublishCancel(ctx context.Context, command domain.CancelOrderCommand) error {
+	ctx, span := tracing.StartInfrastructure(ctx, "PublishCancel", tracing.SubLayerBroker)
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("kafka.topic", p.commandsTopic),
+		attribute.String("order.id", command.OrderID),
+	)
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка сериализации команды отмены заказа %s: %w", command.OrderID, err)
+	}
+
+	event := events.New(p.source, events.TypeOrderCancelRequested, command.OrderID)
+	headers := tracing.InjectTraceContextToKafka(ctx)
+	headers = append(headers, kgo.RecordHeader{Key: messages.HeaderContentType, Value: []byte(messages.ContentTypeJSON)})
+	headers = append(headers, event.Headers()...)
+
+	span.SetAttributes(
+		attribute.String("messaging.event.id", event.ID),
+		attribute.String("messaging.event.type", event.Type),
+	)
+
+	entry := OutboxEntry{
+		Topic: p.commandsTopic,
+		Key:   []byte(command.OrderID),
+		Value: data,
+	}
+	for _, h := range headers {
+		entry.Headers = append(entry.Headers, OutboxHeader{Key: h.Key, Value: string(h.Value)})
+	}
+
+	if err := p.outbox.Add(ctx, entry); err != nil {
+		span.RecordError(err)
+		log.Printf("Не удалось сохранить команду отмены заказа %s в outbox: %v", command.OrderID, err)
+		return err
+	}
+
+	log.Printf("Команда отмены заказа %s сохранена в outbox (топик: %s)", command.OrderID, p.commandsTopic)
+	return nil
+}
+
+// Backlog возвращает число заказов, еще не подтвержденных Kafka.
+// Outbox - буфер перед продюсером: запись остается в нем, пока Kafka не подтвердит ее,
+// поэтому записи в буфере клиента (BufferedProduceRecords) уже учтены.
+func (p *KafkaOrderPublisher) Backlog() int64 {
+	return p.outbox.Pending()
+}
+
+// Ping проверяет, что метаданные топика заказов доступны в Kafka
+func (p *KafkaOrderPublisher) Ping(ctx context.Context) error {
+	topics, err := p.admin.ListTopics(ctx, p.topic)
+	if err != nil {
+		return fmt.Errorf("ошибка получения метаданных Kafka: %w", err)
+	}
+	detail, ok := topics[p.topic]
+	if !ok {
+		return fmt.Errorf("топик %s не найден", p.topic)
+	}
+	return detail.Err
+}
+
+// Shutdown останавливает relay, досылает накопленные в outbox записи и ждет подтверждения Kafka.
+// Клиент и outbox после этого можно закрывать.
+func (p *KafkaOrderPublisher) Shutdown(ctx context.Context) error {
+	p.stopRelay()
+	<-p.relayStopped
+
+	if err := p.relay.Drain(ctx); err != nil {
+		return err
+	}
+	return p.client.Flush(ctx)
+}
@@ -0,0 +1,476 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/messages"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	testOrdersTopic   = "orders"
+	testCommandsTopic = "order-commands"
+	testSource        = "/retailer-api/test"
+)
+
+// newTestCluster запускает Kafka в памяти процесса
+func newTestCluster(t *testing.T, opts ...kfake.Opt) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(append([]kfake.Opt{kfake.NumBrokers(1)}, opts...)...)
+	if err != nil {
+		t.Fatalf("kfake: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+// newTestClient создает клиент продюсера с настройками по умолчанию из конфига
+func newTestClient(t *testing.T, cluster *kfake.Cluster) *kgo.Client {
+	t.Helper()
+	client, err := NewKafkaClient(KafkaProducerOptions{
+		Brokers:         cluster.ListenAddrs(),
+		DefaultTopic:    testOrdersTopic,
+		Acks:            "all",
+		Idempotent:      true,
+		Compression:     "none",
+		BatchMaxBytes:   1000012,
+		RequestTimeout:  5 * time.Second,
+		DeliveryTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewKafkaClient: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func newTestOutbox(t *testing.T) *Outbox {
+	t.Helper()
+	outbox, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatalf("OpenOutbox: %v", err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+	return outbox
+}
+
+func newTestPublisher(t *testing.T, cluster *kfake.Cluster, opts KafkaPublisherOptions) (*KafkaOrderPublisher, *Outbox) {
+	t.Helper()
+	outbox := newTestOutbox(t)
+	publisher, err := NewKafkaOrderPublisher(newTestClient(t, cluster), opts, outbox)
+	if err != nil {
+		t.Fatalf("NewKafkaOrderPublisher: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		publisher.Shutdown(ctx)
+	})
+	return publisher, outbox
+}
+
+func testPublisherOptions() KafkaPublisherOptions {
+	return KafkaPublisherOptions{
+		OrdersTopic:   testOrdersTopic,
+		CommandsTopic: testCommandsTopic,
+		Topic:         KafkaTopicOptions{Partitions: 3, ReplicationFactor: 1},
+		PartitionKey:  PartitionByOrderID,
+		Source:        testSource,
+	}
+}
+
+// consume читает из топика n записей с начала
+func consume(t *testing.T, cluster *kfake.Cluster, topic string, n int) []*kgo.Record {
+	t.Helper()
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatalf("consumer: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var records []*kgo.Record
+	for len(records) < n {
+		fetches := client.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("получено %d записей из %d в топике %s", len(records), n, topic)
+		}
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
+
+// waitPending ждет, пока relay не отправит все записи outbox
+func waitPending(t *testing.T, outbox *Outbox) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for outbox.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("в outbox осталось %d неотправленных записей", outbox.Pending())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func header(record *kgo.Record, key string) string {
+	for _, h := range record.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestKafkaOrderPublisherPublishOrder(t *testing.T) {
+	cluster := newTestCluster(t)
+	opts := testPublisherOptions()
+	opts.PartitionKey = PartitionByCustomerID
+	publisher, outbox := newTestPublisher(t, cluster, opts)
+
+	order := domain.Order{
+		ID:         "order-1",
+		Status:     domain.StatusNew,
+		CustomerID: "customer-1",
+		Payload:    map[string]interface{}{"sku": "A-1"},
+	}
+	if err := publisher.PublishOrder(context.Background(), order); err != nil {
+		t.Fatalf("PublishOrder: %v", err)
+	}
+	waitPending(t, outbox)
+
+	record := consume(t, cluster, testOrdersTopic, 1)[0]
+	if string(record.Key) != order.CustomerID {
+		t.Errorf("ключ записи %q, ожидался покупатель %q", record.Key, order.CustomerID)
+	}
+	if got := header(record, events.HeaderType); got != events.TypeOrderCreated {
+		t.Errorf("%s = %q, ожидался %q", events.HeaderType, got, events.TypeOrderCreated)
+	}
+	if got := header(record, events.HeaderSource); got != testSource {
+		t.Errorf("%s = %q, ожидался %q", events.HeaderSource, got, testSource)
+	}
+
+	msg, version, err := messages.DecodeOrder(record.Headers, record.Value)
+	if err != nil {
+		t.Fatalf("DecodeOrder: %v", err)
+	}
+	if version != messages.OrderSchemaLatest {
+		t.Errorf("версия схемы %d, ожидалась %d", version, messages.OrderSchemaLatest)
+	}
+	if msg.OrderID != order.ID || msg.CustomerID != order.CustomerID || msg.Payload["sku"] != "A-1" {
+		t.Errorf("сообщение %+v не соответствует заказу %+v", msg, order)
+	}
+}
+
+func TestKafkaOrderPublisherPublishOrderKeyFallsBackToOrderID(t *testing.T) {
+	cluster := newTestCluster(t)
+	opts := testPublisherOptions()
+	opts.PartitionKey = PartitionByCustomerID
+	publisher, outbox := newTestPublisher(t, cluster, opts)
+
+	// Без покупателя в JWT и в теле заказа ключом остается id заказа
+	order := domain.Order{ID: "order-2", Status: domain.StatusNew, Payload: map[string]interface{}{}}
+	if err := publisher.PublishOrder(context.Background(), order); err != nil {
+		t.Fatalf("PublishOrder: %v", err)
+	}
+	waitPending(t, outbox)
+
+	if record := consume(t, cluster, testOrdersTopic, 1)[0]; string(record.Key) != order.ID {
+		t.Errorf("ключ записи %q, ожидался id заказа %q", record.Key, order.ID)
+	}
+}
+
+func TestKafkaOrderPublisherPublishCancel(t *testing.T) {
+	cluster := newTestCluster(t)
+	publisher, outbox := newTestPublisher(t, cluster, testPublisherOptions())
+
+	command := domain.CancelOrderCommand{
+		OrderID:     "order-1",
+		CustomerID:  "customer-1",
+		Reason:      "передумал",
+		RequestedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if err := publisher.PublishCancel(context.Background(), command); err != nil {
+		t.Fatalf("PublishCancel: %v", err)
+	}
+	waitPending(t, outbox)
+
+	record := consume(t, cluster, testCommandsTopic, 1)[0]
+	if string(record.Key) != command.OrderID {
+		t.Errorf("ключ записи %q, ожидался id заказа %q", record.Key, command.OrderID)
+	}
+	if got := header(record, events.HeaderType); got != events.TypeOrderCancelRequested {
+		t.Errorf("%s = %q, ожидался %q", events.HeaderType, got, events.TypeOrderCancelRequested)
+	}
+
+	var got domain.CancelOrderCommand
+	if err := json.Unmarshal(record.Value, &got); err != nil {
+		t.Fatalf("команда отмены: %v", err)
+	}
+	if got.OrderID != command.OrderID || got.CustomerID != command.CustomerID || got.Reason != command.Reason ||
+		!got.RequestedAt.Equal(command.RequestedAt) {
+		t.Errorf("команда %+v, ожидалась %+v", got, command)
+	}
+}
+
+func TestKafkaOrderPublisherRejectsUnknownPartitionKey(t *testing.T) {
+	cluster := newTestCluster(t)
+	opts := testPublisherOptions()
+	opts.PartitionKey = "sku"
+
+	if _, err := NewKafkaOrderPublisher(newTestClient(t, cluster), opts, newTestOutbox(t)); err == nil {
+		t.Fatal("ожидалась ошибка для неизвестного KAFKA_PARTITION_KEY")
+	}
+}
+
+func TestEnsureTopicExistsReconcilesExistingTopic(t *testing.T) {
+	cluster := newTestCluster(t)
+	admin := kadm.NewClient(newTestClient(t, cluster))
+
+	ctx := context.Background()
+	if _, err := admin.CreateTopic(ctx, 1, 1, map[string]*string{"retention.ms": toPtr("604800000")}, testOrdersTopic); err != nil {
+		t.Fatalf("CreateTopic: %v", err)
+	}
+
+	opts := testPublisherOptions()
+	opts.Topic = KafkaTopicOptions{
+		Partitions:        3,
+		ReplicationFactor: 1,
+		Configs:           map[string]string{"retention.ms": "3600000"},
+	}
+	newTestPublisher(t, cluster, opts)
+
+	topics, err := admin.ListTopics(ctx, testOrdersTopic, testCommandsTopic)
+	if err != nil {
+		t.Fatalf("ListTopics: %v", err)
+	}
+	if got := len(topics[testOrdersTopic].Partitions); got != 3 {
+		t.Errorf("у существующего топика %d партиций, ожидалось 3", got)
+	}
+	if !topics.Has(testCommandsTopic) {
+		t.Errorf("топик %s не создан", testCommandsTopic)
+	}
+
+	for _, topic := range []string{testOrdersTopic, testCommandsTopic} {
+		described, err := admin.DescribeTopicConfigs(ctx, topic)
+		if err != nil {
+			t.Fatalf("DescribeTopicConfigs: %v", err)
+		}
+		config, err := described.On(topic, nil)
+		if err != nil {
+			t.Fatalf("DescribeTopicConfigs %s: %v", topic, err)
+		}
+		var retention string
+		for _, c := range config.Configs {
+			if c.Key == "retention.ms" && c.Value != nil {
+				retention = *c.Value
+			}
+		}
+		if retention != "3600000" {
+			t.Errorf("retention.ms топика %s = %q, ожидалось 3600000", topic, retention)
+		}
+	}
+}
+
+func TestOutboxRelayRetriesFailedEntriesInOrder(t *testing.T) {
+	cluster := newTestCluster(t, kfake.SeedTopics(1, testOrdersTopic))
+	outbox := newTestOutbox(t)
+	relay := NewOutboxRelay(outbox, newTestClient(t, cluster))
+
+	ctx := context.Background()
+	for _, value := range []string{"first", "second"} {
+		if err := outbox.Add(ctx, OutboxEntry{Topic: testOrdersTopic, Key: []byte("customer-1"), Value: []byte(value)}); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	// Брокер отклоняет первую запись
+	cluster.ControlKey(int16(kmsg.Produce), func(kreq kmsg.Request) (kmsg.Response, error, bool) {
+		req := kreq.(*kmsg.ProduceRequest)
+		resp := req.ResponseKind().(*kmsg.ProduceResponse)
+		for _, rt := range req.Topics {
+			st := kmsg.NewProduceResponseTopic()
+			st.Topic = rt.Topic
+			for _, rp := range rt.Partitions {
+				sp := kmsg.NewProduceResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.ErrorCode = kerr.InvalidRecord.Code
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		return resp, nil, true
+	})
+
+	sent, err := relay.relayBatch(ctx)
+	if err != nil {
+		t.Fatalf("relayBatch: %v", err)
+	}
+	if sent != 0 || outbox.Pending() != 2 {
+		t.Fatalf("отправлено %d, в outbox %d записей; ожидалось 0 и 2", sent, outbox.Pending())
+	}
+
+	// Следующая запись ключа не обгоняет неотправленную, даже когда брокер снова доступен
+	if sent, err := relay.relayBatch(ctx); err != nil || sent != 0 {
+		t.Fatalf("до повтора отправлено %d записей (ошибка %v), ожидалось 0", sent, err)
+	}
+
+	time.Sleep(outboxBackoff(0))
+	if err := relay.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if outbox.Pending() != 0 {
+		t.Fatalf("в outbox осталось %d записей", outbox.Pending())
+	}
+
+	records := consume(t, cluster, testOrdersTopic, 2)
+	if string(records[0].Value) != "first" || string(records[1].Value) != "second" {
+		t.Errorf("записи ключа пришли в порядке %q, %q", records[0].Value, records[1].Value)
+	}
+}
+
+func TestOutboxRelayMovesExhaustedEntryToFailed(t *testing.T) {
+	outbox := newTestOutbox(t)
+
+	ctx := context.Background()
+	if err := outbox.Add(ctx, OutboxEntry{Topic: testOrdersTopic, Key: []byte("customer-1"), Value: []byte("v")}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		entries, err := outbox.Due(time.Now().Add(time.Hour), outboxBatchSize)
+		if err != nil {
+			t.Fatalf("Due: %v", err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("попытка %d: готово %d записей, ожидалась 1", attempt, len(entries))
+		}
+		exhausted, err := outbox.MarkFailed(entries[0], kerr.InvalidRecord, time.Now())
+		if err != nil {
+			t.Fatalf("MarkFailed: %v", err)
+		}
+		if exhausted {
+			if attempt != outboxMaxAttempts {
+				t.Fatalf("запись перенесена после %d попыток, ожидалось %d", attempt, outboxMaxAttempts)
+			}
+			break
+		}
+	}
+
+	if outbox.Pending() != 0 {
+		t.Errorf("в outbox осталось %d записей", outbox.Pending())
+	}
+	if entries, err := outbox.Due(time.Now().Add(time.Hour), outboxBatchSize); err != nil || len(entries) != 0 {
+		t.Errorf("после переноса готово %d записей (ошибка %v)", len(entries), err)
+	}
+}
+
+// dueValues возвращает значения записей outbox, готовых к моменту now
+func dueValues(t *testing.T, outbox *Outbox, now time.Time) []string {
+	t.Helper()
+	entries, err := outbox.Due(now, outboxBatchSize)
+	if err != nil {
+		t.Fatalf("Due: %v", err)
+	}
+	values := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		values = append(values, string(entry.Value))
+	}
+	return values
+}
+
+func TestOutboxDueReturnsFirstEntryOfEachKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	outbox, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatalf("OpenOutbox: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, entry := range []OutboxEntry{
+		{Topic: testOrdersTopic, Key: []byte("customer-1"), Value: []byte("c1-first")},
+		{Topic: testOrdersTopic, Key: []byte("customer-2"), Value: []byte("c2-first")},
+		{Topic: testOrdersTopic, Key: []byte("customer-1"), Value: []byte("c1-second")},
+		{Topic: testCommandsTopic, Key: []byte("customer-1"), Value: []byte("cmd-first")},
+	} {
+		if err := outbox.Add(ctx, entry); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	now := time.Now()
+	entries, err := outbox.Due(now, outboxBatchSize)
+	if err != nil {
+		t.Fatalf("Due: %v", err)
+	}
+	if got := dueValues(t, outbox, now); !slices.Equal(got, []string{"c1-first", "c2-first", "cmd-first"}) {
+		t.Fatalf("готовы записи %q", got)
+	}
+
+	// Запись на повторе задерживает свой ключ, но не остальные
+	retryAt := now.Add(time.Minute)
+	if _, err := outbox.MarkFailed(entries[0], kerr.InvalidRecord, retryAt); err != nil {
+		t.Fatalf("MarkFailed: %v", err)
+	}
+	if err := outbox.MarkSent(entries[1], entries[2]); err != nil {
+		t.Fatalf("MarkSent: %v", err)
+	}
+	if got := dueValues(t, outbox, now); len(got) != 0 {
+		t.Fatalf("до повтора готовы записи %q", got)
+	}
+	if next, err := outbox.NextAttemptAt(); err != nil || !next.Equal(retryAt) {
+		t.Fatalf("следующая попытка %v (ошибка %v), ожидалась %v", next, err, retryAt)
+	}
+
+	// Файл без индексов (созданный прежней версией) индексируется при открытии
+	if err := outbox.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatalf("bolt: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(outboxQueueBucket); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(outboxDueBucket)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("удаление индексов: %v", err)
+	}
+	outbox, err = OpenOutbox(path)
+	if err != nil {
+		t.Fatalf("OpenOutbox: %v", err)
+	}
+	defer outbox.Close()
+
+	entries, err = outbox.Due(retryAt, outboxBatchSize)
+	if err != nil || len(entries) != 1 || string(entries[0].Value) != "c1-first" {
+		t.Fatalf("после повторного открытия готовы %d записей (ошибка %v)", len(entries), err)
+	}
+	if err := outbox.MarkSent(entries[0]); err != nil {
+		t.Fatalf("MarkSent: %v", err)
+	}
+	if got := dueValues(t, outbox, retryAt); !slices.Equal(got, []string{"c1-second"}) {
+		t.Fatalf("после отправки первой записи ключа готовы %q", got)
+	}
+}
@@ -0,0 +1,62 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MemoryOrderPublisher складывает заказы в память - для локального запуска и тестов без Kafka
+type MemoryOrderPublisher struct {
+	mu      sync.Mutex
+	orders  []domain.Order
+	cancels []domain.CancelOrderCommand
+}
+
+// NewMemoryOrderPublisher создает пустой публикатор в памяти
+func NewMemoryOrderPublisher() *MemoryOrderPublisher {
+	return &MemoryOrderPublisher{}
+}
+
+// PublishOrder сохраняет заказ в памяти
+func (p *MemoryOrderPublisher) PublishOrder(ctx context.Context, order domain.Order) error {
+	_, span := tracing.StartInfrastructure(ctx, "PublishOrder", tracing.SubLayerCache)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order.id", order.ID))
+
+	p.mu.Lock()
+	p.orders = append(p.orders, order)
+	p.mu.Unlock()
+	return nil
+}
+
+// PublishCancel сохраняет команду отмены в памяти
+func (p *MemoryOrderPublisher) PublishCancel(ctx context.Context, command domain.CancelOrderCommand) error {
+	_, span := tracing.StartInfrastructure(ctx, "PublishCancel", tracing.SubLayerCache)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order.id", command.OrderID))
+
+	p.mu.Lock()
+	p.cancels = append(p.cancels, command)
+	p.mu.Unlock()
+	return nil
+}
+
+// Orders возвращает копию опубликованных заказов
+func (p *MemoryOrderPublisher) Orders() []domain.Order {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]domain.Order(nil), p.orders...)
+}
+
+// Cancels возвращает копию опубликованных команд отмены
+func (p *MemoryOrderPublisher) Cancels() []domain.CancelOrderCommand {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]domain.CancelOrderCommand(nil), p.cancels...)
+}
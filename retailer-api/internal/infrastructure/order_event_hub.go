@@ -0,0 +1,110 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// orderEventBuffer - сколько изменений может накопиться у медленного подписчика до отключения
+const orderEventBuffer = 64
+
+// OrderEventHub рассылает изменения статусов заказов подписчикам в памяти процесса
+type OrderEventHub struct {
+	mu          sync.Mutex
+	subscribers map[*orderSubscriber]struct{}
+	closed      bool
+}
+
+type orderSubscriber struct {
+	customerID string              // Пусто - заказы всех покупателей
+	orderIDs   map[string]struct{} // Пусто - все заказы
+	updates    chan domain.OrderStatusUpdate
+}
+
+// NewOrderEventHub создает хаб без подписчиков
+func NewOrderEventHub() *OrderEventHub {
+	return &OrderEventHub{subscribers: make(map[*orderSubscriber]struct{})}
+}
+
+// Publish отправляет изменение всем подписчикам заказа, не блокируясь на медленных.
+// Подписчик, который не успевает читать, отключается: клиент переподключится и получит актуальный снимок.
+func (h *OrderEventHub) Publish(ctx context.Context, update domain.OrderStatusUpdate) {
+	_, span := tracing.StartInfrastructure(ctx, "PublishOrderEvent", tracing.SubLayerCache)
+	defer span.End()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delivered, dropped := 0, 0
+	for sub := range h.subscribers {
+		if sub.customerID != "" && sub.customerID != update.CustomerID {
+			continue
+		}
+		if len(sub.orderIDs) > 0 {
+			if _, ok := sub.orderIDs[update.OrderID]; !ok {
+				continue
+			}
+		}
+		select {
+		case sub.updates <- update:
+			delivered++
+		default:
+			delete(h.subscribers, sub)
+			close(sub.updates)
+			dropped++
+		}
+	}
+
+	span.SetAttributes(
+		attribute.String("order.id", update.OrderID),
+		attribute.Int("subscribers.delivered", delivered),
+		attribute.Int("subscribers.dropped", dropped),
+	)
+}
+
+// Subscribe подписывает на изменения заказов orderIDs (пустой список - все заказы) покупателя customerID
+// (пустой - всех покупателей). Канал закрывается при вызове cancel, отключении медленного подписчика или остановке хаба.
+func (h *OrderEventHub) Subscribe(customerID string, orderIDs []string) (<-chan domain.OrderStatusUpdate, func()) {
+	sub := &orderSubscriber{
+		customerID: customerID,
+		orderIDs:   make(map[string]struct{}, len(orderIDs)),
+		updates:    make(chan domain.OrderStatusUpdate, orderEventBuffer),
+	}
+	for _, id := range orderIDs {
+		sub.orderIDs[id] = struct{}{}
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		close(sub.updates)
+	} else {
+		h.subscribers[sub] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[sub]; ok {
+			delete(h.subscribers, sub)
+			close(sub.updates)
+		}
+	}
+	return sub.updates, cancel
+}
+
+// Close закрывает все подписки, чтобы долгие SSE-соединения не задерживали остановку HTTP-сервера
+func (h *OrderEventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.updates)
+	}
+}
@@ -0,0 +1,125 @@
+package infrastructure
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// OrderStatusStore хранит read-модель статусов заказов в памяти
+type OrderStatusStore struct {
+	mu     sync.RWMutex
+	orders map[string]*domain.OrderView
+}
+
+// NewOrderStatusStore создает пустое хранилище read-модели
+func NewOrderStatusStore() *OrderStatusStore {
+	return &OrderStatusStore{orders: make(map[string]*domain.OrderView)}
+}
+
+// AppendChange добавляет переход статуса в историю заказа и пересчитывает текущий статус.
+// Непустой customerID запоминается как владелец заказа.
+// Возвращает false, если такой переход уже был записан (повторная доставка события).
+func (s *OrderStatusStore) AppendChange(ctx context.Context, orderID, customerID string, change domain.StatusChange) (bool, error) {
+	_, span := tracing.StartInfrastructure(ctx, "AppendStatusChange", tracing.SubLayerCache)
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", orderID),
+		attribute.String("order.status", string(change.Status)),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	view, ok := s.orders[orderID]
+	if !ok {
+		view = &domain.OrderView{ID: orderID, CreatedAt: change.OccurredAt}
+		s.orders[orderID] = view
+	}
+	if customerID != "" {
+		view.CustomerID = customerID
+	}
+
+	// События доставляются как минимум один раз - дубликаты пропускаем
+	for _, existing := range view.History {
+		if existing.Status == change.Status && existing.Step == change.Step && existing.OccurredAt.Equal(change.OccurredAt) {
+			span.SetAttributes(attribute.Bool("order.duplicate", true))
+			return false, nil
+		}
+	}
+
+	// События разных партиций могут прийти не по порядку, поэтому история сортируется по времени
+	view.History = append(view.History, change)
+	sort.SliceStable(view.History, func(i, j int) bool {
+		return view.History[i].OccurredAt.Before(view.History[j].OccurredAt)
+	})
+
+	if change.Status == domain.StatusNew {
+		view.TraceID = change.TraceID
+		view.CreatedAt = change.OccurredAt
+	} else if view.TraceID == "" {
+		view.TraceID = change.TraceID
+	}
+
+	last := view.History[len(view.History)-1]
+	view.Status = last.Status
+	view.UpdatedAt = last.OccurredAt
+	return true, nil
+}
+
+// Get возвращает копию read-модели заказа
+func (s *OrderStatusStore) Get(ctx context.Context, orderID string) (domain.OrderView, error) {
+	_, span := tracing.StartInfrastructure(ctx, "GetOrderView", tracing.SubLayerCache)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order.id", orderID))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	view, ok := s.orders[orderID]
+	if !ok {
+		span.SetAttributes(attribute.Bool("order.found", false))
+		return domain.OrderView{}, domain.ErrOrderNotFound
+	}
+	return copyOrderView(view), nil
+}
+
+// List возвращает заказы в указанном статусе (или все, если статус пустой), от старых к новым.
+// Непустой customerID оставляет только заказы этого покупателя.
+func (s *OrderStatusStore) List(ctx context.Context, status domain.OrderStatus, customerID string) ([]domain.OrderView, error) {
+	_, span := tracing.StartInfrastructure(ctx, "ListOrderViews", tracing.SubLayerCache)
+	defer span.End()
+
+	s.mu.RLock()
+	views := make([]domain.OrderView, 0, len(s.orders))
+	for _, view := range s.orders {
+		if (status == "" || view.Status == status) && (customerID == "" || view.CustomerID == customerID) {
+			views = append(views, copyOrderView(view))
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].CreatedAt.Before(views[j].CreatedAt)
+	})
+
+	span.SetAttributes(
+		attribute.String("order.status", string(status)),
+		attribute.String("enduser.id", customerID),
+		attribute.Int("orders.count", len(views)),
+	)
+	return views, nil
+}
+
+// copyOrderView отдает наружу копию, чтобы вызывающий код не гонялся с AppendChange
+func copyOrderView(view *domain.OrderView) domain.OrderView {
+	res := *view
+	res.History = append([]domain.StatusChange(nil), view.History...)
+	return res
+}
@@ -0,0 +1,458 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	outboxMaxBatchDelay = 2 * time.Millisecond
+
+	// outboxMaxAttempts - после стольких неудачных попыток запись переносится в outbox_failed.
+	// С паузами до outboxRetryMax это около 10 минут: дольше не ждем, чтобы запись не висела вечно
+	outboxMaxAttempts = 25
+)
+
+var (
+	outboxPendingBucket = []byte("outbox_pending")
+	outboxSentBucket    = []byte("outbox_sent")
+	outboxFailedBucket  = []byte("outbox_failed") // Записи, которые не удалось отправить или прочитать; разбираются вручную
+
+	// Индексы неотправленных записей, чтобы relay не перечитывал весь outbox_pending на каждой пачке.
+	// В outbox_queue лежат записи каждого топика и ключа в порядке добавления, в outbox_due - только первая
+	// запись каждого ключа, упорядоченная по времени следующей попытки.
+	outboxQueueBucket = []byte("outbox_queue")
+	outboxDueBucket   = []byte("outbox_due")
+)
+
+// OutboxHeader - заголовок сообщения, сохраненный вместе с записью outbox
+type OutboxHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// OutboxEntry - сообщение, ожидающее публикации в Kafka
+type OutboxEntry struct {
+	ID            uint64         `json:"id"`
+	Topic         string         `json:"topic"`
+	Key           []byte         `json:"key"`
+	Value         []byte         `json:"value"`
+	Headers       []OutboxHeader `json:"headers"` // В том числе traceparent спана, создавшего запись
+	CreatedAt     time.Time      `json:"created_at"`
+	Attempts      int            `json:"attempts"`
+	LastError     string         `json:"last_error,omitempty"`
+	NextAttemptAt time.Time      `json:"next_attempt_at"`
+	SentAt        time.Time      `json:"sent_at,omitempty"`
+	FailedAt      time.Time      `json:"failed_at,omitempty"`
+}
+
+// Outbox - локальное хранилище исходящих сообщений на базе bbolt
+type Outbox struct {
+	db      *bolt.DB
+	notify  chan struct{}
+	pending atomic.Int64 // Число неотправленных записей; читается на каждый запрос при сбросе нагрузки
+}
+
+// OpenOutbox открывает (или создает) файл outbox
+func OpenOutbox(path string) (*Outbox, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия outbox %s: %w", path, err)
+	}
+
+	var pending int
+	err = db.Update(func(tx *bolt.Tx) error {
+		indexed := tx.Bucket(outboxDueBucket) != nil
+		for _, name := range [][]byte{outboxPendingBucket, outboxSentBucket, outboxFailedBucket, outboxQueueBucket, outboxDueBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		// Файл, созданный до появления индексов, индексируется один раз при открытии
+		if !indexed {
+			if err := reindexOutbox(tx); err != nil {
+				return err
+			}
+		}
+		pending = tx.Bucket(outboxPendingBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ошибка инициализации outbox: %w", err)
+	}
+
+	// Одиночный заказ не должен заметно ждать, пока накопится пачка записей
+	db.MaxBatchDelay = outboxMaxBatchDelay
+
+	outbox := &Outbox{db: db, notify: make(chan struct{}, 1)}
+	outbox.pending.Store(int64(pending))
+	return outbox, nil
+}
+
+// Add сохраняет сообщение в outbox и будит relay
+func (o *Outbox) Add(ctx context.Context, entry OutboxEntry) error {
+	_, span := tracing.StartInfrastructure(ctx, "SaveOutboxEntry", tracing.SubLayerFilesystem)
+	defer span.End()
+
+	// Batch объединяет одновременные записи (например, заказы из одной пачки) в одну транзакцию,
+	// чтобы не платить за fsync каждой записи отдельно
+	err := o.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(outboxPendingBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+		if entry.CreatedAt.IsZero() {
+			entry.CreatedAt = time.Now().UTC()
+		}
+		entry.NextAttemptAt = entry.CreatedAt
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		span.SetAttributes(attribute.Int64("outbox.id", int64(id)))
+		if err := bucket.Put(outboxKey(id), data); err != nil {
+			return err
+		}
+		return enqueueOutbox(tx, entry)
+	})
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка записи в outbox: %w", err)
+	}
+	o.pending.Add(1)
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Due возвращает до limit записей, готовых к отправке, в порядке времени их готовности.
+// Порядок сохраняется в пределах ключа: в пачку попадает не больше одной записи ключа, поэтому следующая
+// запись ключа отправляется только после подтверждения предыдущей, и ошибка не переставит их местами.
+// Ключ, запись которого ждет повтора, пропускается целиком, а записи других ключей ее не ждут.
+// Записи, которые не удается прочитать, переносятся в outbox_failed.
+func (o *Outbox) Due(now time.Time, limit int) ([]OutboxEntry, error) {
+	var entries []OutboxEntry
+	var broken []outboxIndexKey
+	err := o.db.View(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(outboxPendingBucket)
+		// В индексе готовности только первые записи ключей, поэтому чтение останавливается на первой неготовой
+		cursor := tx.Bucket(outboxDueBucket).Cursor()
+		for k, v := cursor.First(); k != nil && len(entries) < limit; k, v = cursor.Next() {
+			if outboxDueTime(k).After(now) {
+				break
+			}
+			var entry OutboxEntry
+			if err := json.Unmarshal(pending.Get(k[8:]), &entry); err != nil {
+				broken = append(broken, outboxIndexKey{due: bytes.Clone(k), queue: bytes.Clone(v)})
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения outbox: %w", err)
+	}
+	if len(broken) > 0 {
+		if err := o.moveBroken(broken); err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+// moveBroken переносит нечитаемые записи в outbox_failed как есть
+func (o *Outbox) moveBroken(keys []outboxIndexKey) error {
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(outboxPendingBucket)
+		failed := tx.Bucket(outboxFailedBucket)
+		for _, k := range keys {
+			id := k.due[8:]
+			if data := pending.Get(id); data != nil {
+				if err := failed.Put(id, data); err != nil {
+					return err
+				}
+			}
+			if err := pending.Delete(id); err != nil {
+				return err
+			}
+			if err := dequeueOutbox(tx, k); err != nil {
+				return err
+			}
+			log.Printf("Запись outbox %d не читается и перенесена в %s", binary.BigEndian.Uint64(id), outboxFailedBucket)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("ошибка переноса нечитаемых записей outbox: %w", err)
+	}
+	o.pending.Add(-int64(len(keys)))
+	return nil
+}
+
+// NextAttemptAt возвращает время ближайшей повторной попытки (нулевое, если outbox пуст)
+func (o *Outbox) NextAttemptAt() (time.Time, error) {
+	var next time.Time
+	err := o.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(outboxDueBucket).Cursor().First(); k != nil {
+			next = outboxDueTime(k)
+		}
+		return nil
+	})
+	return next, err
+}
+
+// MarkSent переносит записи в корзину отправленных одной транзакцией
+func (o *Outbox) MarkSent(entries ...OutboxEntry) error {
+	sentAt := time.Now().UTC()
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(outboxPendingBucket)
+		sent := tx.Bucket(outboxSentBucket)
+		for _, entry := range entries {
+			entry.SentAt = sentAt
+			entry.Attempts++
+			entry.LastError = ""
+
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			key := outboxKey(entry.ID)
+			if err := pending.Delete(key); err != nil {
+				return err
+			}
+			if err := sent.Put(key, data); err != nil {
+				return err
+			}
+			if err := dequeueOutbox(tx, entry.indexKey()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		o.pending.Add(-int64(len(entries)))
+	}
+	return err
+}
+
+// MarkFailed фиксирует неудачную попытку и время следующего повтора. После outboxMaxAttempts попыток
+// запись переносится в outbox_failed и больше не отправляется; exhausted сообщает об этом.
+func (o *Outbox) MarkFailed(entry OutboxEntry, cause error, nextAttemptAt time.Time) (exhausted bool, err error) {
+	index := entry.indexKey()
+	entry.Attempts++
+	entry.LastError = cause.Error()
+	entry.NextAttemptAt = nextAttemptAt
+	exhausted = entry.Attempts >= outboxMaxAttempts
+	if exhausted {
+		entry.FailedAt = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return false, err
+	}
+
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		key := outboxKey(entry.ID)
+		if !exhausted {
+			if err := tx.Bucket(outboxPendingBucket).Put(key, data); err != nil {
+				return err
+			}
+			// Запись остается первой в очереди ключа, меняется только время ее готовности
+			due := tx.Bucket(outboxDueBucket)
+			if err := due.Delete(index.due); err != nil {
+				return err
+			}
+			return due.Put(outboxDueKey(entry.NextAttemptAt, entry.ID), index.queue)
+		}
+		if err := tx.Bucket(outboxPendingBucket).Delete(key); err != nil {
+			return err
+		}
+		if err := tx.Bucket(outboxFailedBucket).Put(key, data); err != nil {
+			return err
+		}
+		return dequeueOutbox(tx, index)
+	})
+	if err == nil && exhausted {
+		o.pending.Add(-1)
+	}
+	return exhausted, err
+}
+
+// PurgeSent удаляет отправленные записи старше olderThan
+func (o *Outbox) PurgeSent(olderThan time.Time) (int, error) {
+	purged := 0
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(outboxSentBucket)
+
+		// Удаление под курсором сбивает итерацию, поэтому сначала собираем ключи
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var entry OutboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.SentAt.Before(olderThan) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		purged = len(keys)
+		return nil
+	})
+	return purged, err
+}
+
+// Pending возвращает число записей, ожидающих отправки
+func (o *Outbox) Pending() int64 {
+	return o.pending.Load()
+}
+
+// Notify сигнализирует о появлении новых записей
+func (o *Outbox) Notify() <-chan struct{} {
+	return o.notify
+}
+
+// Close закрывает файл outbox
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// outboxKey кодирует id в big-endian, чтобы порядок ключей совпадал с порядком добавления
+func outboxKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// outboxIndexKey - ключи записи в индексах outbox_due и outbox_queue
+type outboxIndexKey struct {
+	due   []byte
+	queue []byte
+}
+
+// indexKey возвращает ключи записи в индексах по ее текущему времени готовности
+func (e OutboxEntry) indexKey() outboxIndexKey {
+	return outboxIndexKey{
+		due:   outboxDueKey(e.NextAttemptAt, e.ID),
+		queue: append(outboxQueuePrefix(e.Topic, e.Key), outboxKey(e.ID)...),
+	}
+}
+
+// outboxQueuePrefix кодирует топик и ключ с длинами, чтобы префикс одного ключа не совпал с другим
+func outboxQueuePrefix(topic string, key []byte) []byte {
+	prefix := make([]byte, 0, 8+len(topic)+len(key))
+	prefix = binary.BigEndian.AppendUint32(prefix, uint32(len(topic)))
+	prefix = append(prefix, topic...)
+	prefix = binary.BigEndian.AppendUint32(prefix, uint32(len(key)))
+	return append(prefix, key...)
+}
+
+// outboxDueKey - время готовности в наносекундах и id записи, оба в big-endian
+func outboxDueKey(at time.Time, id uint64) []byte {
+	key := make([]byte, 0, 16)
+	key = binary.BigEndian.AppendUint64(key, uint64(max(at.UnixNano(), 0)))
+	return binary.BigEndian.AppendUint64(key, id)
+}
+
+// outboxDueTime восстанавливает время готовности из ключа outbox_due
+func outboxDueTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+}
+
+// enqueueOutbox ставит запись в очередь ее ключа; первая запись очереди сразу попадает в outbox_due
+func enqueueOutbox(tx *bolt.Tx, entry OutboxEntry) error {
+	index := entry.indexKey()
+	queue := tx.Bucket(outboxQueueBucket)
+	if err := queue.Put(index.queue, nil); err != nil {
+		return err
+	}
+	// Записи ключа добавляются с растущими id, поэтому запись первая, если перед ней в очереди никого нет
+	first, _ := queue.Cursor().Seek(index.queue[:len(index.queue)-8])
+	if !bytes.Equal(first, index.queue) {
+		return nil
+	}
+	return tx.Bucket(outboxDueBucket).Put(index.due, index.queue)
+}
+
+// dequeueOutbox убирает запись из индексов и переносит в outbox_due следующую запись ее ключа
+func dequeueOutbox(tx *bolt.Tx, index outboxIndexKey) error {
+	queue := tx.Bucket(outboxQueueBucket)
+	due := tx.Bucket(outboxDueBucket)
+	if err := due.Delete(index.due); err != nil {
+		return err
+	}
+	if err := queue.Delete(index.queue); err != nil {
+		return err
+	}
+
+	prefix := index.queue[:len(index.queue)-8]
+	next, _ := queue.Cursor().Seek(prefix)
+	if next == nil || !bytes.HasPrefix(next, prefix) {
+		return nil
+	}
+	next = bytes.Clone(next)
+	id := next[len(prefix):]
+	var entry OutboxEntry
+	if err := json.Unmarshal(tx.Bucket(outboxPendingBucket).Get(id), &entry); err != nil {
+		// Нечитаемая запись становится готовой сразу, и Due перенесет ее в outbox_failed
+		return due.Put(append(make([]byte, 8), id...), next)
+	}
+	return due.Put(outboxDueKey(entry.NextAttemptAt, entry.ID), next)
+}
+
+// reindexOutbox строит индексы по всем неотправленным записям
+func reindexOutbox(tx *bolt.Tx) error {
+	var broken [][]byte
+	pending := tx.Bucket(outboxPendingBucket)
+	err := pending.ForEach(func(k, v []byte) error {
+		var entry OutboxEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			broken = append(broken, bytes.Clone(k))
+			return nil
+		}
+		return enqueueOutbox(tx, entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	failed := tx.Bucket(outboxFailedBucket)
+	for _, k := range broken {
+		if err := failed.Put(k, pending.Get(k)); err != nil {
+			return err
+		}
+		if err := pending.Delete(k); err != nil {
+			return err
+		}
+		log.Printf("Запись outbox %d не читается и перенесена в %s", binary.BigEndian.Uint64(k), outboxFailedBucket)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package infrastructure
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	outboxBatchSize     = 100
+	outboxPollInterval  = time.Second
+	outboxIdleDelay     = 100 * time.Millisecond
+	outboxRetryMin      = 500 * time.Millisecond
+	outboxRetryMax      = 30 * time.Second
+	outboxSentRetention = 24 * time.Hour
+	outboxPurgeInterval = 10 * time.Minute
+)
+
+// OutboxRelay переносит сообщения из outbox в Kafka с повторными попытками
+type OutboxRelay struct {
+	outbox *Outbox
+	client *kgo.Client
+}
+
+// NewOutboxRelay создает relay поверх outbox и Kafka-клиента
+func NewOutboxRelay(outbox *Outbox, client *kgo.Client) *OutboxRelay {
+	return &OutboxRelay{outbox: outbox, client: client}
+}
+
+// Run публикует накопленные сообщения, пока не будет отменен контекст
+func (r *OutboxRelay) Run(ctx context.Context) {
+	purgeTicker := time.NewTicker(outboxPurgeInterval)
+	defer purgeTicker.Stop()
+
+	for {
+		sent, err := r.relayBatch(ctx)
+		if err != nil {
+			log.Printf("Ошибка отправки сообщений из outbox: %v", err)
+		}
+		// Пока записи отправляются, в outbox могут оставаться готовые: например, следующие записи
+		// того же ключа, которые не попали в пачку
+		if sent > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(r.nextDelay())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-r.outbox.Notify():
+		case <-timer.C:
+		case <-purgeTicker.C:
+			if purged, err := r.outbox.PurgeSent(time.Now().Add(-outboxSentRetention)); err != nil {
+				log.Printf("Ошибка очистки outbox: %v", err)
+			} else if purged > 0 {
+				log.Printf("Из outbox удалено %d отправленных записей", purged)
+			}
+		}
+		timer.Stop()
+	}
+}
+
+// Drain отправляет все готовые записи, пока они не закончатся или не истечет контекст.
+// Записи, которые не удалось отправить, остаются в outbox до следующего запуска.
+func (r *OutboxRelay) Drain(ctx context.Context) error {
+	for ctx.Err() == nil {
+		sent, err := r.relayBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if sent == 0 {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// relayBatch отправляет одну пачку готовых записей и возвращает число успешно отправленных
+func (r *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+	entries, err := r.outbox.Due(time.Now(), outboxBatchSize)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	records := make([]*kgo.Record, 0, len(entries))
+	var links []trace.Link
+	for _, entry := range entries {
+		record := entry.record()
+		records = append(records, record)
+		links = append(links, outboxLinks(ctx, record.Headers)...)
+	}
+
+	ctx, span := tracing.StartInfrastructure(ctx, "RelayOutbox", tracing.SubLayerBroker, trace.WithLinks(links...))
+	defer span.End()
+
+	// Заголовки записи (включая traceparent) уходят в Kafka без изменений,
+	// поэтому consumer связывается со спаном, создавшим заказ, а не с relay.
+	// Записи отправляются асинхронно: клиент собирает их в пачки по партициям,
+	// а результат каждой записи приходит в callback. Порядок внутри ключа не нарушается,
+	// потому что в пачке не больше одной записи на ключ, а следующая пачка выбирается
+	// только после того, как пришли подтверждения по всем записям текущей.
+	errs := make([]error, len(records))
+	var wg sync.WaitGroup
+	wg.Add(len(records))
+	for i, record := range records {
+		r.client.Produce(ctx, record, func(_ *kgo.Record, err error) {
+			errs[i] = err
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	sent := make([]OutboxEntry, 0, len(entries))
+	failed := 0
+	for i, produceErr := range errs {
+		if produceErr != nil {
+			failed++
+			span.RecordError(produceErr)
+			next := time.Now().Add(outboxBackoff(entries[i].Attempts))
+			exhausted, err := r.outbox.MarkFailed(entries[i], produceErr, next)
+			if err != nil {
+				return len(sent), err
+			}
+			if exhausted {
+				// Сообщение потеряно для потребителей: запись ждет разбора в outbox_failed
+				log.Printf("Запись outbox %d (топик %s, ключ %s) не отправлена за %d попыток и перенесена в %s: %v",
+					entries[i].ID, entries[i].Topic, entries[i].Key, outboxMaxAttempts, outboxFailedBucket, produceErr)
+				continue
+			}
+			log.Printf("Не удалось отправить запись outbox %d (попытка %d): %v", entries[i].ID, entries[i].Attempts+1, produceErr)
+			continue
+		}
+		sent = append(sent, entries[i])
+	}
+
+	span.SetAttributes(
+		attribute.Int("outbox.batch.size", len(entries)),
+		attribute.Int("outbox.batch.failed", failed),
+	)
+
+	if len(sent) > 0 {
+		if err := r.outbox.MarkSent(sent...); err != nil {
+			span.RecordError(err)
+			return 0, err
+		}
+	}
+	return len(sent), nil
+}
+
+// nextDelay вычисляет паузу до следующей проверки outbox
+func (r *OutboxRelay) nextDelay() time.Duration {
+	next, err := r.outbox.NextAttemptAt()
+	if err != nil || next.IsZero() {
+		return outboxPollInterval
+	}
+	delay := time.Until(next)
+	if delay < outboxIdleDelay {
+		return outboxIdleDelay
+	}
+	if delay > outboxPollInterval {
+		return outboxPollInterval
+	}
+	return delay
+}
+
+// record восстанавливает Kafka-запись из строки outbox
+func (e OutboxEntry) record() *kgo.Record {
+	headers := make([]kgo.RecordHeader, 0, len(e.Headers))
+	for _, h := range e.Headers {
+		headers = append(headers, kgo.RecordHeader{Key: h.Key, Value: []byte(h.Value)})
+	}
+	return &kgo.Record{
+		Topic:   e.Topic,
+		Key:     e.Key,
+		Value:   e.Value,
+		Headers: headers,
+	}
+}
+
+// outboxLinks связывает спан relay со спанами, сохранившими записи в outbox
+func outboxLinks(ctx context.Context, headers []kgo.RecordHeader) []trace.Link {
+	spanCtx := tracing.SpanContextFromKafka(ctx, headers)
+	if !spanCtx.IsValid() {
+		return nil
+	}
+	return []trace.Link{{
+		SpanContext: spanCtx,
+		Attributes: []attribute.KeyValue{
+			attribute.String("link.type", "async"),
+			attribute.String("link.protocol", "outbox"),
+		},
+	}}
+}
+
+// outboxBackoff - экспоненциальная задержка между попытками отправки
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxRetryMin
+	for i := 0; i < attempts && delay < outboxRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > outboxRetryMax {
+		return outboxRetryMax
+	}
+	return delay
+}
@@ -0,0 +1,87 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultIdleExpiry - срок хранения бакета неактивного клиента, если задан непригодный
+const defaultIdleExpiry = 10 * time.Minute
+
+// RateLimiter хранит token bucket для каждого ключа (IP клиента, API-ключ) в памяти
+type RateLimiter struct {
+	mu         sync.Mutex
+	limit      rate.Limit
+	burst      int
+	idleExpiry time.Duration
+	buckets    map[string]*rateBucket
+}
+
+type rateBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter создает лимитер на rps запросов в секунду с допустимым всплеском burst.
+// Бакеты удаляются после idleExpiry без запросов; нулевой или отрицательный срок заменяется defaultIdleExpiry.
+func NewRateLimiter(rps float64, burst int, idleExpiry time.Duration) *RateLimiter {
+	if idleExpiry <= 0 {
+		idleExpiry = defaultIdleExpiry
+	}
+	return &RateLimiter{
+		limit:      rate.Limit(rps),
+		burst:      burst,
+		idleExpiry: idleExpiry,
+		buckets:    make(map[string]*rateBucket),
+	}
+}
+
+// Allow списывает токен из бакета ключа.
+// Если токенов нет, возвращает false и время, через которое запрос будет разрешен.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &rateBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = bucket
+	}
+	bucket.lastSeen = now
+	l.mu.Unlock()
+
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		// Запрос отклоняется, поэтому токен возвращается в бакет
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// Run периодически удаляет бакеты неактивных клиентов, пока не будет отменен контекст
+func (l *RateLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.idleExpiry)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for key, bucket := range l.buckets {
+				if now.Sub(bucket.lastSeen) > l.idleExpiry {
+					delete(l.buckets, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
@@ -2,31 +2,116 @@ package usecase
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
-	"github.com/Vasiliy82/ArchiScoper/retailer-api/internal/infrastructure"
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
 	"github.com/google/uuid"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrIdempotencyConflict возвращается, если Idempotency-Key уже использован с другим телом запроса
+var ErrIdempotencyConflict = errors.New("idempotency key reused with a different request")
+
+// ErrIdempotencyInFlight возвращается, если запрос с тем же Idempotency-Key еще обрабатывается:
+// заказ может быть не принят, поэтому его идентификатор повтору не выдается
+var ErrIdempotencyInFlight = errors.New("request with the same idempotency key is in progress")
+
+// batchConcurrency ограничивает число заказов пачки, обрабатываемых одновременно
+const batchConcurrency = 32
+
+// BatchItemResult - результат приема одного заказа из пачки
+type BatchItemResult struct {
+	OrderID  string
+	Replayed bool
+	Err      error
+}
+
 // OrderUseCase содержит бизнес-логику работы с заказами
 type OrderUseCase struct {
-	orderRepo *infrastructure.OrderRepository
+	publisher   OrderPublisher
+	statusStore OrderReadModel
+	idempotency IdempotencyStore
+	events      OrderEventBroker
 }
 
 // NewOrderUseCase создает экземпляр OrderUseCase
-func NewOrderUseCase(orderRepo *infrastructure.OrderRepository) *OrderUseCase {
-	return &OrderUseCase{orderRepo: orderRepo}
+func NewOrderUseCase(publisher OrderPublisher, statusStore OrderReadModel, idempotency IdempotencyStore, events OrderEventBroker) *OrderUseCase {
+	return &OrderUseCase{publisher: publisher, statusStore: statusStore, idempotency: idempotency, events: events}
+}
+
+// CreateOrder создает новый заказ и передает его в OrderPublisher.
+// При непустом idempotencyKey повторный запрос с тем же телом возвращает ранее созданный заказ (replayed = true),
+// а пока исходный запрос не завершен - ErrIdempotencyInFlight.
+func (uc *OrderUseCase) CreateOrder(ctx context.Context, idempotencyKey string, payload map[string]interface{}) (orderID string, replayed bool, err error) {
+	return uc.createOrder(ctx, idempotencyKey, payload)
+}
+
+// CreateOrders принимает пачку заказов. Каждый заказ обрабатывается как отдельный CreateOrder
+// в собственном трейсе, связанном со спаном пачки, поэтому ошибка одного заказа не влияет на остальные.
+// При непустом idempotencyKey ключ каждого заказа - idempotencyKey:<индекс>, и повтор пачки возвращает те же заказы.
+func (uc *OrderUseCase) CreateOrders(ctx context.Context, idempotencyKey string, payloads []map[string]interface{}) []BatchItemResult {
+	ctx, span := tracing.StartApplication(ctx, "CreateOrders")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("batch.size", len(payloads)))
+
+	// Заказы из пачки - самостоятельные трейсы; ссылка на спан пачки показывает fan-out в графе
+	batchLink := trace.Link{
+		SpanContext: span.SpanContext(),
+		Attributes: []attribute.KeyValue{
+			attribute.String("link.type", "batch"),
+			attribute.String("link.role", "item"),
+		},
+	}
+
+	results := make([]BatchItemResult, len(payloads))
+	sem := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, payload := range payloads {
+		itemKey := ""
+		if idempotencyKey != "" {
+			itemKey = fmt.Sprintf("%s:%d", idempotencyKey, i)
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, payload map[string]interface{}) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			orderID, replayed, err := uc.createOrder(ctx, itemKey, payload, trace.WithNewRoot(), trace.WithLinks(batchLink))
+			results[i] = BatchItemResult{OrderID: orderID, Replayed: replayed, Err: err}
+		}(i, payload)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	span.SetAttributes(attribute.Int("batch.failed", failed))
+	return results
 }
 
-// CreateOrder создает новый заказ и публикует его в Kafka
-func (uc *OrderUseCase) CreateOrder(ctx context.Context, payload map[string]interface{}) (string, error) {
-	ctx, span := tracing.StartApplication(ctx, "CreateOrder")
+// createOrder - общая часть CreateOrder и CreateOrders; opts позволяют начать спан заказа в отдельном трейсе
+func (uc *OrderUseCase) createOrder(ctx context.Context, idempotencyKey string, payload map[string]interface{}, opts ...trace.SpanStartOption) (orderID string, replayed bool, err error) {
+	ctx, span := tracing.StartApplication(ctx, "CreateOrder", opts...)
 	defer span.End()
 
 	order := domain.Order{
 		ID:      uuid.New().String(),
+		Status:  domain.StatusNew,
 		Payload: payload,
 	}
 
@@ -35,11 +120,245 @@ func (uc *OrderUseCase) CreateOrder(ctx context.Context, payload map[string]inte
 		attribute.Int("payload.size", len(payload)),
 	)
 
-	err := uc.orderRepo.PublishOrder(ctx, order)
+	// Покупатель из JWT становится владельцем заказа; ключи идемпотентности разных покупателей не пересекаются
+	if customer, ok := domain.CustomerFromContext(ctx); ok {
+		order.CustomerID = customer.ID
+		span.SetAttributes(attribute.String("enduser.id", customer.ID))
+		if idempotencyKey != "" {
+			idempotencyKey = customer.ID + "/" + idempotencyKey
+		}
+	}
+
+	if idempotencyKey != "" {
+		hash, err := requestHash(payload)
+		if err != nil {
+			span.RecordError(err)
+			return "", false, err
+		}
+
+		record, reserved := uc.idempotency.Reserve(ctx, domain.IdempotencyRecord{
+			Key:         idempotencyKey,
+			RequestHash: hash,
+			OrderID:     order.ID,
+		})
+		if !reserved {
+			span.SetAttributes(attribute.Bool("idempotency.replayed", true))
+			if record.RequestHash != hash {
+				span.RecordError(ErrIdempotencyConflict)
+				return "", false, ErrIdempotencyConflict
+			}
+			if !record.Completed {
+				span.RecordError(ErrIdempotencyInFlight)
+				return "", false, ErrIdempotencyInFlight
+			}
+			return record.OrderID, true, nil
+		}
+	}
+
+	err = uc.publisher.PublishOrder(ctx, order)
+	if err != nil {
+		span.RecordError(err)
+		// Заказ не принят - ключ освобождается, чтобы клиент мог повторить запрос
+		if idempotencyKey != "" {
+			uc.idempotency.Release(ctx, idempotencyKey)
+		}
+		return "", false, err
+	}
+	if idempotencyKey != "" {
+		uc.idempotency.Complete(ctx, idempotencyKey)
+	}
+
+	// Заказ сразу попадает в read-модель, чтобы его можно было запросить до первого события от OMS
+	spanCtx := span.SpanContext()
+	change := domain.StatusChange{
+		Status:     domain.StatusNew,
+		TraceID:    spanCtx.TraceID().String(),
+		SpanID:     spanCtx.SpanID().String(),
+		OccurredAt: time.Now().UTC(),
+	}
+	if _, err := uc.statusStore.AppendChange(ctx, order.ID, order.CustomerID, change); err != nil {
+		span.RecordError(err)
+		return "", false, err
+	}
+	uc.events.Publish(ctx, domain.OrderStatusUpdate{OrderID: order.ID, CustomerID: order.CustomerID, StatusChange: change})
+
+	return order.ID, false, nil
+}
+
+// ApplyStatusEvent применяет событие смены статуса от OMS к read-модели
+func (uc *OrderUseCase) ApplyStatusEvent(ctx context.Context, event domain.OrderStatusEvent, source trace.SpanContext) error {
+	ctx, span := tracing.StartApplication(ctx, "ApplyStatusEvent")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", event.OrderID),
+		attribute.String("order.status", string(event.Status)),
+		attribute.String("order.previous_status", string(event.PreviousStatus)),
+	)
+
+	if event.OrderID == "" || !event.Status.IsValid() {
+		err := fmt.Errorf("некорректное событие статуса заказа %q: %q", event.OrderID, event.Status)
+		span.RecordError(err)
+		return err
+	}
+
+	change := domain.StatusChange{
+		PreviousStatus: event.PreviousStatus,
+		Status:         event.Status,
+		Step:           event.Step,
+		Reason:         event.Reason,
+		OccurredAt:     event.OccurredAt,
+	}
+	if source.IsValid() {
+		change.TraceID = source.TraceID().String()
+		change.SpanID = source.SpanID().String()
+	}
+
+	// Владелец заказа приходит в событии: read-модель, собранная из топика статусов после рестарта
+	// или на другой реплике, тоже проверяет, что заказ принадлежит покупателю
+	appended, err := uc.statusStore.AppendChange(ctx, event.OrderID, event.CustomerID, change)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	// Подписчики получают только новые переходы, повторно доставленные события им не отправляются
+	if appended {
+		update := domain.OrderStatusUpdate{OrderID: event.OrderID, StatusChange: change}
+		if view, err := uc.statusStore.Get(ctx, event.OrderID); err == nil {
+			update.CustomerID = view.CustomerID
+		}
+		uc.events.Publish(ctx, update)
+	}
+	return nil
+}
+
+// CancelOrder передает в OMS запрос на отмену заказа.
+// Статус в read-модели может отставать от саги, поэтому окончательно отмену принимает или отклоняет OMS:
+// здесь отсекаются только заказы, которые уже отгружены, завершены или отменены.
+func (uc *OrderUseCase) CancelOrder(ctx context.Context, orderID, reason string) error {
+	ctx, span := tracing.StartApplication(ctx, "CancelOrder")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order.id", orderID))
+
+	view, err := uc.ownedOrder(ctx, orderID)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	span.SetAttributes(attribute.String("order.status", string(view.Status)))
+	if !view.Status.IsCancellable() {
+		span.RecordError(domain.ErrOrderNotCancellable)
+		return domain.ErrOrderNotCancellable
+	}
+
+	command := domain.CancelOrderCommand{
+		OrderID:     orderID,
+		Reason:      reason,
+		RequestedAt: time.Now().UTC(),
+	}
+	// OMS еще раз проверяет владельца по саге, поэтому покупатель передается в команде
+	if customer, ok := domain.CustomerFromContext(ctx); ok {
+		command.CustomerID = customer.ID
+		span.SetAttributes(attribute.String("enduser.id", customer.ID))
+	}
+
+	if err := uc.publisher.PublishCancel(ctx, command); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// SubscribeOrderEvents подписывает на изменения статусов заказов.
+// Для каждого заказа сначала проверяется, что он существует, и возвращается его текущее состояние,
+// чтобы клиент не пропустил переходы между снимком и подпиской.
+// Покупатель из JWT получает только свои заказы: чужой заказ в списке не находится, а без списка
+// в поток попадают изменения только его заказов.
+func (uc *OrderUseCase) SubscribeOrderEvents(ctx context.Context, orderIDs []string) ([]domain.OrderView, <-chan domain.OrderStatusUpdate, func(), error) {
+	ctx, span := tracing.StartApplication(ctx, "SubscribeOrderEvents")
+	defer span.End()
+
+	span.SetAttributes(attribute.StringSlice("order.ids", orderIDs))
+
+	// Подписка оформляется до чтения снимка: переход между ними придет событием, а не потеряется
+	customerID := ""
+	if customer, ok := domain.CustomerFromContext(ctx); ok {
+		customerID = customer.ID
+		span.SetAttributes(attribute.String("enduser.id", customerID))
+	}
+	updates, cancel := uc.events.Subscribe(customerID, orderIDs)
+
+	snapshot := make([]domain.OrderView, 0, len(orderIDs))
+	for _, id := range orderIDs {
+		view, err := uc.ownedOrder(ctx, id)
+		if err != nil {
+			cancel()
+			span.RecordError(err)
+			return nil, nil, nil, err
+		}
+		snapshot = append(snapshot, view)
+	}
+	return snapshot, updates, cancel, nil
+}
+
+// GetOrder возвращает текущий статус заказа и историю его шагов; чужой заказ не находится
+func (uc *OrderUseCase) GetOrder(ctx context.Context, orderID string) (domain.OrderView, error) {
+	ctx, span := tracing.StartApplication(ctx, "GetOrder")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order.id", orderID))
+
+	view, err := uc.ownedOrder(ctx, orderID)
+	if err != nil {
+		span.RecordError(err)
+		return domain.OrderView{}, err
+	}
+	return view, nil
+}
+
+// ListOrders возвращает заказы, отфильтрованные по статусу; покупатель из JWT видит только свои заказы
+func (uc *OrderUseCase) ListOrders(ctx context.Context, status domain.OrderStatus) ([]domain.OrderView, error) {
+	ctx, span := tracing.StartApplication(ctx, "ListOrders")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order.status", string(status)))
+
+	customerID := ""
+	if customer, ok := domain.CustomerFromContext(ctx); ok {
+		customerID = customer.ID
+		span.SetAttributes(attribute.String("enduser.id", customerID))
+	}
+
+	views, err := uc.statusStore.List(ctx, status, customerID)
 	if err != nil {
 		span.RecordError(err)
-		return "", err
+		return nil, err
+	}
+	return views, nil
+}
+
+// ownedOrder возвращает заказ из read-модели. Для покупателя из JWT чужой заказ не существует (ErrOrderNotFound):
+// по ответу нельзя узнать, есть ли заказ с таким id у другого покупателя.
+func (uc *OrderUseCase) ownedOrder(ctx context.Context, orderID string) (domain.OrderView, error) {
+	view, err := uc.statusStore.Get(ctx, orderID)
+	if err != nil {
+		return domain.OrderView{}, err
+	}
+	if customer, ok := domain.CustomerFromContext(ctx); ok && view.CustomerID != customer.ID {
+		return domain.OrderView{}, domain.ErrOrderNotFound
 	}
+	return view, nil
+}
 
-	return order.ID, nil
+// requestHash вычисляет отпечаток тела запроса; json.Marshal сортирует ключи map,
+// поэтому одинаковые по содержанию запросы дают одинаковый хэш
+func requestHash(payload map[string]interface{}) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("ошибка сериализации запроса: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
 }
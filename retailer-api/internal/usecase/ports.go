@@ -0,0 +1,37 @@
+package usecase
+
+import (
+	"context"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+)
+
+// OrderPublisher передает принятый заказ и команды по нему на дальнейшую обработку (Kafka, файл, память)
+type OrderPublisher interface {
+	PublishOrder(ctx context.Context, order domain.Order) error
+	PublishCancel(ctx context.Context, command domain.CancelOrderCommand) error
+}
+
+// OrderReadModel хранит текущий статус и историю шагов заказов.
+// customerID в AppendChange задает владельца заказа (пустой - не меняет его), в List - отбирает заказы покупателя.
+type OrderReadModel interface {
+	AppendChange(ctx context.Context, orderID, customerID string, change domain.StatusChange) (bool, error)
+	Get(ctx context.Context, orderID string) (domain.OrderView, error)
+	List(ctx context.Context, status domain.OrderStatus, customerID string) ([]domain.OrderView, error)
+}
+
+// IdempotencyStore хранит соответствие Idempotency-Key -> заказ.
+// Reserve закрепляет ключ за заказом, Complete отмечает заказ принятым, Release освобождает ключ непринятого заказа.
+type IdempotencyStore interface {
+	Reserve(ctx context.Context, record domain.IdempotencyRecord) (domain.IdempotencyRecord, bool)
+	Complete(ctx context.Context, key string)
+	Release(ctx context.Context, key string)
+}
+
+// OrderEventBroker рассылает изменения статусов заказов подписчикам (SSE).
+// Subscribe с пустым списком заказов подписывает на все заказы; непустой customerID оставляет только заказы
+// этого покупателя. cancel освобождает подписку.
+type OrderEventBroker interface {
+	Publish(ctx context.Context, update domain.OrderStatusUpdate)
+	Subscribe(customerID string, orderIDs []string) (updates <-chan domain.OrderStatusUpdate, cancel func())
+}
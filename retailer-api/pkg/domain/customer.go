@@ -0,0 +1,22 @@
+package domain
+
+import "context"
+
+// Customer - аутентифицированный покупатель, от имени которого выполняется запрос
+type Customer struct {
+	ID     string   `json:"id"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+type customerContextKey struct{}
+
+// ContextWithCustomer сохраняет покупателя в контексте запроса
+func ContextWithCustomer(ctx context.Context, customer Customer) context.Context {
+	return context.WithValue(ctx, customerContextKey{}, customer)
+}
+
+// CustomerFromContext возвращает покупателя из контекста запроса, если запрос аутентифицирован
+func CustomerFromContext(ctx context.Context) (Customer, bool) {
+	customer, ok := ctx.Value(customerContextKey{}).(Customer)
+	return customer, ok
+}
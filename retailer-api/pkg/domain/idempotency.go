@@ -0,0 +1,14 @@
+package domain
+
+import "time"
+
+// IdempotencyRecord связывает Idempotency-Key с заказом, созданным по этому ключу.
+// Пока Completed = false, исходный запрос еще публикует заказ и тот может быть не принят.
+type IdempotencyRecord struct {
+	Key         string    `json:"key"`
+	RequestHash string    `json:"request_hash"`
+	OrderID     string    `json:"order_id"`
+	Completed   bool      `json:"completed"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
@@ -1,5 +1,13 @@
 package domain
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrOrderNotCancellable возвращается, если заказ уже отгружен, завершен или отменен
+var ErrOrderNotCancellable = errors.New("order can no longer be cancelled")
+
 // OrderStatus определяет состояния заказа
 type OrderStatus string
 
@@ -10,11 +18,39 @@ const (
 	StatusPaid      OrderStatus = "PAID"
 	StatusShipped   OrderStatus = "SHIPPED"
 	StatusCompleted OrderStatus = "COMPLETED"
+	StatusCancelled OrderStatus = "CANCELLED"
 )
 
+// IsValid проверяет, что статус входит в список известных
+func (s OrderStatus) IsValid() bool {
+	switch s {
+	case StatusNew, StatusAccepted, StatusAssembled, StatusPaid, StatusShipped, StatusCompleted, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// IsCancellable сообщает, можно ли еще отменить заказ в этом статусе: после отгрузки отмена невозможна
+func (s OrderStatus) IsCancellable() bool {
+	switch s {
+	case StatusShipped, StatusCompleted, StatusCancelled:
+		return false
+	}
+	return true
+}
+
 // Order представляет заказ
 type Order struct {
-	ID      string                 `json:"id"`
-	Status  OrderStatus            `json:"status"`
-	Payload map[string]interface{} `json:"payload"`
+	ID         string                 `json:"id"`
+	Status     OrderStatus            `json:"status"`
+	CustomerID string                 `json:"customer_id,omitempty"` // Покупатель из JWT; пусто, если аутентификация отключена
+	Payload    map[string]interface{} `json:"payload"`
+}
+
+// CancelOrderCommand - запрос покупателя на отмену заказа, передаваемый в OMS
+type CancelOrderCommand struct {
+	OrderID     string    `json:"order_id"`
+	CustomerID  string    `json:"customer_id,omitempty"` // OMS отклоняет отмену чужого заказа
+	Reason      string    `json:"reason,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
 }
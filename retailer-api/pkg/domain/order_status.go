@@ -0,0 +1,49 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrOrderNotFound возвращается, если заказ отсутствует в read-модели
+var ErrOrderNotFound = errors.New("order not found")
+
+// OrderStatusEvent описывает переход заказа из одного статуса в другой
+type OrderStatusEvent struct {
+	OrderID        string      `json:"order_id"`
+	CustomerID     string      `json:"customer_id,omitempty"` // Владелец заказа: по нему read-модель восстанавливается после рестарта и на других репликах
+	PreviousStatus OrderStatus `json:"previous_status"`
+	Status         OrderStatus `json:"status"`
+	Step           string      `json:"step,omitempty"`
+	Reason         string      `json:"reason,omitempty"`
+	OccurredAt     time.Time   `json:"occurred_at"`
+}
+
+// StatusChange - запись в истории шагов заказа
+type StatusChange struct {
+	PreviousStatus OrderStatus `json:"previous_status"`
+	Status         OrderStatus `json:"status"`
+	Step           string      `json:"step,omitempty"`
+	Reason         string      `json:"reason,omitempty"`
+	TraceID        string      `json:"trace_id,omitempty"`
+	SpanID         string      `json:"span_id,omitempty"`
+	OccurredAt     time.Time   `json:"occurred_at"`
+}
+
+// OrderStatusUpdate - изменение статуса заказа, рассылаемое подписчикам
+type OrderStatusUpdate struct {
+	OrderID    string `json:"order_id"`
+	CustomerID string `json:"-"` // Владелец заказа: по нему отбираются подписки покупателей
+	StatusChange
+}
+
+// OrderView - read-модель заказа: текущий статус и история шагов
+type OrderView struct {
+	ID         string         `json:"id"`
+	Status     OrderStatus    `json:"status"`
+	CustomerID string         `json:"customer_id,omitempty"` // Покупатель, создавший заказ; пусто, если аутентификация отключена
+	TraceID    string         `json:"trace_id"`
+	History    []StatusChange `json:"history"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
@@ -0,0 +1,160 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/google/uuid"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// SpecVersion - поддерживаемая версия спецификации CloudEvents
+const SpecVersion = "1.0"
+
+// Заголовки Kafka для CloudEvents в binary mode (Kafka Protocol Binding).
+// Атрибут datacontenttype передается стандартным заголовком content-type.
+const (
+	HeaderSpecVersion     = "ce_specversion"
+	HeaderID              = "ce_id"
+	HeaderSource          = "ce_source"
+	HeaderType            = "ce_type"
+	HeaderTime            = "ce_time"
+	HeaderSubject         = "ce_subject"
+	HeaderDataSchema      = "ce_dataschema"
+	HeaderDataContentType = "content-type"
+)
+
+// Типы событий, которыми обмениваются сервисы
+const (
+	TypeOrderCreated         = "retailer.order.created"
+	TypeOrderStatusChanged   = "retailer.order.status_changed"
+	TypeOrderCancelRequested = "retailer.order.cancel_requested"
+	TypeSagaStuck            = "retailer.saga.stuck"
+	TypeSagaRedriveRequested = "retailer.saga.redrive_requested"
+)
+
+var (
+	// ErrNotCloudEvent - в заголовках нет ce_specversion (сообщение от продюсера без CloudEvents)
+	ErrNotCloudEvent = errors.New("record is not a cloudevent")
+	ErrInvalidEvent  = errors.New("invalid cloudevent")
+)
+
+// Event - атрибуты контекста CloudEvents; данные события передаются телом записи Kafka
+type Event struct {
+	ID              string
+	Source          string
+	SpecVersion     string
+	Type            string
+	Time            time.Time
+	Subject         string
+	DataContentType string
+	DataSchema      string
+}
+
+// Source формирует атрибут source из домена и имени сервиса, например /web/retailer-api
+func Source(info tracing.AppInfo) string {
+	return fmt.Sprintf("/%s/%s", info.DomainName, info.ServiceName)
+}
+
+// New создает событие с уникальным id и текущим временем
+func New(source, eventType, subject string) Event {
+	return Event{
+		ID:          uuid.New().String(),
+		Source:      source,
+		SpecVersion: SpecVersion,
+		Type:        eventType,
+		Time:        time.Now().UTC(),
+		Subject:     subject,
+	}
+}
+
+// Headers возвращает атрибуты события в виде заголовков Kafka.
+// content-type не добавляется: его выставляет кодек тела сообщения.
+func (e Event) Headers() []kgo.RecordHeader {
+	headers := []kgo.RecordHeader{
+		{Key: HeaderSpecVersion, Value: []byte(e.SpecVersion)},
+		{Key: HeaderID, Value: []byte(e.ID)},
+		{Key: HeaderSource, Value: []byte(e.Source)},
+		{Key: HeaderType, Value: []byte(e.Type)},
+		{Key: HeaderTime, Value: []byte(e.Time.Format(time.RFC3339Nano))},
+	}
+	if e.Subject != "" {
+		headers = append(headers, kgo.RecordHeader{Key: HeaderSubject, Value: []byte(e.Subject)})
+	}
+	if e.DataSchema != "" {
+		headers = append(headers, kgo.RecordHeader{Key: HeaderDataSchema, Value: []byte(e.DataSchema)})
+	}
+	return headers
+}
+
+// FromHeaders восстанавливает и проверяет событие по заголовкам Kafka
+func FromHeaders(headers []kgo.RecordHeader) (Event, error) {
+	var (
+		e       Event
+		rawTime string
+	)
+	for _, h := range headers {
+		switch h.Key {
+		case HeaderSpecVersion:
+			e.SpecVersion = string(h.Value)
+		case HeaderID:
+			e.ID = string(h.Value)
+		case HeaderSource:
+			e.Source = string(h.Value)
+		case HeaderType:
+			e.Type = string(h.Value)
+		case HeaderTime:
+			rawTime = string(h.Value)
+		case HeaderSubject:
+			e.Subject = string(h.Value)
+		case HeaderDataSchema:
+			e.DataSchema = string(h.Value)
+		case HeaderDataContentType:
+			e.DataContentType = string(h.Value)
+		}
+	}
+
+	if e.SpecVersion == "" {
+		return Event{}, ErrNotCloudEvent
+	}
+	if rawTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, rawTime)
+		if err != nil {
+			return Event{}, fmt.Errorf("%w: bad time %q", ErrInvalidEvent, rawTime)
+		}
+		e.Time = t
+	}
+	return e, e.Validate()
+}
+
+// Validate проверяет обязательные атрибуты CloudEvents
+func (e Event) Validate() error {
+	var missing []string
+	if e.ID == "" {
+		missing = append(missing, "id")
+	}
+	if e.Source == "" {
+		missing = append(missing, "source")
+	}
+	if e.Type == "" {
+		missing = append(missing, "type")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing %s", ErrInvalidEvent, strings.Join(missing, ", "))
+	}
+	if e.SpecVersion != SpecVersion {
+		return fmt.Errorf("%w: unsupported specversion %q", ErrInvalidEvent, e.SpecVersion)
+	}
+	return nil
+}
+
+// Expect проверяет, что событие имеет ожидаемый тип
+func (e Event) Expect(eventType string) error {
+	if e.Type != eventType {
+		return fmt.Errorf("%w: unexpected type %q, want %q", ErrInvalidEvent, e.Type, eventType)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package messages
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Заголовки Kafka, описывающие формат тела сообщения
+const (
+	HeaderContentType   = "content-type"
+	HeaderSchemaVersion = "schema-version"
+
+	ContentTypeJSON = "application/json"
+)
+
+// Версии схемы сообщения о заказе (см. schemas/order.v*.json)
+const (
+	OrderSchemaV1 = 1 // Исходный формат: json.Marshal(domain.Order) без заголовков
+	OrderSchemaV2 = 2
+
+	OrderSchemaLatest = OrderSchemaV2
+
+	// OrderDataSchema - идентификатор JSON Schema актуальной версии (атрибут dataschema CloudEvents)
+	OrderDataSchema = "https://github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/messages/schemas/order.v2.json"
+)
+
+var (
+	ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+	ErrUnsupportedContentType   = errors.New("unsupported content type")
+	ErrInvalidMessage           = errors.New("invalid message")
+)
+
+// OrderV1 - сообщение о заказе версии 1
+type OrderV1 struct {
+	ID      string                 `json:"id"`
+	Status  string                 `json:"status"`
+	Payload map[string]interface{} `json:"payload"`
+}
+
+// OrderV2 - сообщение о заказе версии 2
+type OrderV2 struct {
+	OrderID    string                 `json:"order_id"`
+	Status     string                 `json:"status"`
+	CustomerID string                 `json:"customer_id,omitempty"` // Необязательное поле, добавлено вместе с аутентификацией
+	CreatedAt  time.Time              `json:"created_at"`
+	Payload    map[string]interface{} `json:"payload"`
+}
+
+// Order - актуальная версия сообщения о заказе
+type Order = OrderV2
+
+// NewOrder формирует сообщение актуальной версии из доменного заказа
+func NewOrder(order domain.Order, createdAt time.Time) Order {
+	return Order{
+		OrderID:    order.ID,
+		Status:     string(order.Status),
+		CustomerID: order.CustomerID,
+		CreatedAt:  createdAt,
+		Payload:    order.Payload,
+	}
+}
+
+// ToDomain преобразует сообщение в доменный заказ
+func (m Order) ToDomain() domain.Order {
+	return domain.Order{
+		ID:         m.OrderID,
+		Status:     domain.OrderStatus(m.Status),
+		CustomerID: m.CustomerID,
+		Payload:    m.Payload,
+	}
+}
+
+// Validate проверяет сообщение по schemas/order.v2.json: обязательные order_id и created_at, известный статус
+func (m OrderV2) Validate() error {
+	if m.OrderID == "" {
+		return fmt.Errorf("%w: order_id is required", ErrInvalidMessage)
+	}
+	if m.CreatedAt.IsZero() {
+		return fmt.Errorf("%w: created_at is required", ErrInvalidMessage)
+	}
+	return validateStatus(m.Status)
+}
+
+// Validate проверяет сообщение по schemas/order.v1.json: обязательный id, известный статус
+func (m OrderV1) Validate() error {
+	if m.ID == "" {
+		return fmt.Errorf("%w: id is required", ErrInvalidMessage)
+	}
+	return validateStatus(m.Status)
+}
+
+// validateStatus допускает пустой статус и статусы из перечисления схем
+func validateStatus(status string) error {
+	if status != "" && !domain.OrderStatus(status).IsValid() {
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidMessage, status)
+	}
+	return nil
+}
+
+// upcast переводит сообщение версии 1 в актуальную версию
+func (m OrderV1) upcast() Order {
+	return Order{
+		OrderID: m.ID,
+		Status:  m.Status,
+		Payload: m.Payload,
+	}
+}
+
+// EncodeOrder сериализует заказ в актуальной версии схемы и возвращает заголовки с ее описанием
+func EncodeOrder(order domain.Order, createdAt time.Time) ([]byte, []kgo.RecordHeader, error) {
+	msg := NewOrder(order, createdAt)
+	if err := msg.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка сериализации заказа %s: %w", order.ID, err)
+	}
+
+	return data, []kgo.RecordHeader{
+		{Key: HeaderContentType, Value: []byte(ContentTypeJSON)},
+		{Key: HeaderSchemaVersion, Value: []byte(strconv.Itoa(OrderSchemaLatest))},
+	}, nil
+}
+
+// DecodeOrder разбирает сообщение о заказе по версии из заголовков и приводит его к актуальной версии.
+// Сообщения без заголовка schema-version считаются версией 1.
+// Возвращается исходная версия сообщения.
+func DecodeOrder(headers []kgo.RecordHeader, value []byte) (Order, int, error) {
+	version, err := SchemaVersion(headers)
+	if err != nil {
+		return Order{}, 0, err
+	}
+
+	// Сообщение проверяется по схеме своей версии: в версии 1 нет created_at
+	switch version {
+	case OrderSchemaV1:
+		var v1 OrderV1
+		if err := json.Unmarshal(value, &v1); err != nil {
+			return Order{}, version, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+		if err := v1.Validate(); err != nil {
+			return Order{}, version, err
+		}
+		return v1.upcast(), version, nil
+	case OrderSchemaV2:
+		var msg OrderV2
+		if err := json.Unmarshal(value, &msg); err != nil {
+			return Order{}, version, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+		if err := msg.Validate(); err != nil {
+			return Order{}, version, err
+		}
+		return msg, version, nil
+	}
+	return Order{}, version, fmt.Errorf("%w: %d", ErrUnsupportedSchemaVersion, version)
+}
+
+// SchemaVersion читает версию схемы и проверяет content-type
+func SchemaVersion(headers []kgo.RecordHeader) (int, error) {
+	version := OrderSchemaV1
+	for _, h := range headers {
+		switch h.Key {
+		case HeaderContentType:
+			if string(h.Value) != ContentTypeJSON {
+				return 0, fmt.Errorf("%w: %s", ErrUnsupportedContentType, h.Value)
+			}
+		case HeaderSchemaVersion:
+			v, err := strconv.Atoi(string(h.Value))
+			if err != nil {
+				return 0, fmt.Errorf("%w: %q", ErrUnsupportedSchemaVersion, h.Value)
+			}
+			version = v
+		}
+	}
+	return version, nil
+}
@@ -0,0 +1,111 @@
+package messages
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func schemaHeaders(version int) []kgo.RecordHeader {
+	return []kgo.RecordHeader{
+		{Key: HeaderContentType, Value: []byte(ContentTypeJSON)},
+		{Key: HeaderSchemaVersion, Value: []byte(strconv.Itoa(version))},
+	}
+}
+
+func TestDecodeOrderValidatesSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []kgo.RecordHeader
+		value   string
+		wantErr error
+	}{
+		{
+			name:    "v2",
+			headers: schemaHeaders(OrderSchemaV2),
+			value:   `{"order_id":"o-1","status":"NEW","created_at":"2025-01-02T03:04:05Z","payload":{}}`,
+		},
+		{
+			name:    "v2 без created_at",
+			headers: schemaHeaders(OrderSchemaV2),
+			value:   `{"order_id":"o-1","status":"NEW","payload":{}}`,
+			wantErr: ErrInvalidMessage,
+		},
+		{
+			name:    "v2 с некорректным created_at",
+			headers: schemaHeaders(OrderSchemaV2),
+			value:   `{"order_id":"o-1","created_at":"вчера"}`,
+			wantErr: ErrInvalidMessage,
+		},
+		{
+			name:    "v2 без order_id",
+			headers: schemaHeaders(OrderSchemaV2),
+			value:   `{"created_at":"2025-01-02T03:04:05Z"}`,
+			wantErr: ErrInvalidMessage,
+		},
+		{
+			name:    "v2 с неизвестным статусом",
+			headers: schemaHeaders(OrderSchemaV2),
+			value:   `{"order_id":"o-1","status":"LOST","created_at":"2025-01-02T03:04:05Z"}`,
+			wantErr: ErrInvalidMessage,
+		},
+		{
+			name:  "v1 без заголовков и created_at",
+			value: `{"id":"o-1","status":"NEW","payload":{}}`,
+		},
+		{
+			name:    "v1 без id",
+			value:   `{"status":"NEW"}`,
+			wantErr: ErrInvalidMessage,
+		},
+		{
+			name:    "неизвестная версия",
+			headers: schemaHeaders(99),
+			value:   `{}`,
+			wantErr: ErrUnsupportedSchemaVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, _, err := DecodeOrder(tt.headers, []byte(tt.value))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ошибка %v, ожидалась %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeOrder: %v", err)
+			}
+			if msg.OrderID != "o-1" {
+				t.Errorf("order_id = %q", msg.OrderID)
+			}
+		})
+	}
+}
+
+func TestEncodeOrderRequiresCreatedAt(t *testing.T) {
+	order := domain.Order{ID: "o-1", Status: domain.StatusNew}
+
+	if _, _, err := EncodeOrder(order, time.Time{}); !errors.Is(err, ErrInvalidMessage) {
+		t.Fatalf("ошибка %v, ожидалась %v", err, ErrInvalidMessage)
+	}
+
+	createdAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	data, headers, err := EncodeOrder(order, createdAt)
+	if err != nil {
+		t.Fatalf("EncodeOrder: %v", err)
+	}
+	msg, version, err := DecodeOrder(headers, data)
+	if err != nil {
+		t.Fatalf("DecodeOrder: %v", err)
+	}
+	if version != OrderSchemaLatest || !msg.CreatedAt.Equal(createdAt) {
+		t.Errorf("версия %d, created_at %v", version, msg.CreatedAt)
+	}
+}
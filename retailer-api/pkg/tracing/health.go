@@ -0,0 +1,41 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	traceSdk "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// healthExporter оборачивает экспортер и запоминает результат последней отправки спанов
+type healthExporter struct {
+	traceSdk.SpanExporter
+
+	mu      sync.RWMutex
+	lastErr error
+}
+
+// Глобальный экспортер, через который ExporterStatus сообщает о доступности коллектора
+var exporterHealth *healthExporter
+
+func (e *healthExporter) ExportSpans(ctx context.Context, spans []traceSdk.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+
+	e.mu.Lock()
+	e.lastErr = err
+	e.mu.Unlock()
+
+	return err
+}
+
+// ExporterStatus возвращает ошибку последней отправки спанов в коллектор (nil, если она прошла успешно)
+func ExporterStatus() error {
+	if exporterHealth == nil {
+		return errors.New("трейсинг не инициализирован")
+	}
+
+	exporterHealth.mu.RLock()
+	defer exporterHealth.mu.RUnlock()
+	return exporterHealth.lastErr
+}
@@ -24,8 +24,8 @@ func InjectTraceContextToKafka(ctx context.Context) []kgo.RecordHeader {
 	}
 }
 
-// ExtractTraceContextFromKafka извлекает `traceparent` из заголовков Kafka и создаёт `Link` (Consumer)
-func ExtractTraceContextFromKafka(ctx context.Context, headers []kgo.RecordHeader) []trace.Link {
+// SpanContextFromKafka извлекает контекст спана-продюсера из заголовка `traceparent`
+func SpanContextFromKafka(ctx context.Context, headers []kgo.RecordHeader) trace.SpanContext {
 	carrier := propagation.MapCarrier{}
 
 	// Ищем `traceparent` в заголовках Kafka
@@ -36,23 +36,36 @@ func ExtractTraceContextFromKafka(ctx context.Context, headers []kgo.RecordHeade
 		}
 	}
 	if carrier["traceparent"] == "" {
-		return nil
+		return trace.SpanContext{}
 	}
 
 	// Извлекаем контекст трассировки из Kafka-заголовков
 	parentCtx := propagation.TraceContext{}.Extract(ctx, carrier)
-	parentSpanCtx := trace.SpanContextFromContext(parentCtx)
+	return trace.SpanContextFromContext(parentCtx)
+}
+
+// ExtractTraceContextFromKafka извлекает `traceparent` из заголовков Kafka и создаёт `Link` (Consumer)
+func ExtractTraceContextFromKafka(ctx context.Context, headers []kgo.RecordHeader) []trace.Link {
+	parentSpanCtx := SpanContextFromKafka(ctx, headers)
 
 	// Создаём Link с архитектурными атрибутами
 	var links []trace.Link
 	if parentSpanCtx.IsValid() {
+		attrs := []attribute.KeyValue{
+			attribute.String("link.type", "async"),     // Kafka - асинхронная связь
+			attribute.String("link.protocol", "kafka"), // Указываем, что это Kafka
+			attribute.String("link.role", "consumer"),  // Этот сервис - consumer
+		}
+		// Тип CloudEvents-события позволяет подписать асинхронное ребро в графе
+		for _, h := range headers {
+			if h.Key == "ce_type" {
+				attrs = append(attrs, attribute.String("link.event.type", string(h.Value)))
+				break
+			}
+		}
 		links = append(links, trace.Link{
 			SpanContext: parentSpanCtx,
-			Attributes: []attribute.KeyValue{
-				attribute.String("link.type", "async"),     // Kafka - асинхронная связь
-				attribute.String("link.protocol", "kafka"), // Указываем, что это Kafka
-				attribute.String("link.role", "consumer"),  // Этот сервис - consumer
-			},
+			Attributes:  attrs,
 		})
 	}
 
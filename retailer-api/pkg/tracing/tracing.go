@@ -20,8 +20,8 @@ const (
 	traceNameTemplate = "%s.%s.%s"
 )
 
-// Определяем глобальный трейсер
-var tracer trace.Tracer
+// Определяем глобальный трейсер; до InitTracer (например, в тестах) спаны не записываются
+var tracer trace.Tracer = otel.Tracer("")
 
 // InitTracer настраивает OpenTelemetry Tracer Provider
 func InitTracer(cfg TraceConfig, info AppInfo) func() {
@@ -36,10 +36,13 @@ func InitTracer(cfg TraceConfig, info AppInfo) func() {
 		log.Fatalf("Ошибка инициализации OTLP экспортера: %v", err)
 	}
 
+	// Обертка запоминает результат экспорта для проверок готовности сервиса
+	exporterHealth = &healthExporter{SpanExporter: exporter}
+
 	// Создание Tracer Provider
 	tp := traceSdk.NewTracerProvider(
 		traceSdk.WithSampler(traceSdk.ParentBased(traceSdk.TraceIDRatioBased(cfg.SampleRate))),
-		traceSdk.WithBatcher(exporter),
+		traceSdk.WithBatcher(exporterHealth),
 		traceSdk.WithResource(resource.NewWithAttributes(
 			semconv.SchemaURL,
 			semconv.ServiceName(info.ServiceName),
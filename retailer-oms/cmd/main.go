@@ -2,15 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/handler"
 	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/infrastructure"
 	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/workflows"
+	"github.com/gin-gonic/gin"
 )
 
 func main() {
@@ -27,31 +34,152 @@ func main() {
 		ServiceInstanceID: os.Getenv("APP_INSTANCE_ID"),     // Уникальный ID экземпляра сервиса
 	}
 
-	sagaConfig := &workflows.ServicesConfig{
-		SvcAssembly: os.Getenv("SVC_ASSEMBLY"),
-		SvcPayment:  os.Getenv("SVC_PAYMENT"),
-		SvcDelivery: os.Getenv("SVC_DELIVERY"),
-	}
-
 	// Инициализация трейсинга
 	shutdown := tracing.InitTracer(cfg, appInfo)
 	defer shutdown()
 
 	kafkaTopic := os.Getenv("KAFKA_ORDERS_TOPIC")
+	kafkaCommandsTopic := os.Getenv("KAFKA_ORDER_COMMANDS_TOPIC")
+	if kafkaCommandsTopic == "" {
+		kafkaCommandsTopic = "order-commands"
+	}
+	kafkaStatusTopic := os.Getenv("KAFKA_ORDER_STATUS_TOPIC")
+	if kafkaStatusTopic == "" {
+		kafkaStatusTopic = "order-status"
+	}
+	kafkaDeadLetterTopic := os.Getenv("SAGA_DEAD_LETTER_TOPIC")
+	if kafkaDeadLetterTopic == "" {
+		kafkaDeadLetterTopic = "saga-dead-letter"
+	}
+	kafkaOrdersDLQTopic := os.Getenv("KAFKA_ORDERS_DLQ_TOPIC")
+	if kafkaOrdersDLQTopic == "" {
+		kafkaOrdersDLQTopic = "orders-dlq"
+	}
 	kafkaBrokers := strings.Split(os.Getenv("KAFKA_BROKER"), ",")
 
+	// Команда оператора: retailer-oms redrive [-by имя] <id заказа>...
+	if len(os.Args) > 1 && os.Args[1] == "redrive" {
+		if err := redrive(kafkaBrokers, kafkaCommandsTopic, events.Source(appInfo), os.Args[2:]); err != nil {
+			log.Printf("Ошибка перезапуска саг: %v", err)
+			shutdown()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Команда оператора: retailer-oms replay [-all] [-order id]... [партиция:offset]...
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replay(kafkaBrokers, kafkaOrdersDLQTopic, os.Args[2:]); err != nil {
+			log.Printf("Ошибка повторной обработки сообщений: %v", err)
+			shutdown()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Токен оператора для admin API; без него OMS не запускается
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Fatalf("Не задан ADMIN_TOKEN - токен оператора для admin API")
+	}
+
+	// Хранилище состояния саг переживает рестарт OMS
+	sagaStorePath := os.Getenv("SAGA_STORE_PATH")
+	if sagaStorePath == "" {
+		sagaStorePath = "sagas.db"
+	}
+	sagaRetention, err := time.ParseDuration(os.Getenv("SAGA_RETENTION"))
+	if err != nil {
+		sagaRetention = 24 * time.Hour
+	}
+	sagaStore, err := infrastructure.OpenSagaStore(sagaStorePath, sagaRetention)
+	if err != nil {
+		log.Fatalf("Ошибка инициализации хранилища саг: %v", err)
+	}
+	defer sagaStore.Close()
+
+	// Шаги саги описаны в YAML; адреса сервисов берутся из SVC_ASSEMBLY, SVC_PAYMENT, SVC_DELIVERY
+	sagaDefinitionPath := os.Getenv("SAGA_DEFINITION_PATH")
+	if sagaDefinitionPath == "" {
+		sagaDefinitionPath = "sagas/order-processing.yaml"
+	}
+	sagaDefinition, err := infrastructure.LoadSagaDefinition(sagaDefinitionPath)
+	if err != nil {
+		log.Fatalf("Ошибка загрузки описания саги: %v", err)
+	}
+
+	// Продюсер для шагов саги вида kafka, статусов заказов и зависших саг
+	publisher := infrastructure.NewKafkaPublisher(kafkaBrokers, events.Source(appInfo))
+	defer publisher.Close()
+
 	// Инициализация Saga Manager
-	sagaManager := workflows.NewSagaManager(sagaConfig)
+	sagaManager, err := workflows.NewSagaManager(sagaDefinition, publisher, sagaStore, workflows.SagaTopics{
+		OrderStatus: kafkaStatusTopic,
+		DeadLetter:  kafkaDeadLetterTopic,
+	})
+	if err != nil {
+		log.Fatalf("Ошибка инициализации Saga Manager: %v", err)
+	}
 
-	// Запуск Kafka-консьюмера
-	kafkaConsumer := infrastructure.NewKafkaConsumer(kafkaBrokers, kafkaTopic, sagaManager, 500)
+	// Запуск Kafka-консьюмера: заказы распределяются по полосам по ключу, порядок сообщений заказа сохраняется
+	laneCount, err := strconv.Atoi(os.Getenv("KAFKA_CONSUMER_LANES"))
+	if err != nil || laneCount < 1 {
+		laneCount = 500
+	}
+	laneDepth, err := strconv.Atoi(os.Getenv("KAFKA_CONSUMER_LANE_DEPTH"))
+	if err != nil || laneDepth < 0 {
+		laneDepth = 2
+	}
+	// Партиции закреплены за экземпляром, потому что саги хранятся в его локальном файле SAGA_STORE_PATH
+	groupInstanceID := os.Getenv("KAFKA_GROUP_INSTANCE_ID")
+	kafkaConsumer := infrastructure.NewKafkaConsumer(kafkaBrokers, kafkaTopic, kafkaOrdersDLQTopic, sagaManager, laneCount, laneDepth, groupInstanceID)
 	defer kafkaConsumer.Close()
 
+	// Команды покупателей (отмена заказа) и операторов (перезапуск саги) читаются каждым экземпляром
+	commandConsumer, err := infrastructure.NewCommandConsumer(kafkaBrokers, kafkaCommandsTopic, sagaManager)
+	if err != nil {
+		log.Fatalf("Ошибка инициализации консьюмера команд: %v", err)
+	}
+	defer commandConsumer.Close()
+
 	// Контекст для graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go kafkaConsumer.StartListening(ctx)
+	go sagaStore.Run(ctx)
+
+	// Саги, прерванные остановкой OMS, продолжаются до чтения новых заказов
+	if err := sagaManager.Recover(ctx); err != nil {
+		log.Fatalf("Ошибка восстановления саг: %v", err)
+	}
+
+	// Offset'ы заказов коммитятся после обработки, поэтому перед Close нужно дождаться воркеров
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		kafkaConsumer.StartListening(ctx)
+	}()
+	go commandConsumer.StartListening(ctx)
+
+	// Служебный HTTP API для операторов. По умолчанию слушает только loopback; адрес, доступный
+	// из сети (ADMIN_LISTEN_ADDRESS=:8085 в контейнере), должен быть закрыт от внешнего трафика.
+	adminAddress := os.Getenv("ADMIN_LISTEN_ADDRESS")
+	if adminAddress == "" {
+		adminAddress = "127.0.0.1:8085"
+	}
+	router := gin.New()
+	router.Use(gin.Recovery())
+	handler.NewAdminHandler(sagaManager, kafkaConsumer, adminToken).Register(router)
+	adminServer := &http.Server{
+		Addr:    adminAddress,
+		Handler: router,
+	}
+	go func() {
+		log.Printf("Admin API слушает %s", adminAddress)
+		if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Ошибка admin API: %v", err)
+		}
+	}()
 
 	// Ожидание сигнала завершения работы
 	sigCh := make(chan os.Signal, 1)
@@ -59,6 +187,11 @@ func main() {
 	<-sigCh
 
 	log.Println("Завершаем работу...")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := adminServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Admin API не успел обработать запросы: %v", err)
+	}
 	cancel()
-
+	<-consumerDone
 }
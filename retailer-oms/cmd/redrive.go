@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/infrastructure"
+	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/workflows"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// redrive отправляет в топик команд запрос перезапустить компенсации зависших саг.
+// Состояние саги хранится у экземпляра OMS, который ее выполнял, поэтому команда идет через Kafka:
+// ее читают все экземпляры, а выполняет тот, у которого сага зависла.
+func redrive(brokers []string, topic, source string, args []string) error {
+	flags := flag.NewFlagSet("redrive", flag.ContinueOnError)
+	requestedBy := flags.String("by", os.Getenv("USER"), "кто перезапускает сагу (для аудита)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("использование: retailer-oms redrive [-by имя] <id заказа>...")
+	}
+
+	publisher := infrastructure.NewKafkaPublisher(brokers, source)
+	defer publisher.Close()
+
+	for _, orderID := range flags.Args() {
+		if err := publishRedrive(publisher, topic, orderID, *requestedBy); err != nil {
+			return err
+		}
+		log.Printf("Запрошен перезапуск компенсаций саги заказа %s", orderID)
+	}
+	return nil
+}
+
+// publishRedrive публикует команду перезапуска саги одного заказа
+func publishRedrive(publisher *infrastructure.KafkaPublisher, topic, orderID, requestedBy string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ctx, span := tracing.StartApplication(ctx, "RequestRedrive")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", orderID),
+		attribute.String("redrive.requested_by", requestedBy),
+	)
+
+	data, err := json.Marshal(workflows.RedriveCommand{
+		OrderID:     orderID,
+		RequestedBy: requestedBy,
+		RequestedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка сериализации команды перезапуска саги %s: %w", orderID, err)
+	}
+	if err := publisher.Publish(ctx, topic, events.TypeSagaRedriveRequested, orderID, data); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
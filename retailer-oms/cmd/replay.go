@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/infrastructure"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// replay возвращает выбранные сообщения из DLQ заказов в исходный топик.
+// Записи выбираются по id заказа (-order), по адресу в DLQ (партиция:offset) или все (-all).
+// Заказ, сага которого уже завершена, при повторной обработке пропускается.
+func replay(brokers []string, topic string, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	all := flags.Bool("all", false, "вернуть все сообщения DLQ")
+	var orders []string
+	flags.Func("order", "вернуть сообщения заказа (можно указать несколько раз)", func(value string) error {
+		orders = append(orders, value)
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	positions := make(map[string]bool)
+	for _, arg := range flags.Args() {
+		partition, offset, ok := strings.Cut(arg, ":")
+		if !ok {
+			return fmt.Errorf("неверный адрес сообщения %q, ожидается партиция:offset", arg)
+		}
+		p, err := strconv.ParseInt(partition, 10, 32)
+		if err != nil {
+			return fmt.Errorf("неверная партиция в %q: %w", arg, err)
+		}
+		o, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil {
+			return fmt.Errorf("неверный offset в %q: %w", arg, err)
+		}
+		positions[fmt.Sprintf("%d:%d", p, o)] = true
+	}
+	if !*all && len(orders) == 0 && len(positions) == 0 {
+		return errors.New("использование: retailer-oms replay [-all] [-order id]... [партиция:offset]...")
+	}
+
+	selected := func(record *kgo.Record) bool {
+		if *all || positions[fmt.Sprintf("%d:%d", record.Partition, record.Offset)] {
+			return true
+		}
+		return slices.Contains(orders, infrastructure.DeadLetterOrderID(record))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	n, err := infrastructure.ReplayDeadLetters(ctx, brokers, topic, selected)
+	log.Printf("Из %s возвращено сообщений: %d", topic, n)
+	return err
+}
@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/workflows"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// defaultSagaListLimit - сколько саг возвращает список без параметра limit
+	defaultSagaListLimit = 100
+
+	// operatorHeader - имя оператора для аудита действий
+	operatorHeader = "X-Operator"
+
+	// bearerPrefix - префикс токена admin API в заголовке Authorization
+	bearerPrefix = "Bearer "
+)
+
+// ConsumerControl приостанавливает и возобновляет чтение заказов
+type ConsumerControl interface {
+	Pause()
+	Resume()
+	Paused() bool
+}
+
+// AdminHandler - служебный HTTP API OMS: просмотр саг и ручное управление ими.
+// Все маршруты требуют токен оператора в заголовке Authorization: Bearer <token>.
+type AdminHandler struct {
+	sagas    *workflows.SagaManager
+	consumer ConsumerControl
+	token    string
+}
+
+func NewAdminHandler(sagas *workflows.SagaManager, consumer ConsumerControl, token string) *AdminHandler {
+	return &AdminHandler{sagas: sagas, consumer: consumer, token: token}
+}
+
+// Register регистрирует маршруты admin API
+func (h *AdminHandler) Register(router gin.IRouter) {
+	admin := router.Group("/admin", h.authorize)
+	admin.GET("/sagas", h.ListSagas)
+	admin.GET("/sagas/:id", h.GetSaga)
+	admin.POST("/sagas/:id/steps/:step/retry", h.RetryStep)
+	admin.POST("/sagas/:id/compensate", h.Compensate)
+	admin.GET("/consumer", h.ConsumerStatus)
+	admin.POST("/consumer/pause", h.PauseConsumer)
+	admin.POST("/consumer/resume", h.ResumeConsumer)
+}
+
+// authorize пропускает только запросы с токеном оператора. Пустой токен не принимается,
+// даже если admin API по ошибке запущен без него.
+func (h *AdminHandler) authorize(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	token, ok := strings.CutPrefix(header, bearerPrefix)
+	if !ok || h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	c.Next()
+}
+
+// sagaSummary - строка списка саг
+type sagaSummary struct {
+	OrderID     string               `json:"order_id"`
+	Status      workflows.SagaStatus `json:"status"`
+	OrderStatus domain.OrderStatus   `json:"order_status,omitempty"`
+	Step        string               `json:"step,omitempty"`
+	Error       string               `json:"error,omitempty"`
+	TraceID     string               `json:"trace_id,omitempty"` // Трейс последнего шага
+	StartedAt   time.Time            `json:"started_at"`
+	Deadline    *time.Time           `json:"deadline,omitempty"` // Срок выполнения шагов саги
+	UpdatedAt   time.Time            `json:"updated_at"`
+}
+
+// sagaView - сага с хронологией шагов
+type sagaView struct {
+	sagaSummary
+	CompletedSteps      []string                   `json:"completed_steps,omitempty"`
+	CompensatedSteps    []string                   `json:"compensated_steps,omitempty"`
+	FailedCompensations []string                   `json:"failed_compensations,omitempty"`
+	RejectedSteps       []string                   `json:"rejected_steps,omitempty"` // Отклонены circuit breaker или bulkhead
+	Cancel              *domain.CancelOrderCommand `json:"cancel,omitempty"`
+	Redrives            int                        `json:"redrives,omitempty"`
+	Timeline            []workflows.StepRecord     `json:"timeline"`
+}
+
+func newSagaSummary(state workflows.SagaState) sagaSummary {
+	summary := sagaSummary{
+		OrderID:     state.OrderID,
+		Status:      state.Status,
+		OrderStatus: state.OrderStatus,
+		Step:        state.Step,
+		Error:       state.Error,
+		TraceID:     state.TraceID(),
+		StartedAt:   state.StartedAt,
+		UpdatedAt:   state.UpdatedAt,
+	}
+	if !state.Deadline.IsZero() {
+		summary.Deadline = &state.Deadline
+	}
+	return summary
+}
+
+func newSagaView(state workflows.SagaState) sagaView {
+	timeline := state.Timeline
+	if timeline == nil {
+		timeline = []workflows.StepRecord{}
+	}
+	return sagaView{
+		sagaSummary:         newSagaSummary(state),
+		CompletedSteps:      state.CompletedSteps,
+		CompensatedSteps:    state.CompensatedSteps,
+		FailedCompensations: state.FailedCompensations,
+		RejectedSteps:       state.RejectedSteps,
+		Cancel:              state.Cancel,
+		Redrives:            state.Redrives,
+		Timeline:            timeline,
+	}
+}
+
+// ListSagas возвращает выполняющиеся и недавние саги: GET /admin/sagas?status=RUNNING&limit=50
+func (h *AdminHandler) ListSagas(c *gin.Context) {
+	ctx, span := tracing.StartPresentation(c.Request.Context(), "ListSagas", tracing.SubLayerHTTP)
+	defer span.End()
+
+	status := workflows.SagaStatus(c.Query("status"))
+	limit := defaultSagaListLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	states, err := h.sagas.Sagas(ctx, status, limit)
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list sagas"})
+		return
+	}
+
+	sagas := make([]sagaSummary, 0, len(states))
+	for _, state := range states {
+		sagas = append(sagas, newSagaSummary(state))
+	}
+	c.JSON(http.StatusOK, gin.H{"sagas": sagas})
+}
+
+// GetSaga возвращает сагу заказа с хронологией шагов и их trace id: GET /admin/sagas/:id
+func (h *AdminHandler) GetSaga(c *gin.Context) {
+	ctx, span := tracing.StartPresentation(c.Request.Context(), "GetSaga", tracing.SubLayerHTTP)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order.id", c.Param("id")))
+
+	state, err := h.sagas.Saga(ctx, c.Param("id"))
+	if errors.Is(err, workflows.ErrSagaNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "saga not found"})
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get saga"})
+		return
+	}
+
+	c.JSON(http.StatusOK, newSagaView(state))
+}
+
+// RetryStep повторяет невыполненную компенсацию шага зависшей саги: POST /admin/sagas/:id/steps/:step/retry
+func (h *AdminHandler) RetryStep(c *gin.Context) {
+	ctx, span := tracing.StartPresentation(c.Request.Context(), "RetryStep", tracing.SubLayerHTTP)
+	defer span.End()
+
+	operator := operatorName(c, span)
+	state, err := h.sagas.RetryStep(ctx, c.Param("id"), c.Param("step"), operator)
+	switch {
+	case errors.Is(err, workflows.ErrSagaNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "saga not found"})
+	case errors.Is(err, workflows.ErrStepNotRetryable), errors.Is(err, workflows.ErrSagaBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		// Компенсация снова не выполнена: сага остается зависшей
+		span.RecordError(err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "saga": newSagaView(state)})
+	default:
+		c.JSON(http.StatusOK, newSagaView(state))
+	}
+}
+
+// compensateRequest - тело запроса принудительной компенсации
+type compensateRequest struct {
+	Reason string `json:"reason"`
+	// ConfirmPointOfNoReturn - оператор подтверждает откат заказа, прошедшего точку невозврата
+	// (например, уже отгруженного); без подтверждения такая компенсация отклоняется
+	ConfirmPointOfNoReturn bool `json:"confirm_point_of_no_return"`
+}
+
+// Compensate прерывает сагу и откатывает выполненные шаги: POST /admin/sagas/:id/compensate.
+// Компенсации выполняются в фоне, ход виден в GET /admin/sagas/:id.
+// Заказ после точки невозврата откатывается только с confirm_point_of_no_return: true.
+func (h *AdminHandler) Compensate(c *gin.Context) {
+	ctx, span := tracing.StartPresentation(c.Request.Context(), "CompensateSaga", tracing.SubLayerHTTP)
+	defer span.End()
+
+	var req compensateRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+			return
+		}
+	}
+
+	operator := operatorName(c, span)
+	err := h.sagas.ForceCompensation(ctx, c.Param("id"), req.Reason, operator, req.ConfirmPointOfNoReturn)
+	switch {
+	case errors.Is(err, workflows.ErrSagaNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "saga not found"})
+	case errors.Is(err, workflows.ErrCancelRejected):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to compensate saga"})
+	default:
+		c.JSON(http.StatusAccepted, gin.H{"status": "compensation requested"})
+	}
+}
+
+// ConsumerStatus сообщает, читает ли OMS новые заказы: GET /admin/consumer
+func (h *AdminHandler) ConsumerStatus(c *gin.Context) {
+	_, span := tracing.StartPresentation(c.Request.Context(), "ConsumerStatus", tracing.SubLayerHTTP)
+	defer span.End()
+
+	c.JSON(http.StatusOK, gin.H{"paused": h.consumer.Paused()})
+}
+
+// PauseConsumer приостанавливает чтение новых заказов: POST /admin/consumer/pause.
+// Выполняющиеся саги, команды отмены и перезапуска продолжают обрабатываться.
+func (h *AdminHandler) PauseConsumer(c *gin.Context) {
+	_, span := tracing.StartPresentation(c.Request.Context(), "PauseConsumer", tracing.SubLayerHTTP)
+	defer span.End()
+
+	operatorName(c, span)
+	h.consumer.Pause()
+	c.JSON(http.StatusOK, gin.H{"paused": true})
+}
+
+// ResumeConsumer возобновляет чтение заказов: POST /admin/consumer/resume
+func (h *AdminHandler) ResumeConsumer(c *gin.Context) {
+	_, span := tracing.StartPresentation(c.Request.Context(), "ResumeConsumer", tracing.SubLayerHTTP)
+	defer span.End()
+
+	operatorName(c, span)
+	h.consumer.Resume()
+	c.JSON(http.StatusOK, gin.H{"paused": false})
+}
+
+// operatorName возвращает имя оператора из заголовка X-Operator и отмечает его в спане действия
+func operatorName(c *gin.Context, span trace.Span) string {
+	operator := c.GetHeader(operatorHeader)
+	if operator == "" {
+		operator = "admin-api"
+	}
+	span.SetAttributes(attribute.String("admin.operator", operator))
+	return operator
+}
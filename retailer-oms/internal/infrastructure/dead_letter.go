@@ -0,0 +1,291 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/messages"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Заголовки записи в DLQ заказов. Остальные заголовки (traceparent, CloudEvents, схема) сохраняются как были.
+const (
+	HeaderDLQPrefix            = "dlq-"
+	HeaderDLQOriginalTopic     = "dlq-original-topic"
+	HeaderDLQOriginalPartition = "dlq-original-partition"
+	HeaderDLQOriginalOffset    = "dlq-original-offset"
+	HeaderDLQError             = "dlq-error"
+	HeaderDLQErrorType         = "dlq-error-type" // poison - сообщение не разобрать, saga - сагу не удалось выполнить (ошибка хранилища саг и т.п.)
+	HeaderDLQAttempts          = "dlq-attempts"   // Сколько раз сообщение обрабатывалось с ошибкой, включая повторы после replay
+	HeaderDLQFailedAt          = "dlq-failed-at"
+)
+
+// Повторы записи в DLQ: попытка ограничена по времени, паузы между попытками растут до deadLetterRetryMax
+const (
+	deadLetterAttemptTimeout = 10 * time.Second
+	deadLetterRetryMin       = 500 * time.Millisecond
+	deadLetterRetryMax       = 30 * time.Second
+)
+
+// errPoisonMessage - сообщение невозможно разобрать, повторная обработка без исправления не поможет
+var errPoisonMessage = errors.New("poison message")
+
+// deadLetterAttempts возвращает число предыдущих неудачных обработок сообщения (0 - сообщение новое)
+func deadLetterAttempts(headers []kgo.RecordHeader) int {
+	for _, h := range headers {
+		if h.Key == HeaderDLQAttempts {
+			if n, err := strconv.Atoi(string(h.Value)); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// deadLetter публикует необработанную запись в DLQ с заголовками исходного топика, партиции, offset'а и ошибки.
+// Ошибка возвращается, только если запись не удалось сохранить в DLQ: тогда offset не коммитится.
+func (kc *KafkaConsumer) deadLetter(ctx context.Context, record *kgo.Record, cause error) error {
+	ctx, span := tracing.StartInfrastructure(ctx, "DeadLetter", tracing.SubLayerBroker)
+	defer span.End()
+
+	errorType := "saga"
+	if errors.Is(cause, errPoisonMessage) {
+		errorType = "poison"
+	}
+	attempts := deadLetterAttempts(record.Headers) + 1
+
+	span.SetAttributes(
+		attribute.String("kafka.topic", kc.deadLetterTopic),
+		attribute.String("dlq.original_topic", record.Topic),
+		attribute.Int("dlq.original_partition", int(record.Partition)),
+		attribute.Int64("dlq.original_offset", record.Offset),
+		attribute.String("error.type", errorType),
+		attribute.Int("dlq.attempts", attempts),
+	)
+	span.SetStatus(codes.Error, cause.Error())
+
+	headers := make([]kgo.RecordHeader, 0, len(record.Headers)+7)
+	for _, h := range record.Headers {
+		if !strings.HasPrefix(h.Key, HeaderDLQPrefix) {
+			headers = append(headers, h)
+		}
+	}
+	headers = append(headers,
+		kgo.RecordHeader{Key: HeaderDLQOriginalTopic, Value: []byte(record.Topic)},
+		kgo.RecordHeader{Key: HeaderDLQOriginalPartition, Value: []byte(strconv.Itoa(int(record.Partition)))},
+		kgo.RecordHeader{Key: HeaderDLQOriginalOffset, Value: []byte(strconv.FormatInt(record.Offset, 10))},
+		kgo.RecordHeader{Key: HeaderDLQError, Value: []byte(cause.Error())},
+		kgo.RecordHeader{Key: HeaderDLQErrorType, Value: []byte(errorType)},
+		kgo.RecordHeader{Key: HeaderDLQAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kgo.RecordHeader{Key: HeaderDLQFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+
+	dead := &kgo.Record{
+		Topic:   kc.deadLetterTopic,
+		Key:     record.Key,
+		Value:   record.Value,
+		Headers: headers,
+	}
+	if err := kc.client.ProduceSync(ctx, dead).FirstErr(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка публикации в DLQ %s: %w", kc.deadLetterTopic, err)
+	}
+
+	log.Printf("Сообщение %s/%d/%d отправлено в %s (попытка %d): %v",
+		record.Topic, record.Partition, record.Offset, kc.deadLetterTopic, attempts, cause)
+	return nil
+}
+
+// deadLetterWithRetry повторяет запись в DLQ с растущей паузой, пока она не удастся: без нее offset записи
+// не коммитится, watermark партиции стоит, а следующие записи копятся в памяти и доставляются повторно.
+// Повторы прекращаются, только если консьюмер остановлен или партиция отозвана - запись получит новый владелец.
+func (kc *KafkaConsumer) deadLetterWithRetry(ctx context.Context, record *kgo.Record, cause error) error {
+	delay := deadLetterRetryMin
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, deadLetterAttemptTimeout)
+		err := kc.deadLetter(attemptCtx, record, cause)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || !kc.offsets.tracked(record) {
+			return err
+		}
+
+		log.Printf("Не удалось записать сообщение %s/%d/%d в DLQ, повтор через %s: %v",
+			record.Topic, record.Partition, record.Offset, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay = min(delay*2, deadLetterRetryMax)
+	}
+}
+
+// DeadLetterSelector выбирает записи DLQ для повторной обработки
+type DeadLetterSelector func(record *kgo.Record) bool
+
+// DeadLetterOrderID возвращает id заказа записи DLQ: из атрибута CloudEvents subject, а у сообщений без конверта -
+// из тела. Ключ записи для этого не годится: при KAFKA_PARTITION_KEY=customer_id в нем id покупателя.
+// Пустая строка - заказ не определить (сообщение не разобрать).
+func DeadLetterOrderID(record *kgo.Record) string {
+	for _, h := range record.Headers {
+		if h.Key == events.HeaderSubject && len(h.Value) > 0 {
+			return string(h.Value)
+		}
+	}
+	if msg, _, err := messages.DecodeOrder(record.Headers, record.Value); err == nil {
+		return msg.OrderID
+	}
+	return ""
+}
+
+// ReplayDeadLetters возвращает выбранные записи DLQ в исходные топики. Топик читается от начала до high watermark
+// на момент запуска; партиция считается прочитанной, когда чтение дошло до него, даже если последние offset'ы
+// заняты маркерами транзакций или удалены по retention.
+// Заголовок traceparent не меняется, поэтому повторная обработка связана с исходным трейсом сообщения;
+// спан ReplayMessage связан с ним же связью replay. Возвращает число возвращенных записей.
+func ReplayDeadLetters(ctx context.Context, brokers []string, topic string, selected DeadLetterSelector) (int, error) {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		// Маркеры транзакций тоже сдвигают позицию чтения: без них нельзя понять, что партиция дочитана
+		kgo.KeepControlRecords(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка инициализации Kafka-клиента: %w", err)
+	}
+	defer client.Close()
+
+	adm := kadm.NewClient(client)
+	starts, err := adm.ListStartOffsets(ctx, topic)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка чтения начала топика %s: %w", topic, err)
+	}
+	ends, err := adm.ListEndOffsets(ctx, topic)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка чтения конца топика %s: %w", topic, err)
+	}
+	// High watermark каждой партиции, в которой есть записи
+	remaining := make(map[int32]int64)
+	ends.Each(func(end kadm.ListedOffset) {
+		start, ok := starts.Lookup(topic, end.Partition)
+		if end.Err == nil && ok && start.Err == nil && start.Offset < end.Offset {
+			remaining[end.Partition] = end.Offset
+		}
+	})
+
+	replayed := 0
+	for len(remaining) > 0 {
+		fetches := client.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+		fetches.EachError(func(t string, partition int32, err error) {
+			log.Printf("Ошибка чтения топика %s (партиция %d): %v", t, partition, err)
+		})
+
+		for _, fetch := range fetches {
+			for _, t := range fetch.Topics {
+				for _, p := range t.Partitions {
+					end, ok := remaining[p.Partition]
+					if !ok {
+						continue
+					}
+					for _, record := range p.Records {
+						if record.Offset >= end {
+							// Записи, попавшие в DLQ после запуска replay, не возвращаются
+							break
+						}
+						if record.Attrs.IsControl() || !selected(record) {
+							continue
+						}
+						if err := replayRecord(ctx, client, record); err != nil {
+							return replayed, err
+						}
+						replayed++
+					}
+					// Партиция дочитана до high watermark или записи до него удалены по retention
+					if n := len(p.Records); (n > 0 && p.Records[n-1].Offset+1 >= end) || p.LogStartOffset >= end {
+						delete(remaining, p.Partition)
+					}
+				}
+			}
+		}
+	}
+	return replayed, nil
+}
+
+// replayRecord публикует запись DLQ в исходный топик; из заголовков dlq- сохраняется только счетчик попыток
+func replayRecord(ctx context.Context, client *kgo.Client, record *kgo.Record) error {
+	var links []trace.Link
+	if original := tracing.SpanContextFromKafka(ctx, record.Headers); original.IsValid() {
+		links = append(links, trace.Link{
+			SpanContext: original,
+			Attributes: []attribute.KeyValue{
+				attribute.String("link.type", "replay"),
+			},
+		})
+	}
+	ctx, span := tracing.StartApplication(ctx, "ReplayMessage", trace.WithLinks(links...))
+	defer span.End()
+
+	var originalTopic, errorText string
+	headers := make([]kgo.RecordHeader, 0, len(record.Headers))
+	for _, h := range record.Headers {
+		switch {
+		case h.Key == HeaderDLQOriginalTopic:
+			originalTopic = string(h.Value)
+		case h.Key == HeaderDLQError:
+			errorText = string(h.Value)
+		case h.Key == HeaderDLQAttempts || !strings.HasPrefix(h.Key, HeaderDLQPrefix):
+			headers = append(headers, h)
+		}
+	}
+
+	span.SetAttributes(
+		attribute.String("order.id", DeadLetterOrderID(record)),
+		attribute.String("kafka.topic", originalTopic),
+		attribute.String("dlq.topic", record.Topic),
+		attribute.Int("dlq.partition", int(record.Partition)),
+		attribute.Int64("dlq.offset", record.Offset),
+		attribute.Int("dlq.attempts", deadLetterAttempts(record.Headers)),
+	)
+	if originalTopic == "" {
+		err := fmt.Errorf("у записи %s/%d/%d нет заголовка %s", record.Topic, record.Partition, record.Offset, HeaderDLQOriginalTopic)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	replay := &kgo.Record{
+		Topic:   originalTopic,
+		Key:     record.Key,
+		Value:   record.Value,
+		Headers: headers,
+	}
+	if err := client.ProduceSync(ctx, replay).FirstErr(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("ошибка публикации в топик %s: %w", originalTopic, err)
+	}
+
+	log.Printf("Сообщение %s/%d/%d (заказ %s, ошибка: %s) возвращено в %s",
+		record.Topic, record.Partition, record.Offset, DeadLetterOrderID(record), errorText, originalTopic)
+	return nil
+}
@@ -2,115 +2,286 @@ package infrastructure
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/messages"
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
 	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/workflows"
 	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
-// KafkaConsumer отвечает за получение заказов из Kafka
+// revokeDrainTimeout - сколько при отзыве партиций ждать обработки уже полученных записей;
+// должно быть меньше rebalance timeout группы (по умолчанию 60s)
+const revokeDrainTimeout = 30 * time.Second
+
+// backlogPollInterval - как часто при отложенных записях цикл опроса проверяет, освободились ли полосы
+const backlogPollInterval = 100 * time.Millisecond
+
+// KafkaConsumer отвечает за получение заказов из Kafka.
+// Offset коммитится только после обработки записи (at-least-once). Состояние саг хранится в локальном файле
+// экземпляра, поэтому повторно доставленный заказ не запускает сагу заново, только если его получает тот же экземпляр.
+// Партиции удерживаются за владельцами: static membership (instanceID) переживает рестарт экземпляра
+// без ребалансировки, а cooperative-sticky при ребалансировке не переносит партиции без необходимости.
+// Если партиция все же переходит к другому экземпляру (масштабирование, экземпляр недоступен дольше
+// session timeout), саги ее незакоммиченных записей выполнятся повторно - исключить это может только общее хранилище саг.
 type KafkaConsumer struct {
-	client      *kgo.Client
-	topic       string
-	sagaManager *workflows.SagaManager
-	workerCount int
+	client          *kgo.Client
+	topic           string
+	deadLetterTopic string // DLQ для сообщений, которые не удалось обработать
+	sagaManager     *workflows.SagaManager
+	laneCount       int // Число полос (воркеров)
+	laneDepth       int // Длина очереди одной полосы
+	offsets         *offsetTracker
+	backlog         *partitionBacklog // Записи, не поместившиеся в заполненные полосы
+	stopped         atomic.Bool       // Воркеры остановлены, необработанные записи ждать бессмысленно
+	// process обрабатывает запись; по умолчанию processMessage, тесты подменяют его
+	process func(ctx context.Context, record *kgo.Record) error
 }
 
-// NewKafkaConsumer создает нового Kafka-консьюмера
-func NewKafkaConsumer(brokers []string, topic string, sagaManager *workflows.SagaManager, workerCount int) *KafkaConsumer {
+// NewKafkaConsumer создает нового Kafka-консьюмера с laneCount воркерами, у каждого очередь длиной laneDepth.
+// instanceID - постоянный идентификатор экземпляра в группе (group.instance.id), уникальный для каждого
+// экземпляра OMS и его хранилища саг; пустой - динамическое членство, партиции переходят при каждом рестарте.
+func NewKafkaConsumer(brokers []string, topic, deadLetterTopic string, sagaManager *workflows.SagaManager, laneCount, laneDepth int, instanceID string) *KafkaConsumer {
+	kc := &KafkaConsumer{
+		topic:           topic,
+		deadLetterTopic: deadLetterTopic,
+		sagaManager:     sagaManager,
+		laneCount:       laneCount,
+		laneDepth:       laneDepth,
+		offsets:         newOffsetTracker(),
+		backlog:         newPartitionBacklog(),
+	}
+	kc.process = kc.processMessage
+
 	opts := []kgo.Opt{
 		kgo.SeedBrokers(brokers...),
 		kgo.ConsumerGroup("order-management"),
 		kgo.ConsumeTopics(topic),
+		kgo.Balancers(kgo.CooperativeStickyBalancer()),
 		kgo.BlockRebalanceOnPoll(),
+		// Коммитятся только offset'ы, отмеченные после обработки (MarkCommitRecords)
+		kgo.AutoCommitMarks(),
+		kgo.OnPartitionsRevoked(kc.onRevoked),
+		kgo.OnPartitionsLost(kc.onLost),
+		kgo.AllowAutoTopicCreation(), // DLQ создается при первой записи
+	}
+	if instanceID != "" {
+		// Статический участник не покидает группу при Close: после рестарта он получает те же партиции
+		opts = append(opts, kgo.InstanceID(instanceID))
+	} else {
+		log.Println("KAFKA_GROUP_INSTANCE_ID не задан: после рестарта партиции могут перейти к другому экземпляру")
 	}
 
 	client, err := kgo.NewClient(opts...)
 	if err != nil {
 		log.Fatalf("Ошибка инициализации Kafka-консьюмера: %v", err)
 	}
+	kc.client = client
 
-	return &KafkaConsumer{
-		client:      client,
-		topic:       topic,
-		sagaManager: sagaManager,
-		workerCount: workerCount,
-	}
+	return kc
 }
 
-// StartListening запускает обработку сообщений
+// StartListening запускает обработку сообщений и возвращается, когда воркеры завершат уже полученные записи
 func (kc *KafkaConsumer) StartListening(ctx context.Context) {
 	log.Println("Topic listening started")
 
-	// Канал для передачи сообщений воркерам
-	recordsChan := make(chan *kgo.Record, kc.workerCount*2) // Небольшой буфер для баланса нагрузки
+	// Записи одного ключа (заказа) всегда попадают в одну полосу и обрабатываются по порядку
+	lanes := newWorkerLanes(kc.laneCount, kc.laneDepth)
 	var wg sync.WaitGroup
 
-	// Запускаем N воркеров
-	for i := 0; i < kc.workerCount; i++ {
+	// Запускаем по воркеру на полосу
+	for i, lane := range lanes.lanes {
 		wg.Add(1)
-		go kc.worker(ctx, recordsChan, &wg)
+		go kc.worker(ctx, i, lane, &wg)
 	}
+	defer func() {
+		lanes.close()
+		wg.Wait()
+		kc.stopped.Store(true)
+	}()
 
-	// Читаем из Kafka и отправляем в канал
+	// Запись регистрируется до передачи воркеру, чтобы watermark учитывал порядок партиции
+	dispatch := func(record *kgo.Record) {
+		kc.offsets.add(record)
+		lanes.dispatch(record)
+	}
+
+	// Читаем из Kafka и раскладываем по полосам
 	for {
-		select {
-		case <-ctx.Done():
-			close(recordsChan)
-			wg.Wait()
+		pollCtx, cancel := ctx, context.CancelFunc(func() {})
+		if !kc.backlog.empty() {
+			// Новых записей может не быть долго, а отложенные ждут места в полосах
+			pollCtx, cancel = context.WithTimeout(ctx, backlogPollInterval)
+		}
+		fetches := kc.client.PollFetches(pollCtx)
+		cancel()
+		if ctx.Err() != nil {
 			return
-		default:
-			fetches := kc.client.PollFetches(ctx)
-			iter := fetches.RecordIter()
-			for !iter.Done() {
-				record := iter.Next()
-				select {
-				case recordsChan <- record: // Отправляем запись в канал
-				case <-ctx.Done():
-					close(recordsChan)
-					wg.Wait()
-					return
-				}
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+			log.Printf("Ошибка чтения топика %s (партиция %d): %v", topic, partition, err)
+		})
+
+		// Сначала отложенные записи: они прочитаны раньше новых
+		if flushed := kc.backlog.flush(lanes, dispatch); len(flushed) > 0 {
+			kc.client.ResumeFetchPartitions(flushed)
+		}
+
+		iter := fetches.RecordIter()
+		for !iter.Done() {
+			record := iter.Next()
+			if !kc.backlog.has(record) && !lanes.full(record) {
+				dispatch(record)
+				continue
+			}
+			// Полоса заполнена: запись откладывается, а партиция приостанавливается до освобождения места,
+			// чтобы не ждать воркера с заблокированной ребалансировкой
+			if kc.backlog.push(record) {
+				kc.client.PauseFetchPartitions(map[string][]int32{record.Topic: {record.Partition}})
 			}
 		}
+
+		// Все полученные записи переданы в полосы или отложены: ребалансировка может отозвать партиции
+		kc.client.AllowRebalance()
 	}
 }
 
-// worker обрабатывает сообщения из Kafka
-func (kc *KafkaConsumer) worker(ctx context.Context, recordsChan <-chan *kgo.Record, wg *sync.WaitGroup) {
+// worker обрабатывает сообщения своей полосы по очереди
+func (kc *KafkaConsumer) worker(ctx context.Context, lane int, queue <-chan laneRecord, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	for record := range recordsChan {
-		func(ctx context.Context) {
+	for item := range queue {
+		record := item.record
+		if ctx.Err() != nil {
+			// Остановка: оставшиеся в очереди записи не коммитятся и будут доставлены повторно
+			continue
+		}
+		queueTime := time.Since(item.enqueuedAt)
+		handled := func(ctx context.Context) bool {
 			links := tracing.ExtractTraceContextFromKafka(ctx, record.Headers)
 			ctx, span := tracing.StartInfrastructure(ctx, "processMessage", tracing.SubLayerBroker, trace.WithLinks(links...))
 			defer span.End()
 
-			if err := kc.processMessage(ctx, record.Value); err != nil {
-				log.Printf("Ошибка обработки заказа: %v", err)
+			// Время в очереди полосы показывает, сколько запись ждала обработки предыдущих записей полосы
+			span.SetAttributes(
+				attribute.Int("messaging.consumer.lane", lane),
+				attribute.Int64("messaging.consumer.lane.queue_time_ms", queueTime.Milliseconds()),
+			)
+			// Сообщение возвращено из DLQ командой replay
+			if attempts := deadLetterAttempts(record.Headers); attempts > 0 {
+				span.SetAttributes(attribute.Int("dlq.attempts", attempts))
+			}
+
+			err := kc.process(ctx, record)
+			if err == nil || errors.Is(err, workflows.ErrSagaCompensated) || errors.Is(err, workflows.ErrSagaStuck) {
+				// Компенсированная сага - штатный отказ заказа, а зависшая уже в saga dead-letter
+				// и ждет перезапуска компенсаций оператором. В DLQ попадают только сообщения,
+				// которые не удалось разобрать или обработать (ошибки хранилища саг и т.п.)
+				return true
+			}
+			log.Printf("Ошибка обработки заказа: %v", err)
+			if err := kc.deadLetterWithRetry(ctx, record, err); err != nil {
+				// Консьюмер остановлен или партиция отозвана: запись доставят повторно
+				span.RecordError(err)
+				log.Printf("Сообщение %s/%d/%d будет обработано повторно: %v", record.Topic, record.Partition, record.Offset, err)
+				return false
 			}
+			return true
 		}(ctx)
+		if !handled {
+			// Offset не коммитится: запись будет доставлена повторно после рестарта или ребалансировки
+			continue
+		}
+
+		// Результат саги (успех, компенсация, зависание) сохранен или запись в DLQ, запись считается обработанной
+		if watermark := kc.offsets.done(record); watermark != nil {
+			kc.client.MarkCommitRecords(watermark)
+		}
+	}
+}
+
+// onRevoked дожидается обработки записей отзываемых партиций и синхронно коммитит их offset'ы,
+// чтобы новый владелец партиции не обработал их повторно
+func (kc *KafkaConsumer) onRevoked(ctx context.Context, client *kgo.Client, revoked map[string][]int32) {
+	if !kc.stopped.Load() {
+		drainCtx, cancel := context.WithTimeout(ctx, revokeDrainTimeout)
+		defer cancel()
+
+		if left := kc.offsets.drain(drainCtx, revoked); left > 0 {
+			log.Printf("Партиции отозваны до обработки %d записей, они будут обработаны повторно", left)
+		}
+	}
+	if err := client.CommitMarkedOffsets(ctx); err != nil {
+		log.Printf("Ошибка коммита offset'ов отзываемых партиций: %v", err)
 	}
+	kc.offsets.forget(revoked)
+	kc.releaseBacklog(client, revoked)
+}
+
+// onLost забывает потерянные партиции: коммитить их уже нельзя, записи обработает новый владелец
+func (kc *KafkaConsumer) onLost(_ context.Context, client *kgo.Client, lost map[string][]int32) {
+	log.Printf("Партиции потеряны: %v", lost)
+	kc.offsets.forget(lost)
+	kc.releaseBacklog(client, lost)
+}
+
+// releaseBacklog забывает отложенные записи партиций, ушедших от консьюмера, и снимает с них паузу:
+// иначе партиция осталась бы приостановленной, если снова достанется этому экземпляру
+func (kc *KafkaConsumer) releaseBacklog(client *kgo.Client, partitions map[string][]int32) {
+	kc.backlog.drop(partitions)
+	client.ResumeFetchPartitions(partitions)
 }
 
-// processMessage отправляет заказ в Temporal
-func (kc *KafkaConsumer) processMessage(ctx context.Context, value []byte) error {
+// processMessage разбирает сообщение о заказе по версии схемы и запускает сагу
+func (kc *KafkaConsumer) processMessage(ctx context.Context, record *kgo.Record) error {
 	ctx, span := tracing.StartInfrastructure(ctx, "processMessage", tracing.SubLayerBroker)
 	defer span.End()
 
-	var order domain.Order
-	if err := json.Unmarshal(value, &order); err != nil {
+	// Сообщения без CloudEvents-атрибутов принимаются от продюсеров, еще не перешедших на конверт
+	event, err := events.FromHeaders(record.Headers)
+	if errors.Is(err, events.ErrNotCloudEvent) {
+		log.Printf("Заказ получен без CloudEvents-заголовков (offset %d)", record.Offset)
+		err = nil
+	} else if err == nil {
+		err = event.Expect(events.TypeOrderCreated)
+	}
+	if err != nil {
 		span.RecordError(err)
-		return err
+		return fmt.Errorf("%w: %w", errPoisonMessage, err)
 	}
+	if event.ID != "" {
+		span.SetAttributes(
+			attribute.String("messaging.event.id", event.ID),
+			attribute.String("messaging.event.type", event.Type),
+			attribute.String("messaging.event.source", event.Source),
+		)
+	}
+
+	msg, version, err := messages.DecodeOrder(record.Headers, record.Value)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("%w: %w", errPoisonMessage, err)
+	}
+	span.SetAttributes(attribute.Int("messaging.schema.version", version))
+	if version != messages.OrderSchemaLatest {
+		log.Printf("Заказ %s получен в схеме версии %d и приведен к версии %d", msg.OrderID, version, messages.OrderSchemaLatest)
+	}
+	order := msg.ToDomain()
 
 	log.Printf("Начинаем обработку заказа %s через Saga", order.ID)
-	err := kc.sagaManager.Execute(ctx, order)
+	err = kc.sagaManager.Execute(ctx, order)
 	if err != nil {
 		span.RecordError(err)
 		log.Printf("Ошибка выполнения Saga для заказа %s: %v", order.ID, err)
@@ -121,6 +292,26 @@ func (kc *KafkaConsumer) processMessage(ctx context.Context, value []byte) error
 	return nil
 }
 
+// Pause приостанавливает чтение заказов; уже полученные записи дообрабатываются
+func (kc *KafkaConsumer) Pause() {
+	kc.client.PauseFetchTopics(kc.topic)
+	log.Printf("Чтение топика %s приостановлено", kc.topic)
+}
+
+// Resume возобновляет чтение заказов
+func (kc *KafkaConsumer) Resume() {
+	kc.client.ResumeFetchTopics(kc.topic)
+	log.Printf("Чтение топика %s возобновлено", kc.topic)
+}
+
+// Paused сообщает, что чтение заказов приостановлено
+func (kc *KafkaConsumer) Paused() bool {
+	return slices.Contains(kc.client.PauseFetchTopics(), kc.topic)
+}
+
+// Close коммитит обработанные offset'ы и покидает группу; вызывается после завершения StartListening
 func (kc *KafkaConsumer) Close() {
+	// Опрос остановлен: без AllowRebalance выход из группы ждал бы разрешения ребалансировки
+	kc.client.AllowRebalance()
 	kc.client.Close()
 }
@@ -0,0 +1,141 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/workflows"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CommandConsumer получает команды по заказам (отмена покупателем, перезапуск саги оператором) из Kafka
+type CommandConsumer struct {
+	client      *kgo.Client
+	topic       string
+	sagaManager *workflows.SagaManager
+}
+
+// NewCommandConsumer создает консьюмера команд.
+// Сага выполняется в памяти того экземпляра, который получил заказ, поэтому consumer group не используется:
+// каждый экземпляр читает все команды с конца топика и обрабатывает те, что относятся к его сагам.
+func NewCommandConsumer(brokers []string, topic string, sagaManager *workflows.SagaManager) (*CommandConsumer, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()),
+		kgo.AllowAutoTopicCreation(),
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания Kafka-клиента: %w", err)
+	}
+
+	return &CommandConsumer{
+		client:      client,
+		topic:       topic,
+		sagaManager: sagaManager,
+	}, nil
+}
+
+// StartListening читает команды, пока не будет отменен контекст
+func (cc *CommandConsumer) StartListening(ctx context.Context) {
+	log.Printf("Начато чтение команд из топика %s", cc.topic)
+
+	for {
+		fetches := cc.client.PollFetches(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			log.Printf("Ошибка чтения топика %s (партиция %d): %v", topic, partition, err)
+		})
+		fetches.EachRecord(func(record *kgo.Record) {
+			if err := cc.processCommand(ctx, record); err != nil {
+				log.Printf("Ошибка обработки команды (offset %d): %v", record.Offset, err)
+			}
+		})
+	}
+}
+
+// processCommand разбирает команду по типу CloudEvents и передает ее в Saga Manager
+func (cc *CommandConsumer) processCommand(ctx context.Context, record *kgo.Record) error {
+	links := tracing.ExtractTraceContextFromKafka(ctx, record.Headers)
+	ctx, span := tracing.StartInfrastructure(ctx, "processCommand", tracing.SubLayerBroker, trace.WithLinks(links...))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("kafka.topic", record.Topic),
+		attribute.Int64("kafka.offset", record.Offset),
+	)
+
+	event, err := events.FromHeaders(record.Headers)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	span.SetAttributes(
+		attribute.String("messaging.event.id", event.ID),
+		attribute.String("messaging.event.type", event.Type),
+		attribute.String("messaging.event.source", event.Source),
+	)
+
+	switch event.Type {
+	case events.TypeOrderCancelRequested:
+		var command domain.CancelOrderCommand
+		if err := json.Unmarshal(record.Value, &command); err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("ошибка разбора команды отмены: %w", err)
+		}
+		span.SetAttributes(attribute.String("order.id", command.OrderID))
+
+		err := cc.sagaManager.Cancel(ctx, command)
+		if errors.Is(err, workflows.ErrCancelRejected) {
+			log.Printf("Отмена заказа %s отклонена: %v", command.OrderID, err)
+			return nil
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		return err
+
+	case events.TypeSagaRedriveRequested:
+		var command workflows.RedriveCommand
+		if err := json.Unmarshal(record.Value, &command); err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("ошибка разбора команды перезапуска саги: %w", err)
+		}
+		span.SetAttributes(attribute.String("order.id", command.OrderID))
+
+		err := cc.sagaManager.Redrive(ctx, command)
+		if errors.Is(err, workflows.ErrSagaNotFound) {
+			// Сага выполнялась на другом экземпляре
+			return nil
+		}
+		if errors.Is(err, workflows.ErrSagaNotStuck) {
+			log.Printf("Перезапуск саги заказа %s отклонен: %v", command.OrderID, err)
+			return nil
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		return err
+	}
+
+	err = fmt.Errorf("%w: unexpected type %q", events.ErrInvalidEvent, event.Type)
+	span.RecordError(err)
+	return err
+}
+
+// Close закрывает Kafka-клиент
+func (cc *CommandConsumer) Close() {
+	cc.client.Close()
+}
@@ -0,0 +1,72 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/messages"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// KafkaPublisher публикует сообщения OMS (шаги саги вида kafka) в Kafka
+type KafkaPublisher struct {
+	client *kgo.Client
+	source string
+}
+
+// NewKafkaPublisher создает продюсера; source - атрибут source событий CloudEvents
+func NewKafkaPublisher(brokers []string, source string) *KafkaPublisher {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.AllowAutoTopicCreation(),
+	)
+	if err != nil {
+		log.Fatalf("Ошибка инициализации Kafka-продюсера: %v", err)
+	}
+
+	return &KafkaPublisher{client: client, source: source}
+}
+
+// Publish синхронно публикует JSON-сообщение с контекстом трассировки.
+// Если задан eventType, сообщение размечается атрибутами CloudEvents.
+func (p *KafkaPublisher) Publish(ctx context.Context, topic, eventType, key string, value []byte) error {
+	ctx, span := tracing.StartInfrastructure(ctx, "Publish", tracing.SubLayerBroker)
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("kafka.topic", topic),
+		attribute.String("kafka.partition_key", key),
+	)
+
+	headers := tracing.InjectTraceContextToKafka(ctx)
+	headers = append(headers, kgo.RecordHeader{Key: messages.HeaderContentType, Value: []byte(messages.ContentTypeJSON)})
+	if eventType != "" {
+		event := events.New(p.source, eventType, key)
+		headers = append(headers, event.Headers()...)
+		span.SetAttributes(
+			attribute.String("messaging.event.id", event.ID),
+			attribute.String("messaging.event.type", event.Type),
+		)
+	}
+
+	record := &kgo.Record{
+		Topic:   topic,
+		Key:     []byte(key),
+		Value:   value,
+		Headers: headers,
+	}
+	if err := p.client.ProduceSync(ctx, record).FirstErr(); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка публикации в топик %s: %w", topic, err)
+	}
+	return nil
+}
+
+// Close закрывает Kafka-клиент
+func (p *KafkaPublisher) Close() {
+	p.client.Close()
+}
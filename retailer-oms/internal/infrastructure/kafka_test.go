@@ -0,0 +1,275 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	testOrdersTopic = "orders"
+	testDLQTopic    = "orders-dlq"
+	testGroup       = "order-management"
+)
+
+// newTestCluster запускает Kafka в памяти процесса с топиком заказов из partitions партиций
+func newTestCluster(t *testing.T, partitions int32) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(partitions, testOrdersTopic))
+	if err != nil {
+		t.Fatalf("kfake: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+// produce записывает записи с ключами keys в партицию partition топика заказов
+func produce(t *testing.T, cluster *kfake.Cluster, partition int32, keys ...string) {
+	t.Helper()
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.RecordPartitioner(kgo.ManualPartitioner()),
+	)
+	if err != nil {
+		t.Fatalf("kgo: %v", err)
+	}
+	defer client.Close()
+
+	records := make([]*kgo.Record, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, &kgo.Record{Topic: testOrdersTopic, Partition: partition, Key: []byte(key), Value: []byte("{}")})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		t.Fatalf("ProduceSync: %v", err)
+	}
+}
+
+// testHandler подменяет обработку записи: запись с ключом из blocked ждет release, остальные завершаются сразу
+type testHandler struct {
+	mu      sync.Mutex
+	started map[string]chan struct{}
+	release map[string]chan struct{}
+	handled atomic.Int32
+}
+
+func newTestHandler(blocked ...string) *testHandler {
+	h := &testHandler{started: make(map[string]chan struct{}), release: make(map[string]chan struct{})}
+	for _, key := range blocked {
+		h.started[key] = make(chan struct{})
+		h.release[key] = make(chan struct{})
+	}
+	return h
+}
+
+func (h *testHandler) process(ctx context.Context, record *kgo.Record) error {
+	h.mu.Lock()
+	started, release := h.started[string(record.Key)], h.release[string(record.Key)]
+	h.mu.Unlock()
+	if started != nil {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	h.handled.Add(1)
+	return nil
+}
+
+// waitStarted ждет, пока воркер возьмет в обработку запись с ключом key
+func (h *testHandler) waitStarted(t *testing.T, key string) {
+	t.Helper()
+	select {
+	case <-h.started[key]:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("запись %s не взята в обработку", key)
+	}
+}
+
+// startTestConsumer запускает консьюмер заказов с обработкой handler и останавливает его в конце теста
+func startTestConsumer(t *testing.T, cluster *kfake.Cluster, handler *testHandler, laneCount, laneDepth int) *KafkaConsumer {
+	t.Helper()
+	kc := NewKafkaConsumer(cluster.ListenAddrs(), testOrdersTopic, testDLQTopic, nil, laneCount, laneDepth, "")
+	kc.process = handler.process
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		kc.StartListening(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		kc.Close()
+	})
+	return kc
+}
+
+// waitFor повторяет проверку, пока она не выполнится
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("не дождались: %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// markedOffset возвращает offset партиции, отмеченный к коммиту или уже закоммиченный автокоммитом; -1 - отметок нет
+func markedOffset(t *testing.T, kc *KafkaConsumer, partition int32) int64 {
+	t.Helper()
+	if offset, ok := kc.client.MarkedOffsets()[testOrdersTopic][partition]; ok {
+		return offset.Offset
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	committed, err := kadm.NewClient(kc.client).FetchOffsets(ctx, testGroup)
+	if err != nil {
+		t.Fatalf("FetchOffsets: %v", err)
+	}
+	if offset, ok := committed.Lookup(testOrdersTopic, partition); ok && offset.Err == nil {
+		return offset.At
+	}
+	return -1
+}
+
+// paused сообщает, что чтение партиции приостановлено
+func paused(kc *KafkaConsumer, partition int32) bool {
+	for _, p := range kc.client.PauseFetchPartitions(nil)[testOrdersTopic] {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
+func TestKafkaConsumerMarksWatermarkAfterOutOfOrderCompletion(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	// Ключи в разных полосах: a-0 ждет, следующие за ним записи завершаются раньше
+	produce(t, cluster, 0, "a-0", "b-1", "c-2")
+
+	handler := newTestHandler("a-0")
+	kc := startTestConsumer(t, cluster, handler, 64, 2)
+
+	handler.waitStarted(t, "a-0")
+	waitFor(t, "обработка записей после первой", func() bool { return handler.handled.Load() == 2 })
+	// Отметка к коммиту делается после обработки, даем воркерам ее выполнить
+	time.Sleep(200 * time.Millisecond)
+	if offset := markedOffset(t, kc, 0); offset != -1 {
+		t.Fatalf("отмечен offset %d, хотя первая запись не обработана", offset)
+	}
+
+	close(handler.release["a-0"])
+	waitFor(t, "watermark после первой записи", func() bool { return markedOffset(t, kc, 0) == 3 })
+}
+
+func TestKafkaConsumerPausesPartitionWithFullLane(t *testing.T) {
+	cluster := newTestCluster(t, 1)
+	// Одна полоса глубиной 1: o-0 у воркера, o-1 в очереди, остальные откладываются
+	produce(t, cluster, 0, "o-0", "o-1", "o-2", "o-3")
+
+	handler := newTestHandler("o-0")
+	kc := startTestConsumer(t, cluster, handler, 1, 1)
+
+	handler.waitStarted(t, "o-0")
+	waitFor(t, "пауза партиции с заполненной полосой", func() bool { return paused(kc, 0) })
+	if kc.backlog.empty() {
+		t.Fatal("записи не отложены")
+	}
+
+	close(handler.release["o-0"])
+	waitFor(t, "обработка отложенных записей", func() bool { return handler.handled.Load() == 4 })
+	waitFor(t, "возобновление партиции", func() bool { return !paused(kc, 0) })
+	waitFor(t, "watermark", func() bool { return markedOffset(t, kc, 0) == 4 })
+}
+
+func TestKafkaConsumerDrainsRevokedPartition(t *testing.T) {
+	cluster := newTestCluster(t, 2)
+	produce(t, cluster, 0, "p0-0")
+	produce(t, cluster, 1, "p1-0")
+
+	handler := newTestHandler("p0-0", "p1-0")
+	startTestConsumer(t, cluster, handler, 8, 2)
+	handler.waitStarted(t, "p0-0")
+	handler.waitStarted(t, "p1-0")
+
+	// Второй участник группы забирает одну из партиций; отзыв ждет обработки ее записи
+	var assigned atomic.Bool
+	revoked := make(chan int32, 2)
+	other, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumerGroup(testGroup),
+		kgo.ConsumeTopics(testOrdersTopic),
+		kgo.Balancers(kgo.CooperativeStickyBalancer()),
+		kgo.OnPartitionsAssigned(func(_ context.Context, _ *kgo.Client, assignment map[string][]int32) {
+			for _, p := range assignment[testOrdersTopic] {
+				revoked <- p
+				assigned.Store(true)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("kgo: %v", err)
+	}
+	defer other.Close()
+
+	var received atomic.Int32
+	pollCtx, stopPoll := context.WithCancel(context.Background())
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for pollCtx.Err() == nil {
+			received.Add(int32(other.PollFetches(pollCtx).NumRecords()))
+		}
+	}()
+	defer func() {
+		stopPoll()
+		<-polled
+	}()
+
+	// Группа узнает о новом участнике с heartbeat'ом первого; пока тот ждет обработки записей, ребалансировка не завершается
+	adm := kadm.NewClient(other)
+	waitFor(t, "начало ребалансировки", func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		groups, err := adm.DescribeGroups(ctx, testGroup)
+		return err == nil && groups[testGroup].State != "Stable"
+	})
+	time.Sleep(time.Second)
+	if assigned.Load() {
+		t.Fatal("партиция передана до обработки ее записей")
+	}
+	close(handler.release["p0-0"])
+	close(handler.release["p1-0"])
+
+	waitFor(t, "передача партиции второму участнику", assigned.Load)
+	// Новый владелец не получает повторно записи, обработанные до отзыва
+	time.Sleep(500 * time.Millisecond)
+	if n := received.Load(); n != 0 {
+		t.Fatalf("новый владелец получил повторно %d записей", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	committed, err := adm.FetchOffsets(ctx, testGroup)
+	if err != nil {
+		t.Fatalf("FetchOffsets: %v", err)
+	}
+	// Отзываемая партиция коммитится синхронно в onRevoked, не дожидаясь автокоммита
+	partition := <-revoked
+	if offset, ok := committed.Lookup(testOrdersTopic, partition); !ok || offset.At != 1 {
+		t.Errorf("партиция %d: закоммичен offset %+v, ожидался 1", partition, offset)
+	}
+}
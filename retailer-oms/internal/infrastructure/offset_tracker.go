@@ -0,0 +1,133 @@
+package infrastructure
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// drainPollInterval - как часто проверяется, обработаны ли записи отзываемых партиций
+const drainPollInterval = 50 * time.Millisecond
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionQueue - записи партиции в порядке получения, еще не вошедшие в коммит
+type partitionQueue struct {
+	records []*kgo.Record
+	pending map[*kgo.Record]bool // true - запись обработана, но перед ней есть необработанные
+}
+
+// offsetTracker ведет commit watermark по партициям: записи обрабатываются параллельно и завершаются
+// в произвольном порядке, а коммитить можно только offset, до которого обработаны все записи партиции
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[topicPartition]*partitionQueue
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[topicPartition]*partitionQueue)}
+}
+
+// add регистрирует полученную запись; вызывается в порядке чтения партиции
+func (t *offsetTracker) add(record *kgo.Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tp := topicPartition{record.Topic, record.Partition}
+	q := t.partitions[tp]
+	if q == nil {
+		q = &partitionQueue{pending: make(map[*kgo.Record]bool)}
+		t.partitions[tp] = q
+	}
+	q.records = append(q.records, record)
+	q.pending[record] = false
+}
+
+// done отмечает запись обработанной и возвращает последнюю запись непрерывно обработанного префикса
+// партиции, которую можно отметить к коммиту; nil - watermark не сдвинулся.
+// Запись отозванной партиции игнорируется: ее повторно обработает новый владелец.
+func (t *offsetTracker) done(record *kgo.Record) *kgo.Record {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	q := t.partitions[topicPartition{record.Topic, record.Partition}]
+	if q == nil {
+		return nil
+	}
+	if _, ok := q.pending[record]; !ok {
+		return nil
+	}
+	q.pending[record] = true
+
+	var watermark *kgo.Record
+	for len(q.records) > 0 && q.pending[q.records[0]] {
+		watermark = q.records[0]
+		delete(q.pending, watermark)
+		q.records = q.records[1:]
+	}
+	return watermark
+}
+
+// tracked сообщает, что запись еще не обработана и ее партиция принадлежит консьюмеру
+func (t *offsetTracker) tracked(record *kgo.Record) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	q := t.partitions[topicPartition{record.Topic, record.Partition}]
+	if q == nil {
+		return false
+	}
+	_, ok := q.pending[record]
+	return ok
+}
+
+// inFlight возвращает число необработанных записей указанных партиций
+func (t *offsetTracker) inFlight(partitions map[string][]int32) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			if q := t.partitions[topicPartition{topic, p}]; q != nil {
+				n += len(q.records)
+			}
+		}
+	}
+	return n
+}
+
+// drain ждет обработки записей отзываемых партиций, пока не истечет ctx; возвращает число необработанных
+func (t *offsetTracker) drain(ctx context.Context, partitions map[string][]int32) int {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		n := t.inFlight(partitions)
+		if n == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return n
+		case <-ticker.C:
+		}
+	}
+}
+
+// forget удаляет партиции, которые больше не принадлежат консьюмеру
+func (t *offsetTracker) forget(partitions map[string][]int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			delete(t.partitions, topicPartition{topic, p})
+		}
+	}
+}
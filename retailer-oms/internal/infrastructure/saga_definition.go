@@ -0,0 +1,32 @@
+package infrastructure
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/workflows"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadSagaDefinition читает описание саги из YAML-файла; проверяет описание workflows.NewSagaManager.
+// В адресах сервисов подставляются переменные окружения, чтобы один файл подходил для всех окружений.
+func LoadSagaDefinition(path string) (*workflows.SagaDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения описания саги %s: %w", path, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true) // Опечатка в имени поля не должна молча отключать настройку шага
+
+	var definition workflows.SagaDefinition
+	if err := decoder.Decode(&definition); err != nil {
+		return nil, fmt.Errorf("ошибка разбора описания саги %s: %w", path, err)
+	}
+
+	for name, addr := range definition.Services {
+		definition.Services[name] = os.ExpandEnv(addr)
+	}
+	return &definition, nil
+}
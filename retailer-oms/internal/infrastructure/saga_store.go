@@ -0,0 +1,204 @@
+package infrastructure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"github.com/Vasiliy82/ArchiScoper/retailer-oms/internal/workflows"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var sagaStateBucket = []byte("saga_state")
+
+// SagaStore хранит состояние саг в bbolt: ключ - id заказа, значение - JSON workflows.SagaState
+type SagaStore struct {
+	db        *bolt.DB
+	retention time.Duration
+}
+
+// OpenSagaStore открывает (или создает) файл хранилища саг.
+// Завершенные саги хранятся retention, незавершенные - пока не будут завершены.
+func OpenSagaStore(path string, retention time.Duration) (*SagaStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия хранилища саг %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sagaStateBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ошибка инициализации хранилища саг: %w", err)
+	}
+
+	return &SagaStore{db: db, retention: retention}, nil
+}
+
+// Save сохраняет состояние саги. Batch объединяет записи одновременно выполняющихся саг в одну транзакцию.
+func (s *SagaStore) Save(ctx context.Context, state workflows.SagaState) error {
+	_, span := tracing.StartInfrastructure(ctx, "SaveSagaState", tracing.SubLayerFilesystem)
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", state.OrderID),
+		attribute.String("saga.status", string(state.Status)),
+		attribute.String("saga.step", state.Step),
+	)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка сериализации состояния саги %s: %w", state.OrderID, err)
+	}
+
+	err = s.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(sagaStateBucket).Put([]byte(state.OrderID), data)
+	})
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("ошибка сохранения состояния саги %s: %w", state.OrderID, err)
+	}
+	return nil
+}
+
+// Load возвращает состояние саги заказа; false, если сага не найдена
+func (s *SagaStore) Load(ctx context.Context, orderID string) (workflows.SagaState, bool, error) {
+	_, span := tracing.StartInfrastructure(ctx, "LoadSagaState", tracing.SubLayerFilesystem)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("order.id", orderID))
+
+	var (
+		state workflows.SagaState
+		found bool
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(sagaStateBucket).Get([]byte(orderID))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &state)
+	})
+	if err != nil {
+		span.RecordError(err)
+		return workflows.SagaState{}, false, fmt.Errorf("ошибка чтения состояния саги %s: %w", orderID, err)
+	}
+	span.SetAttributes(attribute.Bool("saga.found", found))
+	return state, found, nil
+}
+
+// Unfinished возвращает саги, которые не были завершены
+func (s *SagaStore) Unfinished(ctx context.Context) ([]workflows.SagaState, error) {
+	_, span := tracing.StartInfrastructure(ctx, "ListUnfinishedSagas", tracing.SubLayerFilesystem)
+	defer span.End()
+
+	var states []workflows.SagaState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sagaStateBucket).ForEach(func(_, data []byte) error {
+			var state workflows.SagaState
+			if err := json.Unmarshal(data, &state); err != nil {
+				return err
+			}
+			if !state.Status.IsFinished() {
+				states = append(states, state)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("ошибка чтения хранилища саг: %w", err)
+	}
+	span.SetAttributes(attribute.Int("saga.unfinished", len(states)))
+	return states, nil
+}
+
+// List возвращает все сохраненные саги: выполняющиеся и завершенные в пределах срока хранения
+func (s *SagaStore) List(ctx context.Context) ([]workflows.SagaState, error) {
+	_, span := tracing.StartInfrastructure(ctx, "ListSagas", tracing.SubLayerFilesystem)
+	defer span.End()
+
+	var states []workflows.SagaState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sagaStateBucket).ForEach(func(_, data []byte) error {
+			var state workflows.SagaState
+			if err := json.Unmarshal(data, &state); err != nil {
+				return err
+			}
+			states = append(states, state)
+			return nil
+		})
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("ошибка чтения хранилища саг: %w", err)
+	}
+	span.SetAttributes(attribute.Int("saga.count", len(states)))
+	return states, nil
+}
+
+// Run периодически удаляет завершенные саги старше retention, пока не будет отменен контекст
+func (s *SagaStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			removed, err := s.purge(now.Add(-s.retention))
+			if err != nil {
+				log.Printf("Ошибка очистки хранилища саг: %v", err)
+			} else if removed > 0 {
+				log.Printf("Из хранилища удалено %d завершенных саг", removed)
+			}
+		}
+	}
+}
+
+// purge удаляет саги, завершенные до before
+func (s *SagaStore) purge(before time.Time) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sagaStateBucket)
+
+		// Ключи собираются заранее: удаление во время обхода курсором пропускает записи
+		var expired [][]byte
+		err := bucket.ForEach(func(k, data []byte) error {
+			var state workflows.SagaState
+			if err := json.Unmarshal(data, &state); err != nil {
+				return err
+			}
+			if state.Status.IsFinished() && state.UpdatedAt.Before(before) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return removed, err
+}
+
+// Close закрывает файл хранилища
+func (s *SagaStore) Close() error {
+	return s.db.Close()
+}
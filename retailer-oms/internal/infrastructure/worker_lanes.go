@@ -0,0 +1,144 @@
+package infrastructure
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// laneRecord - запись в очереди полосы и момент ее постановки в очередь
+type laneRecord struct {
+	record     *kgo.Record
+	enqueuedAt time.Time
+}
+
+// workerLanes распределяет записи по фиксированным полосам по хешу ключа: у каждой полосы один воркер,
+// поэтому сообщения одного заказа обрабатываются строго по очереди, а разные заказы - параллельно
+type workerLanes struct {
+	lanes []chan laneRecord
+}
+
+func newWorkerLanes(count, depth int) *workerLanes {
+	if count < 1 {
+		count = 1
+	}
+	if depth < 1 {
+		// Полоса без буфера всегда заполнена: записи в нее не передать без ожидания воркера
+		depth = 1
+	}
+	l := &workerLanes{lanes: make([]chan laneRecord, count)}
+	for i := range l.lanes {
+		l.lanes[i] = make(chan laneRecord, depth)
+	}
+	return l
+}
+
+// lane возвращает номер полосы записи. Записи без ключа распределяются по партиции,
+// чтобы сохранить хотя бы порядок партиции.
+func (l *workerLanes) lane(record *kgo.Record) int {
+	h := fnv.New32a()
+	if len(record.Key) > 0 {
+		h.Write(record.Key)
+	} else {
+		h.Write([]byte(record.Topic))
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(record.Partition)))
+	}
+	return int(h.Sum32() % uint32(len(l.lanes)))
+}
+
+// full сообщает, что очередь полосы записи заполнена и запись в нее сейчас не поместится.
+// Записи в очереди ставит только цикл опроса, поэтому после false постановка не блокируется.
+func (l *workerLanes) full(record *kgo.Record) bool {
+	lane := l.lanes[l.lane(record)]
+	return len(lane) >= cap(lane)
+}
+
+// dispatch ставит запись в очередь ее полосы; перед вызовом проверяется full
+func (l *workerLanes) dispatch(record *kgo.Record) {
+	l.lanes[l.lane(record)] <- laneRecord{record: record, enqueuedAt: time.Now()}
+}
+
+// close закрывает очереди полос; воркеры завершаются, разобрав свои очереди
+func (l *workerLanes) close() {
+	for _, lane := range l.lanes {
+		close(lane)
+	}
+}
+
+// partitionBacklog - записи, которые не поместились в заполненные полосы, по партициям в порядке чтения.
+// Партиция с отложенными записями приостанавливается, и цикл опроса не ждет освобождения полосы:
+// иначе он не вызывал бы AllowRebalance, и долгие саги одной полосы задерживали бы ребалансировку группы.
+type partitionBacklog struct {
+	mu         sync.Mutex
+	partitions map[topicPartition][]*kgo.Record
+}
+
+func newPartitionBacklog() *partitionBacklog {
+	return &partitionBacklog{partitions: make(map[topicPartition][]*kgo.Record)}
+}
+
+// push откладывает запись; возвращает true, если партиция до этого не была отложена
+func (b *partitionBacklog) push(record *kgo.Record) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tp := topicPartition{record.Topic, record.Partition}
+	_, parked := b.partitions[tp]
+	b.partitions[tp] = append(b.partitions[tp], record)
+	return !parked
+}
+
+// has сообщает, что у партиции записи есть отложенные записи: новые записи партиции встают за ними
+func (b *partitionBacklog) has(record *kgo.Record) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.partitions[topicPartition{record.Topic, record.Partition}]
+	return ok
+}
+
+// empty сообщает, что отложенных записей нет
+func (b *partitionBacklog) empty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.partitions) == 0
+}
+
+// flush передает в полосы отложенные записи, пока их полосы не заполнены; порядок партиции сохраняется.
+// Возвращает партиции, все записи которых переданы: их чтение можно возобновить.
+func (b *partitionBacklog) flush(lanes *workerLanes, dispatch func(*kgo.Record)) map[string][]int32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	flushed := make(map[string][]int32)
+	for tp, records := range b.partitions {
+		for len(records) > 0 && !lanes.full(records[0]) {
+			dispatch(records[0])
+			records = records[1:]
+		}
+		if len(records) > 0 {
+			b.partitions[tp] = records
+			continue
+		}
+		delete(b.partitions, tp)
+		flushed[tp.topic] = append(flushed[tp.topic], tp.partition)
+	}
+	return flushed
+}
+
+// drop забывает отложенные записи партиций, которые больше не принадлежат консьюмеру;
+// записи не регистрировались в offsetTracker, их прочитает новый владелец
+func (b *partitionBacklog) drop(partitions map[string][]int32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			delete(b.partitions, topicPartition{topic, p})
+		}
+	}
+}
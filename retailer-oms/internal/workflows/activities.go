@@ -5,9 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
 	"go.opentelemetry.io/otel"
@@ -17,47 +17,100 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
-// httpPost делает HTTP-запрос
-func httpPost(ctx context.Context, serviceURL string, requestData interface{}) error {
+// maxOutputSize ограничивает размер ответа сервиса, сохраняемого как результат шага
+const maxOutputSize = 64 << 10
+
+// activity - действие шага саги или его компенсации
+type activity func(ctx context.Context, sagaCtx *SagaContextData) error
+
+// StepPublisher публикует сообщения шагов саги вида kafka
+type StepPublisher interface {
+	Publish(ctx context.Context, topic, eventType, key string, value []byte) error
+}
+
+// localActivities - обработчики шагов вида local по имени шага
+var localActivities = map[string]activity{
+	"AcceptOrder":   AcceptOrder,
+	"CompleteOrder": CompleteOrder,
+	"CancelOrder":   CancelOrder,
+}
+
+// httpClient - общий клиент вызовов сервисов: соединения переиспользуются между шагами и сагами.
+// Время запроса ограничивает контекст шага (timeout попытки и срок саги), а не сам клиент.
+var httpClient = newHTTPClient()
+
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 100
+	return &http.Client{Transport: transport}
+}
+
+// httpCall делает HTTP-запрос и возвращает тело успешного ответа
+func httpCall(ctx context.Context, method, serviceURL string, requestData interface{}) (json.RawMessage, error) {
 	// Сериализуем тело запроса
 	jsonData, err := json.Marshal(requestData)
 	if err != nil {
-		return fmt.Errorf("ошибка сериализации JSON: %w", err)
+		return nil, fmt.Errorf("ошибка сериализации JSON: %w", err)
 	}
 
 	// Выполняем HTTP-запрос
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, serviceURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, method, serviceURL, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("ошибка создания HTTP-запроса: %w", err)
+		return nil, fmt.Errorf("ошибка создания HTTP-запроса: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	// Добавляем заголовки трассировки
 	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("ошибка выполнения запроса в %s: %w", serviceURL, err)
+		return nil, fmt.Errorf("%w: ошибка выполнения запроса в %s: %w", ErrNetwork, serviceURL, err)
 	}
 	defer resp.Body.Close()
 
-	// Проверяем код ответа
+	// Проверяем код ответа; тело дочитывается, чтобы соединение вернулось в пул
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("ошибка ответа %d от %s", resp.StatusCode, serviceURL)
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxOutputSize))
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, URL: serviceURL}
 	}
 
-	return nil
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOutputSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: ошибка чтения ответа от %s: %w", ErrNetwork, serviceURL, err)
+	}
+	// Ответ сохраняется в состоянии саги как JSON; не-JSON ответ сохраняется строкой
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	return body, nil
 }
 
-// linksFromSagaContext создает trace.Link для связи с предыдущим шагом
+// linksFromSagaContext создает trace.Link для связи с предыдущим шагом.
+// Повторная попытка шага связывается с предыдущей попыткой связью retry,
+// ветка группы параллельных шагов - со спаном разветвления связью fork.
 func linksFromSagaContext(sagaCtx *SagaContextData) []trace.Link {
+	if sagaCtx.attempt > 1 && sagaCtx.LastSpanContext.IsValid() {
+		return []trace.Link{
+			{
+				SpanContext: sagaCtx.LastSpanContext,
+				Attributes: []attribute.KeyValue{
+					attribute.String("link.type", "retry"),
+					attribute.Int("retry.attempt", sagaCtx.attempt),
+				},
+			},
+		}
+	}
 	if sagaCtx.LastSpanContext.IsValid() {
+		linkType := "saga"
+		if sagaCtx.forked {
+			linkType = "fork"
+		}
 		return []trace.Link{
 			{
 				SpanContext: sagaCtx.LastSpanContext,
 				Attributes: []attribute.KeyValue{
-					attribute.String("link.type", "saga"), // Kafka - асинхронная связь
+					attribute.String("link.type", linkType),
 				},
 			},
 		}
@@ -65,79 +118,99 @@ func linksFromSagaContext(sagaCtx *SagaContextData) []trace.Link {
 	return nil
 }
 
-// **Функции активностей**
-
-// Принятие заказа (локальная логика)
-func AcceptOrder(ctx context.Context, sagaCtx *SagaContextData) error {
-	_, span := tracing.StartApplication(ctx, "AcceptOrder", trace.WithLinks(linksFromSagaContext(sagaCtx)...))
-	defer span.End()
-
-	// Сохраняем ссылку на последний шаг
-	sagaCtx.LastSpanContext = span.SpanContext()
-
-	log.Printf("Заказ %s принят", sagaCtx.Order.ID)
-	span.SetStatus(codes.Ok, "успешно")
-	return nil
+// setAttemptAttributes отмечает в спане номер повторной попытки шага
+func setAttemptAttributes(span trace.Span, sagaCtx *SagaContextData) {
+	if sagaCtx.attempt > 1 {
+		span.SetAttributes(attribute.Int("retry.attempt", sagaCtx.attempt))
+	}
 }
 
-// Сборка заказа (вызов удаленного сервиса)
-func AssembleOrder(ctx context.Context, sagaCtx *SagaContextData) error {
-
-	ctx, span := tracing.StartIntegration(ctx, "AssembleOrder", tracing.SubLayerHTTP, trace.WithLinks(linksFromSagaContext(sagaCtx)...))
-	defer span.End()
+// recordStepError записывает ошибку шага: error.type разделяет постоянные ошибки и те, что можно повторить
+func recordStepError(span trace.Span, action ActionDefinition, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.SetAttributes(
+		attribute.String("error.type", errorType(err)),
+		attribute.Bool("retry.retryable", action.Retry.retryable(err)),
+	)
+}
 
-	sagaCtx.LastSpanContext = span.SpanContext()
+// httpActivity создает действие шага вида http: заказ отправляется в сервис через его circuit breaker и bulkhead,
+// ответ сохраняется как результат шага; compensation - действие компенсирует шаг
+func httpActivity(action ActionDefinition, serviceAddr string, guard *serviceGuard, compensation bool) activity {
+	serviceURL := fmt.Sprintf("http://%s%s", serviceAddr, action.Path)
+
+	return func(ctx context.Context, sagaCtx *SagaContextData) error {
+		ctx, span := tracing.StartIntegration(ctx, action.Name, tracing.SubLayerHTTP, trace.WithLinks(linksFromSagaContext(sagaCtx)...))
+		defer span.End()
+
+		sagaCtx.LastSpanContext = span.SpanContext()
+
+		span.SetAttributes(
+			attribute.String("peer.service", action.Service),
+			attribute.String("http.method", action.Method),
+			attribute.String("http.url", serviceURL),
+		)
+		setAttemptAttributes(span, sagaCtx)
+
+		output, err := guard.call(ctx, compensation, func(ctx context.Context) (json.RawMessage, error) {
+			sagaCtx.called = true
+			return httpCall(ctx, action.Method, serviceURL, sagaCtx.Order)
+		})
+		if err != nil {
+			recordStepError(span, action, err)
+			return err
+		}
+		sagaCtx.Outputs[action.Name] = output
 
-	serviceURL := fmt.Sprintf("http://%s/assembly", sagaCtx.ServicesConfig.SvcAssembly)
-	err := httpPost(ctx, serviceURL, sagaCtx.Order)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return err
+		span.SetStatus(codes.Ok, "успешно")
+		log.Printf("Шаг %s успешно выполнен для заказа %s", action.Name, sagaCtx.Order.ID)
+		return nil
 	}
-
-	span.SetStatus(codes.Ok, "успешно")
-	log.Printf("Шаг AssembleOrder успешно выполнен для заказа %s", sagaCtx.Order.ID)
-	return nil
 }
 
-// Оплата заказа (вызов удаленного сервиса)
-func PayOrder(ctx context.Context, sagaCtx *SagaContextData) error {
-	ctx, span := tracing.StartIntegration(ctx, "PayOrder", tracing.SubLayerHTTP, trace.WithLinks(linksFromSagaContext(sagaCtx)...))
-	defer span.End()
+// kafkaActivity создает действие шага вида kafka: заказ публикуется в топик с ключом - id заказа
+func kafkaActivity(action ActionDefinition, publisher StepPublisher) activity {
+	return func(ctx context.Context, sagaCtx *SagaContextData) error {
+		ctx, span := tracing.StartApplication(ctx, action.Name, trace.WithLinks(linksFromSagaContext(sagaCtx)...))
+		defer span.End()
 
-	sagaCtx.LastSpanContext = span.SpanContext()
+		sagaCtx.LastSpanContext = span.SpanContext()
 
-	serviceURL := fmt.Sprintf("http://%s/payment", sagaCtx.ServicesConfig.SvcPayment)
-	err := httpPost(ctx, serviceURL, sagaCtx.Order)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return err
-	}
+		span.SetAttributes(attribute.String("kafka.topic", action.Topic))
+		setAttemptAttributes(span, sagaCtx)
 
-	span.SetStatus(codes.Ok, "успешно")
-	log.Printf("Шаг PayOrder успешно выполнен для заказа %s", sagaCtx.Order.ID)
-	return nil
+		data, err := json.Marshal(sagaCtx.Order)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("ошибка сериализации заказа %s: %w", sagaCtx.Order.ID, err)
+		}
+		if err := publisher.Publish(ctx, action.Topic, action.Event, sagaCtx.Order.ID, data); err != nil {
+			// Ошибка публикации считается временной: брокер недоступен или идут перевыборы лидера
+			err = fmt.Errorf("%w: %w", ErrNetwork, err)
+			recordStepError(span, action, err)
+			return err
+		}
+
+		span.SetStatus(codes.Ok, "успешно")
+		log.Printf("Шаг %s успешно выполнен для заказа %s", action.Name, sagaCtx.Order.ID)
+		return nil
+	}
 }
 
-// Доставка заказа (вызов удаленного сервиса)
-func ShipOrder(ctx context.Context, sagaCtx *SagaContextData) error {
-	ctx, span := tracing.StartIntegration(ctx, "ShipOrder", tracing.SubLayerHTTP, trace.WithLinks(linksFromSagaContext(sagaCtx)...))
+// **Функции активностей**
+
+// Принятие заказа (локальная логика)
+func AcceptOrder(ctx context.Context, sagaCtx *SagaContextData) error {
+	_, span := tracing.StartApplication(ctx, "AcceptOrder", trace.WithLinks(linksFromSagaContext(sagaCtx)...))
 	defer span.End()
 
+	// Сохраняем ссылку на последний шаг
 	sagaCtx.LastSpanContext = span.SpanContext()
 
-	serviceURL := fmt.Sprintf("http://%s/delivery", sagaCtx.ServicesConfig.SvcDelivery)
-	err := httpPost(ctx, serviceURL, sagaCtx.Order)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return err
-	}
-
+	log.Printf("Заказ %s принят", sagaCtx.Order.ID)
 	span.SetStatus(codes.Ok, "успешно")
-	log.Printf("Шаг ShipOrder успешно выполнен для заказа %s", sagaCtx.Order.ID)
 	return nil
 }
 
@@ -166,63 +239,3 @@ func CancelOrder(ctx context.Context, sagaCtx *SagaContextData) error {
 	span.SetStatus(codes.Ok, "успешно")
 	return nil
 }
-
-// Возврат товара на склад (вызов Assembly Service)
-func ReturnToStock(ctx context.Context, sagaCtx *SagaContextData) error {
-	ctx, span := tracing.StartIntegration(ctx, "ReturnToStock", tracing.SubLayerHTTP, trace.WithLinks(linksFromSagaContext(sagaCtx)...))
-	defer span.End()
-
-	sagaCtx.LastSpanContext = span.SpanContext()
-
-	serviceURL := fmt.Sprintf("http://%s/cancel-assembly", sagaCtx.ServicesConfig.SvcAssembly)
-	err := httpPost(ctx, serviceURL, sagaCtx.Order)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return err
-	}
-
-	span.SetStatus(codes.Ok, "успешно")
-	log.Printf("Товары заказа %s возвращены на склад", sagaCtx.Order.ID)
-	return nil
-}
-
-// Возврат денег клиенту (вызов Refund Service)
-func RefundPayment(ctx context.Context, sagaCtx *SagaContextData) error {
-	ctx, span := tracing.StartIntegration(ctx, "RefundPayment", tracing.SubLayerHTTP, trace.WithLinks(linksFromSagaContext(sagaCtx)...))
-	defer span.End()
-
-	sagaCtx.LastSpanContext = span.SpanContext()
-
-	serviceURL := fmt.Sprintf("http://%s/cancel-payment", sagaCtx.ServicesConfig.SvcPayment)
-	err := httpPost(ctx, serviceURL, sagaCtx.Order)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return err
-	}
-
-	span.SetStatus(codes.Ok, "успешно")
-	log.Printf("Деньги за заказ %s возвращены клиенту", sagaCtx.Order.ID)
-	return nil
-}
-
-// Возврат заказа на склад (вызов Refund Service)
-func ReturnToWarehouse(ctx context.Context, sagaCtx *SagaContextData) error {
-	ctx, span := tracing.StartIntegration(ctx, "ReturnToWarehouse", tracing.SubLayerHTTP, trace.WithLinks(linksFromSagaContext(sagaCtx)...))
-	defer span.End()
-
-	sagaCtx.LastSpanContext = span.SpanContext()
-
-	serviceURL := fmt.Sprintf("http://%s/cancel-delivery", sagaCtx.ServicesConfig.SvcDelivery)
-	err := httpPost(ctx, serviceURL, sagaCtx.Order)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return err
-	}
-
-	span.SetStatus(codes.Ok, "успешно")
-	log.Printf("Заказ %s возвращен на склад", sagaCtx.Order.ID)
-	return nil
-}
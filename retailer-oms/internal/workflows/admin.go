@@ -0,0 +1,188 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrStepNotRetryable - вручную повторить можно только невыполненную компенсацию зависшей саги
+	ErrStepNotRetryable = errors.New("step is not retryable")
+	// ErrSagaBusy - сага заказа сейчас выполняется на этом экземпляре
+	ErrSagaBusy = errors.New("saga is running")
+)
+
+// TraceID возвращает trace id последнего спана саги
+func (s SagaState) TraceID() string {
+	if last := decodeSpanContext(s.LastSpanContext); last.IsValid() {
+		return last.TraceID().String()
+	}
+	return ""
+}
+
+// Sagas возвращает саги из хранилища, новые первыми; status ограничивает выборку, limit > 0 - ее размер
+func (sm *SagaManager) Sagas(ctx context.Context, status SagaStatus, limit int) ([]SagaState, error) {
+	states, err := sm.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status != "" {
+		states = slices.DeleteFunc(states, func(s SagaState) bool { return s.Status != status })
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].StartedAt.After(states[j].StartedAt) })
+	if limit > 0 && len(states) > limit {
+		states = states[:limit]
+	}
+	return states, nil
+}
+
+// Saga возвращает состояние саги заказа вместе с хронологией шагов
+func (sm *SagaManager) Saga(ctx context.Context, orderID string) (SagaState, error) {
+	state, found, err := sm.store.Load(ctx, orderID)
+	if err != nil {
+		return SagaState{}, err
+	}
+	if !found {
+		return SagaState{}, fmt.Errorf("%w: заказ %s", ErrSagaNotFound, orderID)
+	}
+	return state, nil
+}
+
+// RetryStep по команде оператора один раз повторяет невыполненную компенсацию шага step зависшей саги
+// (с политикой повторов компенсации). Когда выполнены все компенсации, сага считается откаченной.
+// В отличие от Redrive повтор выполняется синхронно и только для одного шага.
+func (sm *SagaManager) RetryStep(ctx context.Context, orderID, step, requestedBy string) (SagaState, error) {
+	state, err := sm.Saga(ctx, orderID)
+	if err != nil {
+		return SagaState{}, err
+	}
+
+	ctx, span := tracing.StartApplication(ctx, "RetryStep", trace.WithLinks(linkToLastSpan(state, "redrive")...))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", orderID),
+		attribute.String("saga.step", step),
+		attribute.String("saga.status", string(state.Status)),
+		attribute.String("redrive.requested_by", requestedBy),
+	)
+
+	comp, ok := sm.compensations[step]
+	if state.Status != SagaStuck || !ok || !slices.Contains(state.FailedCompensations, step) {
+		span.SetAttributes(attribute.String("error.type", "retry_rejected"))
+		return state, fmt.Errorf("%w: у саги заказа %s (%s) нет невыполненной компенсации шага %s", ErrStepNotRetryable, orderID, state.Status, step)
+	}
+
+	run, ok := sm.startRun(state)
+	if !ok {
+		return state, fmt.Errorf("%w: заказ %s", ErrSagaBusy, orderID)
+	}
+	defer sm.finishRun(run)
+
+	sagaCtx := &SagaContextData{
+		LastSpanContext: span.SpanContext(),
+		Order:           state.Order,
+		Outputs:         make(map[string]json.RawMessage, len(state.Outputs)),
+		run:             run,
+	}
+	for name, output := range state.Outputs {
+		sagaCtx.Outputs[name] = output
+	}
+
+	// Компенсация не прерывается, если оператор не дождался ответа
+	ctx = context.WithoutCancel(ctx)
+	startedAt := time.Now().UTC()
+	stepErr := comp.act(ctx, sagaCtx)
+
+	if err := run.update(ctx, func(s *SagaState) {
+		s.record(step, comp.action, true, sagaCtx.LastSpanContext, startedAt, stepErr)
+		s.Timeline[len(s.Timeline)-1].Manual = true
+		s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+		if stepErr != nil {
+			s.Error = stepErr.Error()
+			return
+		}
+		s.FailedCompensations = slices.DeleteFunc(s.FailedCompensations, func(name string) bool { return name == step })
+		s.CompensatedSteps = append(s.CompensatedSteps, step)
+		if len(s.FailedCompensations) == 0 {
+			s.Status = SagaCompensated
+		}
+	}); err != nil {
+		span.RecordError(err)
+		return run.snapshot(), err
+	}
+
+	if stepErr != nil {
+		span.RecordError(stepErr)
+		span.SetStatus(codes.Error, stepErr.Error())
+		return run.snapshot(), stepErr
+	}
+
+	state = run.snapshot()
+	span.SetAttributes(attribute.String("saga.status", string(state.Status)))
+	log.Printf("Компенсация шага %s саги заказа %s выполнена оператором %s (статус саги %s)", step, orderID, requestedBy, state.Status)
+	return state, nil
+}
+
+// ForceCompensation по команде оператора прерывает сагу и откатывает выполненные шаги.
+// Как и отмена покупателем, сага прерывается перед следующим шагом. Сагу после точки невозврата
+// откатывает только явное подтверждение оператора (pastPointOfNoReturn), без него - ErrCancelRejected.
+// Завершенную сагу откатить нельзя (ErrCancelRejected).
+func (sm *SagaManager) ForceCompensation(ctx context.Context, orderID, reason, requestedBy string, pastPointOfNoReturn bool) error {
+	ctx, span := tracing.StartApplication(ctx, "ForceCompensation")
+	defer span.End()
+
+	if reason == "" {
+		reason = "принудительная компенсация оператором"
+	}
+	span.SetAttributes(
+		attribute.String("order.id", orderID),
+		attribute.String("cancel.reason", reason),
+		attribute.String("redrive.requested_by", requestedBy),
+		attribute.Bool("cancel.past_point_of_no_return", pastPointOfNoReturn),
+	)
+
+	// В отличие от отмены покупателем, компенсация саги, которой еще нет, не откладывается
+	if _, err := sm.Saga(ctx, orderID); err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	request := cancelRequest{
+		command: domain.CancelOrderCommand{
+			OrderID:     orderID,
+			Reason:      reason,
+			RequestedAt: time.Now().UTC(),
+		},
+		spanContext: span.SpanContext(),
+		receivedAt:  time.Now(),
+		force:       pastPointOfNoReturn,
+	}
+
+	err := sm.cancel(ctx, request)
+	if errors.Is(err, ErrCancelRejected) {
+		span.SetAttributes(
+			attribute.String("error.type", "cancel_rejected"),
+			attribute.String("cancel.reject_reason", err.Error()),
+		)
+		return err
+	}
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	log.Printf("Оператор %s запросил компенсацию саги заказа %s", requestedBy, orderID)
+	return nil
+}
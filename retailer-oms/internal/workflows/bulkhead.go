@@ -0,0 +1,126 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrBulkheadFull - вызов сервиса отклонен: все места bulkhead заняты дольше max_wait
+var ErrBulkheadFull = errors.New("bulkhead full")
+
+// BulkheadPolicy - ограничение одновременных вызовов сервиса
+type BulkheadPolicy struct {
+	MaxConcurrent int           `yaml:"max_concurrent"` // Одновременных вызовов сервиса; 0 - без ограничения
+	MaxWait       time.Duration `yaml:"max_wait"`       // Ожидание свободного места; 0 - вызов отклоняется сразу
+}
+
+// validate проверяет настройки
+func (p BulkheadPolicy) validate() error {
+	if p.MaxConcurrent < 0 || p.MaxWait < 0 {
+		return errors.New("отрицательное значение в bulkhead")
+	}
+	return nil
+}
+
+// bulkhead ограничивает число одновременных вызовов сервиса, чтобы медленный сервис
+// не занял все воркеры OMS и не задержал саги, которые в него не ходят
+type bulkhead struct {
+	service string
+	policy  BulkheadPolicy
+	slots   chan struct{}
+}
+
+func newBulkhead(service string, policy BulkheadPolicy) *bulkhead {
+	return &bulkhead{service: service, policy: policy, slots: make(chan struct{}, policy.MaxConcurrent)}
+}
+
+// acquire занимает место для вызова. Компенсации ждут места до истечения времени попытки, а не max_wait.
+func (b *bulkhead) acquire(ctx context.Context, compensation bool) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	span := trace.SpanFromContext(ctx)
+	waitCtx := ctx
+	if !compensation {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, b.policy.MaxWait)
+		defer cancel()
+	}
+
+	startedAt := time.Now()
+	select {
+	case b.slots <- struct{}{}:
+		span.SetAttributes(attribute.Int64("bulkhead.wait_ms", time.Since(startedAt).Milliseconds()))
+		return nil
+	case <-waitCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		span.SetAttributes(attribute.Bool("bulkhead.rejected", true))
+		return fmt.Errorf("%w: сервис %s (%d одновременных вызовов)", ErrBulkheadFull, b.service, b.policy.MaxConcurrent)
+	}
+}
+
+// release освобождает место вызова
+func (b *bulkhead) release() {
+	<-b.slots
+}
+
+// serviceGuard - circuit breaker и bulkhead одного сервиса; nil-поля отключены
+type serviceGuard struct {
+	breaker  *circuitBreaker
+	bulkhead *bulkhead
+}
+
+func newServiceGuard(service string, breaker CircuitBreakerPolicy, limit BulkheadPolicy) *serviceGuard {
+	guard := &serviceGuard{}
+	if breaker.FailureThreshold > 0 {
+		guard.breaker = newCircuitBreaker(service, breaker)
+	}
+	if limit.MaxConcurrent > 0 {
+		guard.bulkhead = newBulkhead(service, limit)
+	}
+	return guard
+}
+
+// call выполняет вызов сервиса через circuit breaker и bulkhead. Отклоненный вызов в сервис не уходит
+// и завершается ошибкой ErrCircuitOpen или ErrBulkheadFull (error.type circuit_open, bulkhead_full).
+func (g *serviceGuard) call(ctx context.Context, compensation bool, do func(context.Context) (json.RawMessage, error)) (json.RawMessage, error) {
+	var probe bool
+	if g.breaker != nil {
+		var err error
+		if probe, err = g.breaker.allow(ctx, compensation); err != nil {
+			return nil, err
+		}
+	}
+	if g.bulkhead != nil {
+		if err := g.bulkhead.acquire(ctx, compensation); err != nil {
+			if g.breaker != nil && probe {
+				g.breaker.cancelProbe()
+			}
+			return nil, err
+		}
+		defer g.bulkhead.release()
+	}
+
+	output, err := do(ctx)
+	if g.breaker != nil {
+		g.breaker.done(ctx, probe, err)
+	}
+	return output, err
+}
+
+// notCalled сообщает, что шаг не выполнен, так и не обратившись к сервису: все его попытки отклонили
+// circuit breaker или bulkhead. Компенсировать такой шаг не нужно.
+func notCalled(sagaCtx *SagaContextData, err error) bool {
+	return !sagaCtx.called && (errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrBulkheadFull))
+}
@@ -0,0 +1,273 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrSagaCancelled - сага прервана по запросу покупателя, выполненные шаги компенсированы
+	ErrSagaCancelled = errors.New("saga cancelled by customer")
+	// ErrCancelRejected - отмена невозможна: заказ прошел точку невозврата, его обработка завершена или он принадлежит другому покупателю
+	ErrCancelRejected = errors.New("cancel rejected")
+	// ErrSagaResumedCompensation - сага продолжена после рестарта в состоянии компенсации
+	ErrSagaResumedCompensation = errors.New("saga compensation resumed")
+)
+
+const (
+	// pendingCancelTTL - сколько хранится отмена заказа, сага которого еще не запущена на этом экземпляре
+	pendingCancelTTL = 10 * time.Minute
+
+	// pendingPruneInterval - как часто удаляются устаревшие отложенные отмены
+	pendingPruneInterval = time.Minute
+)
+
+// cancelRequest - принятый запрос на отмену и спан, в котором он получен
+type cancelRequest struct {
+	command     domain.CancelOrderCommand
+	spanContext trace.SpanContext
+	receivedAt  time.Time
+	force       bool // Компенсация, подтвержденная оператором после точки невозврата: точка невозврата не проверяется
+}
+
+// checkPoint возвращает шаг, после которого отмена отклоняется; у подтвержденной оператором компенсации его нет
+func (r cancelRequest) checkPoint(pointOfNoReturn string) string {
+	if r.force {
+		return ""
+	}
+	return pointOfNoReturn
+}
+
+// sagaRun - состояние выполняющейся саги, общее для шагов саги и обработчика команд отмены.
+// Каждое изменение сразу сохраняется в хранилище.
+type sagaRun struct {
+	mu              sync.Mutex
+	store           SagaStore
+	pointOfNoReturn string
+	state           SagaState
+}
+
+// update изменяет состояние саги и сохраняет его. Сохранение выполняется под блокировкой,
+// чтобы более старое состояние не перезаписало более новое.
+func (r *sagaRun) update(ctx context.Context, change func(*SagaState)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	change(&r.state)
+	r.state.UpdatedAt = time.Now().UTC()
+	return r.store.Save(ctx, r.state)
+}
+
+// snapshot возвращает копию текущего состояния саги
+func (r *sagaRun) snapshot() SagaState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// requestCancel принимает и сохраняет отмену, если заказ еще не прошел точку невозврата. Повторная отмена ничего не меняет.
+func (r *sagaRun) requestCancel(ctx context.Context, request cancelRequest) error {
+	var rejected error
+	err := r.update(ctx, func(s *SagaState) {
+		rejected = checkCancel(*s, request.command, request.checkPoint(r.pointOfNoReturn))
+		if rejected == nil && s.Cancel == nil {
+			s.Cancel = &request.command
+			s.CancelSpan = encodeSpanContext(request.spanContext)
+		}
+	})
+	if rejected != nil {
+		return rejected
+	}
+	return err
+}
+
+// checkCancel проверяет, можно ли отменить заказ в состоянии state.
+// После шага pointOfNoReturn (например, отгрузки) отмена невозможна.
+func checkCancel(state SagaState, command domain.CancelOrderCommand, pointOfNoReturn string) error {
+	if command.CustomerID != "" && state.Order.CustomerID != "" && command.CustomerID != state.Order.CustomerID {
+		return fmt.Errorf("%w: заказ %s принадлежит другому покупателю", ErrCancelRejected, state.OrderID)
+	}
+	if pointOfNoReturn != "" && state.completed(pointOfNoReturn) {
+		return fmt.Errorf("%w: заказ %s уже прошел шаг %s", ErrCancelRejected, state.OrderID, pointOfNoReturn)
+	}
+	if state.Status.IsFinished() && state.Cancel == nil {
+		return fmt.Errorf("%w: обработка заказа %s уже завершена", ErrCancelRejected, state.OrderID)
+	}
+	return nil
+}
+
+// startRun регистрирует сагу заказа и применяет отмену, полученную до ее запуска.
+// Если сага заказа уже выполняется, возвращает false.
+func (sm *SagaManager) startRun(state SagaState) (*sagaRun, bool) {
+	run := &sagaRun{store: sm.store, pointOfNoReturn: sm.definition.PointOfNoReturn, state: state}
+
+	sm.mu.Lock()
+	if _, ok := sm.runs[state.OrderID]; ok {
+		sm.mu.Unlock()
+		return nil, false
+	}
+	sm.runs[state.OrderID] = run
+	pending, ok := sm.pending[state.OrderID]
+	delete(sm.pending, state.OrderID)
+	sm.mu.Unlock()
+
+	if ok {
+		if err := run.requestCancel(context.Background(), pending); err != nil {
+			log.Printf("Отложенная отмена заказа %s отклонена: %v", state.OrderID, err)
+		}
+	}
+	return run, true
+}
+
+// finishRun снимает сагу с регистрации; дальше отмены проверяются по хранилищу
+func (sm *SagaManager) finishRun(run *sagaRun) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.runs, run.state.OrderID)
+}
+
+// prunePending удаляет устаревшие отложенные отмены не чаще pendingPruneInterval; вызывается под sm.mu
+func (sm *SagaManager) prunePending() {
+	if time.Since(sm.prunedAt) < pendingPruneInterval {
+		return
+	}
+	sm.prunedAt = time.Now()
+
+	for orderID, pending := range sm.pending {
+		if time.Since(pending.receivedAt) > pendingCancelTTL {
+			delete(sm.pending, orderID)
+		}
+	}
+}
+
+// Cancel обрабатывает запрос покупателя на отмену заказа.
+// Выполняющаяся сага прерывается перед следующим шагом, после чего компенсируются уже выполненные шаги.
+// Отмена заказа, прошедшего точку невозврата, или завершенной саги отклоняется с ErrCancelRejected.
+// Если сага заказа на этом экземпляре еще не запущена, отмена откладывается до ее запуска.
+func (sm *SagaManager) Cancel(ctx context.Context, command domain.CancelOrderCommand) error {
+	ctx, span := tracing.StartApplication(ctx, "CancelSaga")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", command.OrderID),
+		attribute.String("cancel.reason", command.Reason),
+	)
+
+	request := cancelRequest{command: command, spanContext: span.SpanContext(), receivedAt: time.Now()}
+
+	err := sm.cancel(ctx, request)
+	if errors.Is(err, ErrCancelRejected) {
+		// Отклоненная отмена - ожидаемый исход, а не сбой: спан не помечается ошибкой
+		span.SetAttributes(
+			attribute.String("error.type", "cancel_rejected"),
+			attribute.String("cancel.reject_reason", err.Error()),
+		)
+		return err
+	}
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// cancel передает отмену выполняющейся саге, проверяет ее по хранилищу или откладывает до запуска саги
+func (sm *SagaManager) cancel(ctx context.Context, request cancelRequest) error {
+	orderID := request.command.OrderID
+
+	sm.mu.Lock()
+	run, running := sm.runs[orderID]
+	sm.mu.Unlock()
+	if running {
+		if err := run.requestCancel(ctx, request); err != nil {
+			return err
+		}
+		log.Printf("Отмена заказа %s принята", orderID)
+		return nil
+	}
+
+	state, found, err := sm.store.Load(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if found {
+		if err := checkCancel(state, request.command, request.checkPoint(sm.definition.PointOfNoReturn)); err != nil {
+			return err
+		}
+		if state.Status.IsFinished() {
+			// Повторная отмена уже отмененного заказа
+			return nil
+		}
+		if state.Status == SagaCompensating || state.Status == SagaStuck {
+			// Сага уже откатывается: отмена ничего не меняет
+			log.Printf("Сага заказа %s уже откатывается (%s), отмена не требуется", orderID, state.Status)
+			return nil
+		}
+	}
+
+	// Сага еще не запущена или ее продолжит Recover на этом экземпляре
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if run, ok := sm.runs[orderID]; ok {
+		// Сага запустилась, пока читали хранилище
+		return run.requestCancel(ctx, request)
+	}
+	sm.prunePending()
+	sm.pending[orderID] = request
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cancel.deferred", true))
+	log.Printf("Сага заказа %s не выполняется на этом экземпляре, отмена отложена", orderID)
+	return nil
+}
+
+// interruptIfCancelled прерывает сагу перед шагом step, если покупатель запросил отмену.
+// Спан прерывания связан с предыдущим шагом саги и со спаном, принявшим отмену,
+// а компенсации продолжают цепочку от него.
+func interruptIfCancelled(ctx context.Context, sagaCtx *SagaContextData, step string) error {
+	state := sagaCtx.run.snapshot()
+	if state.Cancel == nil {
+		return nil
+	}
+
+	links := linksFromSagaContext(sagaCtx)
+	if cancelSpan := decodeSpanContext(state.CancelSpan); cancelSpan.IsValid() {
+		links = append(links, trace.Link{
+			SpanContext: cancelSpan,
+			Attributes: []attribute.KeyValue{
+				attribute.String("link.type", "cancel"),
+			},
+		})
+	}
+	_, span := tracing.StartApplication(ctx, "InterruptSaga", trace.WithLinks(links...))
+	defer span.End()
+
+	sagaCtx.LastSpanContext = span.SpanContext()
+
+	span.SetAttributes(
+		attribute.String("order.id", sagaCtx.Order.ID),
+		attribute.String("saga.step", step),
+		attribute.String("cancel.reason", state.Cancel.Reason),
+	)
+
+	if err := sagaCtx.run.update(ctx, func(s *SagaState) {
+		s.Status = SagaCompensating
+		s.Step = step
+		s.InterruptedStep = step
+		s.Error = ErrSagaCancelled.Error()
+		s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+	}); err != nil {
+		span.RecordError(err)
+		log.Printf("Не удалось сохранить прерывание саги заказа %s: %v", sagaCtx.Order.ID, err)
+	}
+
+	log.Printf("Сага заказа %s прервана перед шагом %s (причина: %s)", sagaCtx.Order.ID, step, state.Cancel.Reason)
+	return ErrSagaCancelled
+}
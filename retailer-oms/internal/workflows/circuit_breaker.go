@@ -0,0 +1,167 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrCircuitOpen - вызов сервиса отклонен открытым circuit breaker без обращения к сервису
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Значения по умолчанию для circuit_breaker с заданным failure_threshold
+const (
+	defaultOpenTimeout   = 10 * time.Second
+	defaultHalfOpenCalls = 1
+)
+
+// CircuitBreakerPolicy - настройки circuit breaker сервиса
+type CircuitBreakerPolicy struct {
+	FailureThreshold int           `yaml:"failure_threshold"` // Сбоев подряд, после которых breaker открывается; 0 - breaker выключен
+	OpenTimeout      time.Duration `yaml:"open_timeout"`      // Сколько breaker открыт до пробных вызовов
+	HalfOpenCalls    int           `yaml:"half_open_calls"`   // Сколько пробных вызовов выполняется одновременно
+}
+
+// validate проверяет настройки и подставляет значения по умолчанию
+func (p *CircuitBreakerPolicy) validate() error {
+	if p.FailureThreshold < 0 || p.OpenTimeout < 0 || p.HalfOpenCalls < 0 {
+		return errors.New("отрицательное значение в circuit_breaker")
+	}
+	if p.OpenTimeout == 0 {
+		p.OpenTimeout = defaultOpenTimeout
+	}
+	if p.HalfOpenCalls == 0 {
+		p.HalfOpenCalls = defaultHalfOpenCalls
+	}
+	return nil
+}
+
+// breakerState - состояние circuit breaker
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"    // Вызовы проходят, сбои подряд считаются
+	breakerOpen     breakerState = "open"      // Вызовы отклоняются сразу
+	breakerHalfOpen breakerState = "half_open" // Проходят только пробные вызовы: успех закрывает breaker, сбой открывает снова
+)
+
+// circuitBreaker защищает вызовы одного сервиса: пока сервис недоступен, шаги саг не ждут его таймаутов,
+// а сразу завершаются ошибкой ErrCircuitOpen. Смена состояния записывается событием в спан вызова, который к ней привел.
+type circuitBreaker struct {
+	service string
+	policy  CircuitBreakerPolicy
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int // Сбои подряд в состоянии closed
+	probes   int // Выполняющиеся пробные вызовы в состоянии half-open
+	openedAt time.Time
+}
+
+func newCircuitBreaker(service string, policy CircuitBreakerPolicy) *circuitBreaker {
+	return &circuitBreaker{service: service, policy: policy, state: breakerClosed}
+}
+
+// allow решает, выполнять ли вызов. probe - вызов пробный, его результат закроет или снова откроет breaker.
+// Компенсации не отклоняются: откат должен дойти до сервиса, а их повторы настойчивее повторов шагов.
+func (b *circuitBreaker) allow(ctx context.Context, compensation bool) (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	span := trace.SpanFromContext(ctx)
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.policy.OpenTimeout {
+		b.setState(span, breakerHalfOpen, "open_timeout")
+	}
+	span.SetAttributes(attribute.String("circuit_breaker.state", string(b.state)))
+
+	switch {
+	case compensation || b.state == breakerClosed:
+		return false, nil
+	case b.state == breakerHalfOpen && b.probes < b.policy.HalfOpenCalls:
+		b.probes++
+		span.SetAttributes(attribute.Bool("circuit_breaker.probe", true))
+		return true, nil
+	}
+
+	span.SetAttributes(attribute.Bool("circuit_breaker.rejected", true))
+	return false, fmt.Errorf("%w: сервис %s (%s)", ErrCircuitOpen, b.service, b.state)
+}
+
+// done учитывает результат вызова. Сбоем сервиса считаются сетевые ошибки, таймауты и ответы 5xx;
+// ответ 4xx - отказ по существу запроса, сервис при этом работает.
+func (b *circuitBreaker) done(ctx context.Context, probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	span := trace.SpanFromContext(ctx)
+	failure := serviceFailure(err)
+
+	if probe {
+		b.probes--
+		if b.state != breakerHalfOpen {
+			return
+		}
+		if failure {
+			b.setState(span, breakerOpen, "probe_failed")
+		} else {
+			b.setState(span, breakerClosed, "probe_succeeded")
+		}
+		return
+	}
+
+	if b.state != breakerClosed {
+		return
+	}
+	if !failure {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.policy.FailureThreshold {
+		b.setState(span, breakerOpen, "failure_threshold")
+	}
+}
+
+// cancelProbe освобождает пробный вызов, который не был выполнен (например, его отклонил bulkhead)
+func (b *circuitBreaker) cancelProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probes--
+}
+
+// setState меняет состояние breaker и записывает событие circuit_breaker.state_change в спан вызова
+func (b *circuitBreaker) setState(span trace.Span, state breakerState, reason string) {
+	from := b.state
+	b.state = state
+
+	span.AddEvent("circuit_breaker.state_change", trace.WithAttributes(
+		attribute.String("circuit_breaker.service", b.service),
+		attribute.String("circuit_breaker.from", string(from)),
+		attribute.String("circuit_breaker.to", string(state)),
+		attribute.String("circuit_breaker.reason", reason),
+		attribute.Int("circuit_breaker.failures", b.failures),
+	))
+	log.Printf("Circuit breaker сервиса %s: %s -> %s (%s)", b.service, from, state, reason)
+
+	switch state {
+	case breakerOpen:
+		b.openedAt = time.Now()
+	case breakerClosed:
+		b.failures = 0
+	}
+}
+
+// serviceFailure сообщает, что ошибка вызова говорит о недоступности сервиса
+func serviceFailure(err error) bool {
+	switch errorType(err) {
+	case RetryOnNetwork, RetryOnTimeout, "http_5xx":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrSagaDeadline - сага не выполнена за срок из описания (deadline), выполненные шаги компенсируются
+var ErrSagaDeadline = errors.New("saga deadline exceeded")
+
+// checkDeadline проверяет срок саги перед шагом step или после его ошибки cause. Если срок истек,
+// создается спан SagaDeadlineExceeded, связанный с предыдущим шагом саги; компенсации продолжают цепочку от него.
+// Срок задается контекстом шагов (см. play), компенсации выполняются в контексте без срока.
+func checkDeadline(ctx context.Context, sagaCtx *SagaContextData, step string, cause error) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return cause
+	}
+
+	err := fmt.Errorf("%w: шаг %s", ErrSagaDeadline, step)
+	if cause != nil {
+		err = fmt.Errorf("%w: шаг %s: %w", ErrSagaDeadline, step, cause)
+	}
+
+	_, span := tracing.StartApplication(context.WithoutCancel(ctx), "SagaDeadlineExceeded",
+		trace.WithLinks(linksFromSagaContext(sagaCtx)...))
+	defer span.End()
+
+	sagaCtx.LastSpanContext = span.SpanContext()
+
+	span.SetAttributes(
+		attribute.String("order.id", sagaCtx.Order.ID),
+		attribute.String("saga.step", step),
+		attribute.String("error.type", errorType(err)),
+	)
+	if deadline, ok := ctx.Deadline(); ok {
+		span.SetAttributes(attribute.String("saga.deadline", deadline.UTC().Format(time.RFC3339Nano)))
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+
+	log.Printf("Срок саги заказа %s истек на шаге %s, выполненные шаги будут компенсированы", sagaCtx.Order.ID, step)
+	return err
+}
@@ -0,0 +1,216 @@
+package workflows
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+)
+
+// StepKind - способ выполнения шага саги
+type StepKind string
+
+const (
+	StepLocal StepKind = "local" // Локальная логика OMS, обработчик выбирается по имени шага
+	StepHTTP  StepKind = "http"  // Вызов HTTP-сервиса
+	StepKafka StepKind = "kafka" // Публикация заказа в топик Kafka
+)
+
+// ErrInvalidDefinition - ошибка в описании саги
+var ErrInvalidDefinition = errors.New("invalid saga definition")
+
+// defaultStepTimeout ограничивает попытку шага, если в описании не заданы ни timeout шага, ни step_timeout саги
+const defaultStepTimeout = 5 * time.Second
+
+// SagaDefinition - описание саги: шаги выполняются по порядку, при ошибке компенсируются в обратном.
+// Группа шагов (parallel) выполняется одновременно, следующий шаг ждет завершения всех веток группы.
+type SagaDefinition struct {
+	Name string `yaml:"name"`
+	// PointOfNoReturn - шаг, после выполнения которого заказ отменить нельзя
+	PointOfNoReturn string `yaml:"point_of_no_return"`
+	// Deadline - срок выполнения саги от ее запуска (SLA); если он истек, выполненные шаги компенсируются. 0 - без срока
+	Deadline time.Duration `yaml:"deadline"`
+	// StepTimeout - ограничение попытки шага, у которого не задан timeout
+	StepTimeout time.Duration `yaml:"step_timeout"`
+	// Services - адреса сервисов (host:port) по имени; переменные окружения вида ${SVC_PAYMENT} подставляются при загрузке
+	Services map[string]string `yaml:"services"`
+	// CircuitBreaker и Bulkhead защищают вызовы сервисов; у каждого сервиса свои breaker и bulkhead с этими настройками
+	CircuitBreaker CircuitBreakerPolicy `yaml:"circuit_breaker"`
+	Bulkhead       BulkheadPolicy       `yaml:"bulkhead"`
+	Steps          []StepDefinition     `yaml:"steps"`
+}
+
+// ActionDefinition - действие шага или его компенсации
+type ActionDefinition struct {
+	Name    string        `yaml:"name"`
+	Kind    StepKind      `yaml:"kind"`
+	Service string        `yaml:"service"` // http: имя сервиса из SagaDefinition.Services
+	Path    string        `yaml:"path"`    // http: путь запроса
+	Method  string        `yaml:"method"`  // http: метод запроса, по умолчанию POST
+	Topic   string        `yaml:"topic"`   // kafka: топик
+	Event   string        `yaml:"event"`   // kafka: тип события CloudEvents
+	Timeout time.Duration `yaml:"timeout"` // Ограничение времени одной попытки, по умолчанию SagaDefinition.StepTimeout
+	Retry   RetryPolicy   `yaml:"retry"`
+	// Status - статус заказа после успешного действия; смена статуса публикуется в топик статусов
+	Status domain.OrderStatus `yaml:"status"`
+}
+
+// StepDefinition - шаг саги и его компенсация; шаг без компенсации при откате пропускается.
+// Шаг с Parallel - группа независимых шагов-веток: у группы есть только имя, действия и компенсации задаются в ветках.
+type StepDefinition struct {
+	ActionDefinition `yaml:",inline"`
+	Compensation     *ActionDefinition `yaml:"compensation"`
+	Parallel         []StepDefinition  `yaml:"parallel"`
+}
+
+// IsGroup сообщает, что шаг - группа параллельных веток
+func (s *StepDefinition) IsGroup() bool {
+	return len(s.Parallel) > 0
+}
+
+// Validate проверяет описание саги и заполняет значения по умолчанию
+func (d *SagaDefinition) Validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("%w: не задано имя саги", ErrInvalidDefinition)
+	}
+	if len(d.Steps) == 0 {
+		return fmt.Errorf("%w: сага %s не содержит шагов", ErrInvalidDefinition, d.Name)
+	}
+	if d.Deadline < 0 || d.StepTimeout < 0 {
+		return fmt.Errorf("%w: отрицательный deadline или step_timeout саги %s", ErrInvalidDefinition, d.Name)
+	}
+	if d.StepTimeout == 0 {
+		d.StepTimeout = defaultStepTimeout
+	}
+	if err := d.CircuitBreaker.validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDefinition, err)
+	}
+	if err := d.Bulkhead.validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDefinition, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range d.Steps {
+		step := &d.Steps[i]
+		if step.IsGroup() {
+			if err := d.validateGroup(step, names); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.validateStep(step, names); err != nil {
+			return err
+		}
+	}
+
+	if d.PointOfNoReturn != "" && !d.hasStep(d.PointOfNoReturn) {
+		return fmt.Errorf("%w: point_of_no_return ссылается на неизвестный шаг %s", ErrInvalidDefinition, d.PointOfNoReturn)
+	}
+	return nil
+}
+
+// validateStep проверяет действие шага и его компенсацию
+func (d *SagaDefinition) validateStep(step *StepDefinition, names map[string]bool) error {
+	if err := d.validateAction(&step.ActionDefinition, names); err != nil {
+		return err
+	}
+	if step.Compensation != nil {
+		return d.validateAction(step.Compensation, names)
+	}
+	return nil
+}
+
+// validateGroup проверяет группу параллельных шагов; вложенные группы не поддерживаются
+func (d *SagaDefinition) validateGroup(group *StepDefinition, names map[string]bool) error {
+	if group.Name == "" {
+		return fmt.Errorf("%w: у группы шагов саги %s не задано имя", ErrInvalidDefinition, d.Name)
+	}
+	if names[group.Name] {
+		return fmt.Errorf("%w: шаг %s описан дважды", ErrInvalidDefinition, group.Name)
+	}
+	names[group.Name] = true
+
+	if group.Kind != "" || group.Status != "" || group.Compensation != nil {
+		return fmt.Errorf("%w: группа %s не может иметь собственного действия, статуса или компенсации", ErrInvalidDefinition, group.Name)
+	}
+	if len(group.Parallel) < 2 {
+		return fmt.Errorf("%w: в группе %s меньше двух шагов", ErrInvalidDefinition, group.Name)
+	}
+	for i := range group.Parallel {
+		branch := &group.Parallel[i]
+		if branch.IsGroup() {
+			return fmt.Errorf("%w: вложенная группа %s в группе %s", ErrInvalidDefinition, branch.Name, group.Name)
+		}
+		if err := d.validateStep(branch, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateAction проверяет действие; имена действий уникальны в пределах саги, так как по ним сохраняется состояние
+func (d *SagaDefinition) validateAction(action *ActionDefinition, names map[string]bool) error {
+	if action.Name == "" {
+		return fmt.Errorf("%w: у шага саги %s не задано имя", ErrInvalidDefinition, d.Name)
+	}
+	if names[action.Name] {
+		return fmt.Errorf("%w: шаг %s описан дважды", ErrInvalidDefinition, action.Name)
+	}
+	names[action.Name] = true
+
+	switch action.Kind {
+	case StepLocal:
+		if _, ok := localActivities[action.Name]; !ok {
+			return fmt.Errorf("%w: нет локального обработчика для шага %s", ErrInvalidDefinition, action.Name)
+		}
+	case StepHTTP:
+		if _, ok := d.Services[action.Service]; !ok {
+			return fmt.Errorf("%w: шаг %s ссылается на неизвестный сервис %q", ErrInvalidDefinition, action.Name, action.Service)
+		}
+		if !strings.HasPrefix(action.Path, "/") {
+			return fmt.Errorf("%w: путь шага %s должен начинаться с /", ErrInvalidDefinition, action.Name)
+		}
+		if action.Method == "" {
+			action.Method = http.MethodPost
+		}
+		action.Method = strings.ToUpper(action.Method)
+	case StepKafka:
+		if action.Topic == "" {
+			return fmt.Errorf("%w: для шага %s не задан топик", ErrInvalidDefinition, action.Name)
+		}
+	default:
+		return fmt.Errorf("%w: неизвестный тип шага %s: %q", ErrInvalidDefinition, action.Name, action.Kind)
+	}
+
+	if action.Status != "" && !action.Status.IsValid() {
+		return fmt.Errorf("%w: неизвестный статус заказа %q в шаге %s", ErrInvalidDefinition, action.Status, action.Name)
+	}
+	if action.Timeout < 0 {
+		return fmt.Errorf("%w: отрицательный timeout в шаге %s", ErrInvalidDefinition, action.Name)
+	}
+	if action.Timeout == 0 {
+		action.Timeout = d.StepTimeout
+	}
+	if err := action.Retry.validate(); err != nil {
+		return fmt.Errorf("%w: шаг %s: %v", ErrInvalidDefinition, action.Name, err)
+	}
+	return nil
+}
+
+// hasStep сообщает, что в саге есть прямой шаг, группа или шаг группы с таким именем
+func (d *SagaDefinition) hasStep(name string) bool {
+	for _, step := range d.Steps {
+		if step.Name == name {
+			return true
+		}
+		for _, branch := range step.Parallel {
+			if branch.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
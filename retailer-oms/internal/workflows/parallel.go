@@ -0,0 +1,272 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// branch - шаг группы параллельных шагов
+type branch struct {
+	name         string
+	act          activity
+	compensation *compensation // nil - у шага нет компенсации
+}
+
+// branchResult - итог ветки: ее последний спан и ответы сервисов
+type branchResult struct {
+	name    string
+	span    trace.SpanContext
+	outputs map[string]json.RawMessage
+	err     error
+}
+
+// wrapGroup оборачивает группу параллельных шагов. Ветки запускаются одновременно от спана ForkSteps
+// и дожидаются друг друга: ошибка одной ветки не прерывает остальные, так как прерванный вызов сервиса
+// оставил бы его в неизвестном состоянии. Спан JoinSteps связан с последними спанами всех веток.
+// После рестарта выполняются только невыполненные ветки.
+func (sm *SagaManager) wrapGroup(group string, branches []branch) func(context.Context) error {
+	return func(ctx context.Context) error {
+		sagaCtx := sagaContextFrom(ctx)
+		run := sagaCtx.run
+
+		state := run.snapshot()
+		if state.completed(group) {
+			return nil
+		}
+		if state.Status == SagaCompensating {
+			return fmt.Errorf("%w: %s", ErrSagaResumedCompensation, state.Error)
+		}
+
+		if err := interruptIfCancelled(ctx, sagaCtx, group); err != nil {
+			return err
+		}
+		if err := checkDeadline(ctx, sagaCtx, group, nil); err != nil {
+			if saveErr := run.update(ctx, func(s *SagaState) {
+				s.Status = SagaCompensating
+				s.Step = group
+				s.Error = err.Error()
+				s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+			}); saveErr != nil {
+				log.Printf("Не удалось сохранить истечение срока саги заказа %s: %v", sagaCtx.Order.ID, saveErr)
+			}
+			return err
+		}
+		if err := run.update(ctx, func(s *SagaState) {
+			s.Step = group
+			s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+		}); err != nil {
+			return err
+		}
+
+		var pending []branch
+		for _, b := range branches {
+			if !state.completed(b.name) {
+				pending = append(pending, b)
+			}
+		}
+		fork := forkSpan(ctx, sagaCtx, "ForkSteps", group, pending)
+
+		results := make([]branchResult, len(pending))
+		var wg sync.WaitGroup
+		for i, b := range pending {
+			wg.Add(1)
+			go func(i int, b branch) {
+				defer wg.Done()
+				results[i] = runBranch(ctx, sagaCtx, fork, b.name, b.name, false, b.act)
+			}(i, b)
+		}
+		wg.Wait()
+
+		err := joinSpan(ctx, sagaCtx, "JoinSteps", group, results)
+		if err != nil {
+			err = checkDeadline(ctx, sagaCtx, group, err)
+			if saveErr := run.update(ctx, func(s *SagaState) {
+				s.Status = SagaCompensating
+				s.Error = err.Error()
+				s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+			}); saveErr != nil {
+				log.Printf("Не удалось сохранить ошибку группы %s заказа %s: %v", group, sagaCtx.Order.ID, saveErr)
+			}
+			return err
+		}
+
+		return run.update(ctx, func(s *SagaState) {
+			s.CompletedSteps = append(s.CompletedSteps, group)
+			s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+		})
+	}
+}
+
+// wrapGroupCompensation оборачивает компенсацию группы: компенсируются все ветки, в том числе не выполненные,
+// так как их вызов мог частично выполниться. Пропускаются только ветки, вызов которых отклонил circuit breaker или bulkhead. Компенсации веток тоже выполняются параллельно.
+// Невыполненная компенсация ветки записывается по имени ветки, перезапуск оператором повторяет только ее.
+func (sm *SagaManager) wrapGroupCompensation(group string, branches []branch) func(context.Context) error {
+	return func(ctx context.Context) error {
+		sagaCtx := sagaContextFrom(ctx)
+		run := sagaCtx.run
+
+		state := run.snapshot()
+		if state.InterruptedStep == group || slices.Contains(state.CompensatedSteps, group) {
+			return nil
+		}
+
+		var pending []branch
+		for _, b := range branches {
+			if b.compensation != nil && !slices.Contains(state.CompensatedSteps, b.name) && !slices.Contains(state.RejectedSteps, b.name) {
+				pending = append(pending, b)
+			}
+		}
+		fork := forkSpan(ctx, sagaCtx, "ForkCompensations", group, pending)
+
+		results := make([]branchResult, len(pending))
+		var wg sync.WaitGroup
+		for i, b := range pending {
+			wg.Add(1)
+			go func(i int, b branch) {
+				defer wg.Done()
+				results[i] = runBranch(ctx, sagaCtx, fork, b.name, b.compensation.action, true, b.compensation.act)
+			}(i, b)
+		}
+		wg.Wait()
+
+		err := joinSpan(ctx, sagaCtx, "JoinCompensations", group, results)
+		if err != nil {
+			if saveErr := run.update(ctx, func(s *SagaState) {
+				s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+			}); saveErr != nil {
+				log.Printf("Не удалось сохранить компенсацию группы %s заказа %s: %v", group, sagaCtx.Order.ID, saveErr)
+			}
+			return err
+		}
+
+		return run.update(ctx, func(s *SagaState) {
+			s.CompensatedSteps = append(s.CompensatedSteps, group)
+			s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+		})
+	}
+}
+
+// runBranch выполняет действие ветки со своей копией контекста саги и сохраняет результат ветки.
+// step - имя шага-ветки, action - имя действия (у компенсации отличается от шага).
+func runBranch(ctx context.Context, parent *SagaContextData, fork trace.SpanContext, step, action string, compensation bool, act activity) branchResult {
+	sagaCtx := &SagaContextData{
+		LastSpanContext: fork,
+		Order:           parent.Order,
+		Outputs:         make(map[string]json.RawMessage),
+		run:             parent.run,
+		forked:          true,
+	}
+
+	startedAt := time.Now().UTC()
+	err := act(ctx, sagaCtx)
+
+	if saveErr := sagaCtx.run.update(ctx, func(s *SagaState) {
+		s.record(step, action, compensation, sagaCtx.LastSpanContext, startedAt, err)
+		switch {
+		case err != nil && compensation:
+			if !slices.Contains(s.FailedCompensations, step) {
+				s.FailedCompensations = append(s.FailedCompensations, step)
+			}
+			s.Error = err.Error()
+		case err != nil:
+			// Статус саги и ошибку группы сохраняет wrapGroup после завершения всех веток
+			if notCalled(sagaCtx, err) {
+				s.RejectedSteps = append(s.RejectedSteps, step)
+			}
+		case compensation:
+			s.CompensatedSteps = append(s.CompensatedSteps, step)
+		default:
+			s.CompletedSteps = append(s.CompletedSteps, step)
+			if output, ok := sagaCtx.Outputs[step]; ok {
+				if s.Outputs == nil {
+					s.Outputs = make(map[string]json.RawMessage)
+				}
+				s.Outputs[step] = output
+			}
+		}
+	}); saveErr != nil {
+		log.Printf("Не удалось сохранить шаг %s заказа %s: %v", action, sagaCtx.Order.ID, saveErr)
+		if err == nil {
+			err = saveErr
+		}
+	}
+
+	return branchResult{name: step, span: sagaCtx.LastSpanContext, outputs: sagaCtx.Outputs, err: err}
+}
+
+// forkSpan создает спан разветвления, связанный с предыдущим шагом саги; ветки связываются с ним связью fork
+func forkSpan(ctx context.Context, sagaCtx *SagaContextData, operation, group string, branches []branch) trace.SpanContext {
+	names := make([]string, 0, len(branches))
+	for _, b := range branches {
+		names = append(names, b.name)
+	}
+
+	_, span := tracing.StartApplication(ctx, operation, trace.WithLinks(linksFromSagaContext(sagaCtx)...))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", sagaCtx.Order.ID),
+		attribute.String("saga.group", group),
+		attribute.String("saga.branches", strings.Join(names, ",")),
+	)
+	return span.SpanContext()
+}
+
+// joinSpan создает спан слияния, связанный связью join с последним спаном каждой ветки, и продолжает от него
+// цепочку саги. Ответы сервисов веток переносятся в общий контекст саги. Возвращает ошибки веток.
+func joinSpan(ctx context.Context, sagaCtx *SagaContextData, operation, group string, results []branchResult) error {
+	links := make([]trace.Link, 0, len(results))
+	var errs []error
+	var failed []string
+	for _, result := range results {
+		if result.span.IsValid() {
+			links = append(links, trace.Link{
+				SpanContext: result.span,
+				Attributes: []attribute.KeyValue{
+					attribute.String("link.type", "join"),
+					attribute.String("saga.step", result.name),
+				},
+			})
+		}
+		for name, output := range result.outputs {
+			sagaCtx.Outputs[name] = output
+		}
+		if result.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.name, result.err))
+			failed = append(failed, result.name)
+		}
+	}
+
+	_, span := tracing.StartApplication(ctx, operation, trace.WithLinks(links...))
+	defer span.End()
+
+	sagaCtx.LastSpanContext = span.SpanContext()
+
+	span.SetAttributes(
+		attribute.String("order.id", sagaCtx.Order.ID),
+		attribute.String("saga.group", group),
+		attribute.Int("saga.branch_count", len(results)),
+	)
+
+	err := errors.Join(errs...)
+	if err != nil {
+		span.SetAttributes(attribute.String("saga.failed_branches", strings.Join(failed, ",")))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	span.SetStatus(codes.Ok, "успешно")
+	return nil
+}
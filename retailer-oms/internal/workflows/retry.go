@@ -0,0 +1,192 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Классы ошибок в retry_on политики повторов
+const (
+	RetryOnNetwork = "network" // Запрос не дошел до сервиса или ответ не получен
+	RetryOnTimeout = "timeout" // Истекло время попытки
+	RetryOn5xx     = "5xx"     // Любой ответ 5xx; отдельные коды задаются числом, например "503"
+)
+
+// defaultRetryOn - ошибки, которые повторяются, если retry_on не задан
+var defaultRetryOn = []string{RetryOnNetwork, RetryOnTimeout, RetryOn5xx}
+
+// ErrNetwork - запрос не дошел до сервиса или ответ не получен
+var ErrNetwork = errors.New("network error")
+
+// HTTPStatusError - сервис ответил кодом ошибки
+type HTTPStatusError struct {
+	StatusCode int
+	URL        string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("ошибка ответа %d от %s", e.StatusCode, e.URL)
+}
+
+// RetryPolicy - повторы действия при временной ошибке. Ответы 4xx считаются постоянными ошибками и не повторяются.
+type RetryPolicy struct {
+	MaxAttempts int           `yaml:"max_attempts"` // Число попыток, включая первую; по умолчанию 1
+	Backoff     time.Duration `yaml:"backoff"`      // Пауза перед второй попыткой, дальше удваивается
+	MaxBackoff  time.Duration `yaml:"max_backoff"`  // Верхняя граница паузы; 0 - без ограничения
+	Jitter      float64       `yaml:"jitter"`       // Случайный разброс паузы в долях от нее, от 0 до 1
+	RetryOn     []string      `yaml:"retry_on"`     // network, timeout, 5xx или коды 5xx; по умолчанию network, timeout, 5xx
+}
+
+// attempts возвращает число попыток с учетом значения по умолчанию
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// validate проверяет политику; retry_on не может включать 4xx
+func (p RetryPolicy) validate() error {
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("отрицательная пауза между попытками")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter должен быть от 0 до 1, задан %v", p.Jitter)
+	}
+	for _, class := range p.RetryOn {
+		switch class {
+		case RetryOnNetwork, RetryOnTimeout, RetryOn5xx:
+			continue
+		}
+		code, err := strconv.Atoi(class)
+		if err != nil {
+			return fmt.Errorf("неизвестный класс ошибок в retry_on: %q", class)
+		}
+		if code < 500 || code > 599 {
+			return fmt.Errorf("код %d в retry_on: повторять можно только ответы 5xx", code)
+		}
+	}
+	return nil
+}
+
+// retryable сообщает, что ошибку можно повторить по этой политике
+func (p RetryPolicy) retryable(err error) bool {
+	retryOn := p.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+
+	var statusErr *HTTPStatusError
+	isStatus := errors.As(err, &statusErr)
+	class := errorType(err)
+
+	for _, allowed := range retryOn {
+		switch {
+		case allowed == class && !isStatus:
+			return true
+		case allowed == RetryOn5xx && isStatus && statusErr.StatusCode >= 500:
+			return true
+		case isStatus && allowed == strconv.Itoa(statusErr.StatusCode):
+			return true
+		}
+	}
+	return false
+}
+
+// delay возвращает паузу перед попыткой attempt (начиная со второй) с учетом разброса
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 2; i < attempt; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		// Разброс не дает повторам одновременно упавших саг прийти в сервис одной волной
+		delay = time.Duration(float64(delay) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return delay
+}
+
+// errorType классифицирует ошибку шага для атрибута error.type и политики повторов
+func errorType(err error) string {
+	var statusErr *HTTPStatusError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &statusErr):
+		if statusErr.StatusCode >= 500 {
+			return "http_5xx"
+		}
+		return "http_4xx"
+	case errors.Is(err, ErrSagaDeadline):
+		return "saga_deadline"
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, ErrBulkheadFull):
+		return "bulkhead_full"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return RetryOnTimeout
+	case errors.Is(err, ErrNetwork):
+		return RetryOnNetwork
+	}
+	return "permanent"
+}
+
+// withPolicy выполняет действие до action.Retry.MaxAttempts раз, пока ошибка временная; каждая попытка
+// ограничена action.Timeout. Повторная попытка - отдельный спан, связанный с предыдущей попыткой (link.type=retry).
+func withPolicy(action ActionDefinition, act activity) activity {
+	return func(ctx context.Context, sagaCtx *SagaContextData) error {
+		policy := action.Retry
+		attempts := policy.attempts()
+		defer func() { sagaCtx.attempt = 0 }()
+
+		var err error
+		for attempt := 1; attempt <= attempts; attempt++ {
+			if attempt > 1 {
+				sagaCtx.attempt = attempt
+			}
+
+			attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+			if action.Timeout > 0 {
+				attemptCtx, cancel = context.WithTimeout(ctx, action.Timeout)
+			}
+			err = act(attemptCtx, sagaCtx)
+			cancel()
+
+			if err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				// Истек срок саги: повторять шаг бессмысленно
+				return err
+			}
+			if !policy.retryable(err) {
+				return err
+			}
+			if attempt == attempts {
+				log.Printf("Шаг %s заказа %s не выполнен за %d попыток: %v", action.Name, sagaCtx.Order.ID, attempts, err)
+				return err
+			}
+
+			delay := policy.delay(attempt + 1)
+			log.Printf("Шаг %s заказа %s не выполнен (попытка %d из %d), повтор через %v: %v",
+				action.Name, sagaCtx.Order.ID, attempt, attempts, delay, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		return err
+	}
+}
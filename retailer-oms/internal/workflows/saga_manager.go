@@ -2,10 +2,18 @@ package workflows
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
 	"github.com/itimofeev/go-saga"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -13,99 +21,401 @@ type contextKey string
 
 const sagaContextKey contextKey = "sagaContext"
 
-type ServicesConfig struct {
-	SvcAssembly string
-	SvcPayment  string
-	SvcDelivery string
-}
-
 // SagaManager управляет выполнением саги
 type SagaManager struct {
-	saga           *saga.Saga
-	servicesConfig *ServicesConfig
+	saga       *saga.Saga
+	definition *SagaDefinition
+	publisher  StepPublisher
+	store      SagaStore
+	topics     SagaTopics
+	// compensations - компенсации по имени шага, для ручного повтора оператором
+	compensations map[string]compensation
+	// guards - circuit breaker и bulkhead по имени сервиса
+	guards map[string]*serviceGuard
+
+	mu       sync.Mutex
+	runs     map[string]*sagaRun      // Выполняющиеся саги по id заказа
+	pending  map[string]cancelRequest // Отмены, полученные до запуска саги
+	prunedAt time.Time
+}
+
+// SagaTopics - топики Kafka, в которые Saga Manager публикует результаты саг
+type SagaTopics struct {
+	OrderStatus string // События смены статуса заказа
+	DeadLetter  string // Саги, которые не удалось откатить
+}
+
+// compensation - компенсирующее действие шага
+type compensation struct {
+	action string
+	act    activity
 }
 
 type SagaContextData struct {
 	LastSpanContext trace.SpanContext
 	Order           domain.Order
-	ServicesConfig  *ServicesConfig
+	Outputs         map[string]json.RawMessage // Ответы сервисов по шагам, в том числе сохраненные до рестарта
+
+	run     *sagaRun
+	attempt int  // Номер повторной попытки шага; 0 - первая попытка
+	forked  bool // Ветка группы параллельных шагов: действие связано со спаном разветвления
+	called  bool // Хотя бы одна попытка шага дошла до сервиса (не отклонена circuit breaker или bulkhead)
 }
 
-// NewSagaManager создает новый экземпляр SagaManager
-func NewSagaManager(cfg *ServicesConfig) *SagaManager {
+// NewSagaManager создает новый экземпляр SagaManager и строит сагу по описанию definition.
+// publisher публикует сообщения шагов вида kafka, смену статусов заказа и зависшие саги в топики topics.
+// Состояние саг сохраняется в store, чтобы после рестарта продолжить их с прерванного шага (см. Recover).
+func NewSagaManager(definition *SagaDefinition, publisher StepPublisher, store SagaStore, topics SagaTopics) (*SagaManager, error) {
+	if err := definition.Validate(); err != nil {
+		return nil, err
+	}
+
 	sm := &SagaManager{
-		saga:           saga.NewSaga("OrderProcessing"),
-		servicesConfig: cfg,
+		saga:          saga.NewSaga(definition.Name),
+		definition:    definition,
+		publisher:     publisher,
+		store:         store,
+		topics:        topics,
+		runs:          make(map[string]*sagaRun),
+		compensations: make(map[string]compensation),
+		guards:        make(map[string]*serviceGuard, len(definition.Services)),
+		pending:       make(map[string]cancelRequest),
+	}
+	for service := range definition.Services {
+		sm.guards[service] = newServiceGuard(service, definition.CircuitBreaker, definition.Bulkhead)
 	}
 
-	// Функция для безопасного добавления шагов
-	addStep := func(step *saga.Step) {
-		if err := sm.saga.AddStep(step); err != nil {
-			log.Fatalf("Ошибка при добавлении шага %s: %v", step.Name, err)
+	// Регистрация шагов саги
+	for _, step := range definition.Steps {
+		var action, compensate func(context.Context) error
+		if step.IsGroup() {
+			// Группа - один шаг координатора: ветки выполняются и компенсируются внутри него
+			branches := make([]branch, 0, len(step.Parallel))
+			for _, def := range step.Parallel {
+				branches = append(branches, branch{
+					name:         def.Name,
+					act:          sm.buildActivity(def.ActionDefinition, false),
+					compensation: sm.buildCompensation(def),
+				})
+			}
+			action = sm.wrapGroup(step.Name, branches)
+			compensate = sm.wrapGroupCompensation(step.Name, branches)
+		} else {
+			action = sm.wrapAction(step.Name, sm.buildActivity(step.ActionDefinition, false))
+			// Шаг без компенсации (например, финальный) при откате пропускается
+			compensate = func(ctx context.Context) error { return nil }
+			if comp := sm.buildCompensation(step); comp != nil {
+				compensate = sm.wrapCompensation(step.Name, comp.action, comp.act)
+			}
+		}
+
+		err := sm.saga.AddStep(&saga.Step{
+			Name:           step.Name,
+			Func:           action,
+			CompensateFunc: compensate,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("ошибка при добавлении шага %s: %w", step.Name, err)
 		}
 	}
 
-	// Регистрация шагов саги
-	addStep(&saga.Step{
-		Name:           "AcceptOrder",
-		Func:           sm.wrapAction(AcceptOrder),
-		CompensateFunc: sm.wrapAction(CancelOrder),
-	})
-
-	addStep(&saga.Step{
-		Name:           "AssembleOrder",
-		Func:           sm.wrapAction(AssembleOrder),
-		CompensateFunc: sm.wrapAction(ReturnToStock),
-	})
-
-	addStep(&saga.Step{
-		Name:           "PayOrder",
-		Func:           sm.wrapAction(PayOrder),
-		CompensateFunc: sm.wrapAction(RefundPayment),
-	})
-
-	addStep(&saga.Step{
-		Name:           "ShipOrder",
-		Func:           sm.wrapAction(ShipOrder),
-		CompensateFunc: sm.wrapAction(ReturnToWarehouse),
-	})
-
-	addStep(&saga.Step{
-		Name:           "CompleteOrder",
-		Func:           sm.wrapAction(CompleteOrder),
-		CompensateFunc: func(ctx context.Context) error { return nil }, // Финальный шаг, без компенсации
-	})
-
-	return sm
+	return sm, nil
 }
 
-// Execute запускает сагу
+// buildActivity создает действие по описанию и добавляет к нему ограничение времени, повторы
+// и публикацию статуса заказа; compensation - действие компенсирует шаг
+func (sm *SagaManager) buildActivity(action ActionDefinition, compensation bool) activity {
+	var act activity
+	switch action.Kind {
+	case StepHTTP:
+		act = httpActivity(action, sm.definition.Services[action.Service], sm.guards[action.Service], compensation)
+	case StepKafka:
+		act = kafkaActivity(action, sm.publisher)
+	default:
+		act = localActivities[action.Name]
+	}
+	return sm.withStatus(action, compensation, withPolicy(action, act))
+}
+
+// buildCompensation создает компенсацию шага и регистрирует ее для ручного повтора; nil - у шага нет компенсации
+func (sm *SagaManager) buildCompensation(step StepDefinition) *compensation {
+	if step.Compensation == nil {
+		return nil
+	}
+	comp := &compensation{action: step.Compensation.Name, act: sm.buildActivity(*step.Compensation, true)}
+	sm.compensations[step.Name] = *comp
+	return comp
+}
+
+// Execute запускает сагу заказа. Сага, прерванная отменой покупателя, считается выполненной.
+// Компенсированная сага возвращает ErrSagaCompensated, зависшая - ErrSagaStuck; остальные ошибки
+// означают, что исход саги не сохранен.
+// Повторно доставленный заказ не запускает сагу заново: завершенная сага пропускается,
+// а незавершенная, оставшаяся от прошлого запуска OMS, продолжается.
 func (sm *SagaManager) Execute(ctx context.Context, order domain.Order) error {
-	span := trace.SpanFromContext(ctx)
-	sagaCtxData := &SagaContextData{LastSpanContext: span.SpanContext(), Order: order, ServicesConfig: sm.servicesConfig}
+	state, found, err := sm.store.Load(ctx, order.ID)
+	if err != nil {
+		return err
+	}
+	if found {
+		if state.Status.IsFinished() {
+			log.Printf("Сага заказа %s уже завершена (%s), повторное сообщение пропущено", order.ID, state.Status)
+			return nil
+		}
+		if state.Status == SagaStuck {
+			log.Printf("Сага заказа %s зависла и ждет решения оператора, повторное сообщение пропущено", order.ID)
+			return nil
+		}
+		return sm.resume(ctx, state)
+	}
+
+	now := time.Now().UTC()
+	state = SagaState{
+		OrderID:   order.ID,
+		Order:     order,
+		Status:    SagaRunning,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	if sm.definition.Deadline > 0 {
+		state.Deadline = now.Add(sm.definition.Deadline)
+	}
+	return sm.play(state, trace.SpanFromContext(ctx).SpanContext())
+}
+
+// Recover продолжает саги, не завершенные до остановки OMS. Каждая сага выполняется в отдельной горутине.
+// Зависшие саги не продолжаются: их компенсации перезапускает оператор (см. Redrive).
+func (sm *SagaManager) Recover(ctx context.Context) error {
+	unfinished, err := sm.store.Unfinished(ctx)
+	if err != nil {
+		return err
+	}
+	var states []SagaState
+	for _, state := range unfinished {
+		if state.Status == SagaStuck {
+			log.Printf("Сага заказа %s зависла, компенсации ждут перезапуска оператором", state.OrderID)
+			continue
+		}
+		states = append(states, state)
+	}
+	for _, state := range states {
+		go func(state SagaState) {
+			if err := sm.resume(context.Background(), state); err != nil {
+				log.Printf("Ошибка продолжения саги заказа %s: %v", state.OrderID, err)
+			}
+		}(state)
+	}
+	if len(states) > 0 {
+		log.Printf("Продолжаем %d незавершенных саг", len(states))
+	}
+	return nil
+}
+
+// resume продолжает сохраненную сагу. Спан ResumeSaga связан с последним спаном саги до рестарта,
+// а следующие шаги и компенсации продолжают цепочку от него.
+func (sm *SagaManager) resume(ctx context.Context, state SagaState) error {
+	_, span := tracing.StartApplication(ctx, "ResumeSaga", trace.WithNewRoot(), trace.WithLinks(linkToLastSpan(state, "resume")...))
+	span.SetAttributes(
+		attribute.String("order.id", state.OrderID),
+		attribute.String("saga.status", string(state.Status)),
+		attribute.String("saga.step", state.Step),
+		attribute.Int("saga.completed_steps", len(state.CompletedSteps)),
+	)
+	span.End()
+
+	log.Printf("Сага заказа %s продолжается после рестарта (статус %s, шаг %s)", state.OrderID, state.Status, state.Step)
+	return sm.play(state, span.SpanContext())
+}
+
+// play выполняет сагу с сохраненного состояния; выполненные шаги и компенсации пропускаются
+func (sm *SagaManager) play(state SagaState, last trace.SpanContext) error {
+	run, ok := sm.startRun(state)
+	if !ok {
+		log.Printf("Сага заказа %s уже выполняется", state.OrderID)
+		return nil
+	}
+	defer sm.finishRun(run)
+
+	// Состояние фиксируется до первого шага, чтобы заказ не потерялся при рестарте
+	if err := run.update(context.Background(), func(s *SagaState) {}); err != nil {
+		return err
+	}
+
+	sagaCtxData := &SagaContextData{
+		LastSpanContext: last,
+		Order:           state.Order,
+		Outputs:         make(map[string]json.RawMessage, len(state.Outputs)),
+		run:             run,
+	}
+	for step, output := range state.Outputs {
+		sagaCtxData.Outputs[step] = output
+	}
 	// New context from background
 	sagaCtx := context.WithValue(context.Background(), sagaContextKey, sagaCtxData)
 
-	coordinator := saga.NewCoordinator(sagaCtx, sagaCtx, sm.saga, saga.New())
+	// Срок саги ограничивает только шаги: компенсации должны выполниться и после него
+	stepsCtx := sagaCtx
+	if !state.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		stepsCtx, cancel = context.WithDeadline(sagaCtx, state.Deadline)
+		defer cancel()
+	}
+
+	coordinator := saga.NewCoordinator(stepsCtx, sagaCtx, sm.saga, saga.New(), state.OrderID)
 
 	result := coordinator.Play()
+
+	status := SagaCompleted
+	switch {
+	case len(result.CompensateErrors) > 0:
+		status = SagaStuck
+	case result.ExecutionError != nil:
+		status = SagaCompensated
+	}
+	if err := run.update(sagaCtx, func(s *SagaState) {
+		s.Status = status
+		s.LastSpanContext = encodeSpanContext(sagaCtxData.LastSpanContext)
+	}); err != nil {
+		log.Printf("Не удалось сохранить завершение саги заказа %s: %v", state.OrderID, err)
+	}
+
+	if status == SagaStuck {
+		sm.deadLetter(run.snapshot())
+		return fmt.Errorf("%w: %w", ErrSagaStuck, errors.Join(result.CompensateErrors...))
+	}
+
+	// Отмененная до рестарта сага завершается ошибкой продолжения компенсаций, но тоже считается отмененной
+	if errors.Is(result.ExecutionError, ErrSagaCancelled) || run.snapshot().InterruptedStep != "" {
+		log.Printf("Заказ %s отменен по запросу покупателя", state.OrderID)
+		return nil
+	}
+	if errors.Is(result.ExecutionError, ErrSagaResumedCompensation) {
+		// Ошибка шага уже обработана до рестарта или до перезапуска оператором
+		log.Printf("Компенсации саги заказа %s завершены", state.OrderID)
+		return nil
+	}
 	if result.ExecutionError != nil {
 		log.Printf("Ошибка выполнения саги: %v", result.ExecutionError)
-		return result.ExecutionError
+		return fmt.Errorf("%w: %w", ErrSagaCompensated, result.ExecutionError)
 	}
 	log.Println("Сага выполнена успешно")
 	return nil
 }
 
-// wrapAction оборачивает действие в обработку OpenTelemetry
-func (sm *SagaManager) wrapAction(action func(context.Context, *SagaContextData) error) func(context.Context) error {
+// wrapAction оборачивает шаг саги: выполненный до рестарта шаг пропускается, перед шагом проверяются
+// запрос на отмену и срок саги, а начало и результат шага сохраняются в хранилище
+func (sm *SagaManager) wrapAction(step string, action activity) func(context.Context) error {
+	return func(ctx context.Context) error {
+		sagaCtx := sagaContextFrom(ctx)
+		run := sagaCtx.run
+
+		state := run.snapshot()
+		if state.completed(step) {
+			return nil
+		}
+		if state.Status == SagaCompensating {
+			// Компенсации прервал рестарт: ошибка возвращает координатор к компенсации выполненных шагов
+			return fmt.Errorf("%w: %s", ErrSagaResumedCompensation, state.Error)
+		}
+
+		if err := interruptIfCancelled(ctx, sagaCtx, step); err != nil {
+			return err
+		}
+		if err := checkDeadline(ctx, sagaCtx, step, nil); err != nil {
+			if saveErr := run.update(ctx, func(s *SagaState) {
+				s.Status = SagaCompensating
+				s.Step = step
+				s.Error = err.Error()
+				s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+			}); saveErr != nil {
+				log.Printf("Не удалось сохранить истечение срока саги заказа %s: %v", sagaCtx.Order.ID, saveErr)
+			}
+			return err
+		}
+		if err := run.update(ctx, func(s *SagaState) {
+			s.Step = step
+			s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+		}); err != nil {
+			return err
+		}
+
+		startedAt := time.Now().UTC()
+		sagaCtx.called = false
+		if err := action(ctx, sagaCtx); err != nil {
+			stepSpan := sagaCtx.LastSpanContext
+			rejected := notCalled(sagaCtx, err)
+			err = checkDeadline(ctx, sagaCtx, step, err)
+			if saveErr := run.update(ctx, func(s *SagaState) {
+				s.Status = SagaCompensating
+				s.Error = err.Error()
+				if rejected {
+					s.RejectedSteps = append(s.RejectedSteps, step)
+				}
+				s.record(step, step, false, stepSpan, startedAt, err)
+				s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+			}); saveErr != nil {
+				log.Printf("Не удалось сохранить ошибку шага %s заказа %s: %v", step, sagaCtx.Order.ID, saveErr)
+			}
+			return err
+		}
+
+		return run.update(ctx, func(s *SagaState) {
+			s.CompletedSteps = append(s.CompletedSteps, step)
+			s.record(step, step, false, sagaCtx.LastSpanContext, startedAt, nil)
+			if output, ok := sagaCtx.Outputs[step]; ok {
+				if s.Outputs == nil {
+					s.Outputs = make(map[string]json.RawMessage)
+				}
+				s.Outputs[step] = output
+			}
+			s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+		})
+	}
+}
+
+// wrapCompensation оборачивает компенсацию шага step.
+// Координатор компенсирует и шаг, на котором сага прервалась; если прервала ее отмена или вызов шага
+// отклонил circuit breaker или bulkhead, шаг не выполнялся.
+// Компенсации, выполненные до рестарта или до перезапуска оператором, не повторяются.
+func (sm *SagaManager) wrapCompensation(step, action string, compensate activity) func(context.Context) error {
 	return func(ctx context.Context) error {
-		// Получаем SagaContext
-		sagaCtx, _ := ctx.Value(sagaContextKey).(*SagaContextData)
-		if sagaCtx == nil {
-			sagaCtx = &SagaContextData{}
+		sagaCtx := sagaContextFrom(ctx)
+		run := sagaCtx.run
+
+		state := run.snapshot()
+		if state.InterruptedStep == step || slices.Contains(state.CompensatedSteps, step) || slices.Contains(state.RejectedSteps, step) {
+			return nil
 		}
 
-		return action(ctx, sagaCtx)
+		startedAt := time.Now().UTC()
+		if err := compensate(ctx, sagaCtx); err != nil {
+			// Координатор продолжит компенсировать остальные шаги, а сага после отката будет помечена зависшей
+			if saveErr := run.update(ctx, func(s *SagaState) {
+				if !slices.Contains(s.FailedCompensations, step) {
+					s.FailedCompensations = append(s.FailedCompensations, step)
+				}
+				s.Error = err.Error()
+				s.record(step, action, true, sagaCtx.LastSpanContext, startedAt, err)
+				s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+			}); saveErr != nil {
+				log.Printf("Не удалось сохранить ошибку компенсации %s заказа %s: %v", step, sagaCtx.Order.ID, saveErr)
+			}
+			return err
+		}
+
+		return run.update(ctx, func(s *SagaState) {
+			s.CompensatedSteps = append(s.CompensatedSteps, step)
+			s.record(step, action, true, sagaCtx.LastSpanContext, startedAt, nil)
+			s.LastSpanContext = encodeSpanContext(sagaCtx.LastSpanContext)
+		})
+	}
+}
+
+// sagaContextFrom получает SagaContext из контекста шага
+func sagaContextFrom(ctx context.Context) *SagaContextData {
+	sagaCtx, _ := ctx.Value(sagaContextKey).(*SagaContextData)
+	if sagaCtx == nil {
+		sagaCtx = &SagaContextData{Outputs: make(map[string]json.RawMessage)}
 	}
+	return sagaCtx
 }
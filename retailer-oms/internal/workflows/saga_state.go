@@ -0,0 +1,132 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SagaStatus - состояние экземпляра саги
+type SagaStatus string
+
+const (
+	SagaRunning      SagaStatus = "RUNNING"      // Шаги выполняются
+	SagaCompensating SagaStatus = "COMPENSATING" // Шаг не выполнен или заказ отменен, выполняются компенсации
+	SagaCompleted    SagaStatus = "COMPLETED"
+	SagaCompensated  SagaStatus = "COMPENSATED"
+	SagaStuck        SagaStatus = "STUCK" // Компенсация не выполнена после всех повторов, нужен ручной re-drive
+)
+
+// IsFinished сообщает, что сага завершена и продолжать ее после рестарта не нужно.
+// Зависшая сага не завершена, но продолжается только по команде оператора (см. SagaManager.Redrive).
+func (s SagaStatus) IsFinished() bool {
+	return s == SagaCompleted || s == SagaCompensated
+}
+
+// SagaState - сохраняемое состояние экземпляра саги, по которому она продолжается после рестарта OMS
+type SagaState struct {
+	OrderID             string                     `json:"order_id"`
+	Order               domain.Order               `json:"order"`
+	OrderStatus         domain.OrderStatus         `json:"order_status,omitempty"` // Последний опубликованный статус заказа
+	Status              SagaStatus                 `json:"status"`
+	Step                string                     `json:"step,omitempty"` // Выполняемый шаг; при компенсации - шаг, на котором сага остановилась
+	CompletedSteps      []string                   `json:"completed_steps,omitempty"`
+	CompensatedSteps    []string                   `json:"compensated_steps,omitempty"`
+	FailedCompensations []string                   `json:"failed_compensations,omitempty"` // Шаги, компенсация которых не выполнена
+	InterruptedStep     string                     `json:"interrupted_step,omitempty"`     // Шаг, перед которым сагу прервала отмена
+	RejectedSteps       []string                   `json:"rejected_steps,omitempty"`       // Шаги, вызов которых отклонили circuit breaker или bulkhead: компенсация не нужна
+	Outputs             map[string]json.RawMessage `json:"outputs,omitempty"`              // Ответы сервисов по шагам
+	LastSpanContext     string                     `json:"last_span_context,omitempty"`    // traceparent последнего спана саги
+	Cancel              *domain.CancelOrderCommand `json:"cancel,omitempty"`
+	CancelSpan          string                     `json:"cancel_span,omitempty"` // traceparent спана, принявшего отмену
+	Error               string                     `json:"error,omitempty"`
+	Redrives            int                        `json:"redrives,omitempty"` // Сколько раз оператор перезапускал компенсации
+	Timeline            []StepRecord               `json:"timeline,omitempty"` // Выполненные шаги и компенсации по порядку
+	Deadline            time.Time                  `json:"deadline"`           // Срок выполнения шагов саги, сохраняется для продолжения после рестарта
+	StartedAt           time.Time                  `json:"started_at"`
+	UpdatedAt           time.Time                  `json:"updated_at"`
+}
+
+// StepRecord - выполнение шага или компенсации; по trace id и span id шаг находится в трейсе
+type StepRecord struct {
+	Step         string    `json:"step"`
+	Action       string    `json:"action"` // Совпадает со Step у шага, у компенсации - имя компенсирующего действия
+	Compensation bool      `json:"compensation,omitempty"`
+	Manual       bool      `json:"manual,omitempty"` // Запущено оператором через admin API
+	Error        string    `json:"error,omitempty"`
+	TraceID      string    `json:"trace_id,omitempty"`
+	SpanID       string    `json:"span_id,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+}
+
+// record добавляет выполнение действия в хронологию саги; span - спан действия
+func (s *SagaState) record(step, action string, compensation bool, span trace.SpanContext, startedAt time.Time, err error) {
+	rec := StepRecord{
+		Step:         step,
+		Action:       action,
+		Compensation: compensation,
+		StartedAt:    startedAt,
+		FinishedAt:   time.Now().UTC(),
+	}
+	if span.IsValid() {
+		rec.TraceID = span.TraceID().String()
+		rec.SpanID = span.SpanID().String()
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	s.Timeline = append(s.Timeline, rec)
+}
+
+// completed сообщает, что шаг выполнен
+func (s *SagaState) completed(step string) bool {
+	return slices.Contains(s.CompletedSteps, step)
+}
+
+// SagaStore хранит состояние саг между рестартами OMS
+type SagaStore interface {
+	Save(ctx context.Context, state SagaState) error
+	Load(ctx context.Context, orderID string) (SagaState, bool, error)
+	Unfinished(ctx context.Context) ([]SagaState, error)
+	// List возвращает все сохраненные саги, в том числе завершенные в пределах срока хранения
+	List(ctx context.Context) ([]SagaState, error)
+}
+
+// encodeSpanContext сериализует контекст спана в traceparent
+func encodeSpanContext(sc trace.SpanContext) string {
+	if !sc.IsValid() {
+		return ""
+	}
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(context.Background(), sc), carrier)
+	return carrier["traceparent"]
+}
+
+// decodeSpanContext восстанавливает контекст спана из traceparent
+func decodeSpanContext(traceparent string) trace.SpanContext {
+	if traceparent == "" {
+		return trace.SpanContext{}
+	}
+	carrier := propagation.MapCarrier{"traceparent": traceparent}
+	return trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+}
+
+// linkToLastSpan связывает новый спан с последним спаном саги (link.type=linkType).
+// Если последний спан неизвестен, ссылок нет.
+func linkToLastSpan(state SagaState, linkType string) []trace.Link {
+	last := decodeSpanContext(state.LastSpanContext)
+	if !last.IsValid() {
+		return nil
+	}
+	return []trace.Link{{
+		SpanContext: last,
+		Attributes:  []attribute.KeyValue{attribute.String("link.type", linkType)},
+	}}
+}
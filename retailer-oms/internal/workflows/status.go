@@ -0,0 +1,74 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/domain"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// withStatus публикует смену статуса заказа после успешного действия, если в описании шага задан status
+func (sm *SagaManager) withStatus(action ActionDefinition, compensation bool, act activity) activity {
+	if action.Status == "" {
+		return act
+	}
+	return func(ctx context.Context, sagaCtx *SagaContextData) error {
+		if err := act(ctx, sagaCtx); err != nil {
+			return err
+		}
+		sm.publishStatus(ctx, sagaCtx, action, compensation)
+		return nil
+	}
+}
+
+// publishStatus отправляет событие смены статуса в топик статусов; по нему обновляются read-модели и уведомления.
+// Событие продолжает трейс шага. Ошибка публикации не откатывает выполненный шаг и только логируется.
+func (sm *SagaManager) publishStatus(ctx context.Context, sagaCtx *SagaContextData, action ActionDefinition, compensation bool) {
+	event := domain.OrderStatusEvent{
+		OrderID:    sagaCtx.Order.ID,
+		CustomerID: sagaCtx.Order.CustomerID,
+		Status:     action.Status,
+		Step:       action.Name,
+		OccurredAt: time.Now().UTC(),
+	}
+
+	changed := false
+	err := sagaCtx.run.update(ctx, func(s *SagaState) {
+		event.PreviousStatus = s.OrderStatus
+		if event.PreviousStatus == "" {
+			event.PreviousStatus = s.Order.Status
+		}
+		if compensation {
+			// При откате причина - отмена покупателем или ошибка шага
+			event.Reason = s.Error
+			if s.Cancel != nil {
+				event.Reason = s.Cancel.Reason
+			}
+		}
+		changed = event.PreviousStatus != event.Status
+		s.OrderStatus = event.Status
+	})
+	if err != nil {
+		log.Printf("Не удалось сохранить статус %s заказа %s: %v", event.Status, event.OrderID, err)
+	}
+	if !changed {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Ошибка сериализации статуса заказа %s: %v", event.OrderID, err)
+		return
+	}
+
+	ctx = trace.ContextWithSpanContext(ctx, sagaCtx.LastSpanContext)
+	if err := sm.publisher.Publish(ctx, sm.topics.OrderStatus, events.TypeOrderStatusChanged, event.OrderID, data); err != nil {
+		log.Printf("Не удалось опубликовать статус %s заказа %s: %v", event.Status, event.OrderID, err)
+		return
+	}
+	log.Printf("Заказ %s: статус %s -> %s", event.OrderID, event.PreviousStatus, event.Status)
+}
@@ -0,0 +1,109 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/events"
+	"github.com/Vasiliy82/ArchiScoper/retailer-api/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrSagaStuck - компенсация не выполнена после всех повторов: деньги или товар могут остаться в несогласованном состоянии
+	ErrSagaStuck = errors.New("saga stuck: compensation failed")
+	// ErrSagaCompensated - шаг не выполнен (отказ сервиса, срок саги), выполненные шаги компенсированы.
+	// Это штатный исход саги: он сохранен и опубликован, повторно обрабатывать заказ не нужно.
+	ErrSagaCompensated = errors.New("saga compensated")
+	// ErrSagaNotFound - саги заказа нет в хранилище этого экземпляра
+	ErrSagaNotFound = errors.New("saga not found")
+	// ErrSagaNotStuck - перезапустить компенсации можно только у зависшей саги
+	ErrSagaNotStuck = errors.New("saga is not stuck")
+)
+
+// RedriveCommand - команда оператора перезапустить невыполненные компенсации зависшей саги
+type RedriveCommand struct {
+	OrderID     string    `json:"order_id"`
+	RequestedBy string    `json:"requested_by,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// deadLetter публикует зависшую сагу со всем сохраненным состоянием в топик dead-letter,
+// откуда ее разбирает оператор. Спан связан с последним спаном саги.
+func (sm *SagaManager) deadLetter(state SagaState) {
+	ctx, span := tracing.StartApplication(context.Background(), "DeadLetterSaga", trace.WithLinks(linkToLastSpan(state, "saga")...))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", state.OrderID),
+		attribute.String("kafka.topic", sm.topics.DeadLetter),
+		attribute.String("saga.failed_compensations", strings.Join(state.FailedCompensations, ",")),
+		attribute.Int("saga.redrives", state.Redrives),
+	)
+	span.SetStatus(codes.Error, state.Error)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		span.RecordError(err)
+		log.Printf("Ошибка сериализации зависшей саги заказа %s: %v", state.OrderID, err)
+		return
+	}
+	if err := sm.publisher.Publish(ctx, sm.topics.DeadLetter, events.TypeSagaStuck, state.OrderID, data); err != nil {
+		// Состояние саги остается в хранилище, оператор найдет ее и без сообщения в dead-letter
+		span.RecordError(err)
+		log.Printf("Не удалось отправить зависшую сагу заказа %s в %s: %v", state.OrderID, sm.topics.DeadLetter, err)
+		return
+	}
+	log.Printf("Сага заказа %s зависла (не выполнены компенсации шагов %s) и отправлена в %s",
+		state.OrderID, strings.Join(state.FailedCompensations, ", "), sm.topics.DeadLetter)
+}
+
+// Redrive перезапускает невыполненные компенсации зависшей саги по команде оператора.
+// Сага продолжается в фоне; выполненные ранее компенсации не повторяются.
+// Если сага снова не откатится, она опять попадет в dead-letter.
+func (sm *SagaManager) Redrive(ctx context.Context, command RedriveCommand) error {
+	state, found, err := sm.store.Load(ctx, command.OrderID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: заказ %s", ErrSagaNotFound, command.OrderID)
+	}
+
+	_, span := tracing.StartApplication(ctx, "RedriveSaga", trace.WithLinks(linkToLastSpan(state, "redrive")...))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("order.id", command.OrderID),
+		attribute.String("saga.status", string(state.Status)),
+		attribute.String("redrive.requested_by", command.RequestedBy),
+	)
+
+	if state.Status != SagaStuck {
+		err := fmt.Errorf("%w: сага заказа %s в статусе %s", ErrSagaNotStuck, command.OrderID, state.Status)
+		span.SetAttributes(attribute.String("error.type", "redrive_rejected"))
+		return err
+	}
+
+	state.Status = SagaCompensating
+	state.FailedCompensations = nil
+	state.Redrives++
+	span.SetAttributes(attribute.Int("saga.redrives", state.Redrives))
+
+	last := span.SpanContext()
+	go func() {
+		if err := sm.play(state, last); err != nil {
+			log.Printf("Перезапуск компенсаций саги заказа %s: %v", command.OrderID, err)
+		}
+	}()
+
+	log.Printf("Компенсации саги заказа %s перезапущены оператором %s", command.OrderID, command.RequestedBy)
+	return nil
+}
@@ -20,12 +20,15 @@ type Node struct {
 	P90Duration uint64
 	P99Duration uint64
 	ErrorCount  uint64
+	ShedCount   uint64 // Запросы, отклоненные лимитами и сбросом нагрузки (не ошибки)
+	FastFail    uint64 // Ошибки без обращения к сервису: отказ circuit breaker или bulkhead
 }
 
 // EdgeMetrics агрегирует количество вызовов, время выполнения и ошибки
 type EdgeMetrics struct {
 	Protocol   string
 	Type       string
+	EventType  string // Тип CloudEvents-события для асинхронных связей
 	Count      int64
 	ErrorCount int64
 	TotalTime  int64
@@ -58,7 +61,7 @@ func (g *Graph) AddNode(node Node) {
 	g.Subgraphs[node.ServiceName] = append(g.Subgraphs[node.ServiceName], node.NodeID)
 }
 
-func (g *Graph) AddEdge(from, to uint32, duration int64, isError bool, callType, protocol string) {
+func (g *Graph) AddEdge(from, to uint32, duration int64, isError bool, callType, protocol, eventType string) {
 	if g.Edges[from] == nil {
 		g.Edges[from] = make(map[uint32]EdgeMetrics)
 	}
@@ -74,6 +77,9 @@ func (g *Graph) AddEdge(from, to uint32, duration int64, isError bool, callType,
 	if protocol != "" {
 		metrics.Protocol = protocol
 	}
+	if eventType != "" {
+		metrics.EventType = eventType
+	}
 	g.Edges[from][to] = metrics
 }
 
@@ -96,7 +102,9 @@ func main() {
 			toUInt64(quantilesMerge(0.50)(P50Duration)[1]) AS P50Duration,
 			toUInt64(quantilesMerge(0.90)(P90Duration)[1]) AS P90Duration,
 			toUInt64(quantilesMerge(0.99)(P99Duration)[1]) AS P99Duration,
-			sumMerge(ErrorCount) AS ErrorCount
+			sumMerge(ErrorCount) AS ErrorCount,
+			sumMerge(ShedCount) AS ShedCount,
+			sumMerge(FastFailCount) AS FastFailCount
 		FROM NodeDictionary FINAL
 		GROUP BY NodeId, NodeUniqueName, ServiceName, Layer, SubLayer;
 `)
@@ -109,7 +117,7 @@ func main() {
 
 	for rows.Next() {
 		var node Node
-		err := rows.Scan(&node.NodeID, &node.NodeName, &node.ServiceName, &node.Layer, &node.SubLayer, &node.CallCount, &node.P50Duration, &node.P90Duration, &node.P99Duration, &node.ErrorCount)
+		err := rows.Scan(&node.NodeID, &node.NodeName, &node.ServiceName, &node.Layer, &node.SubLayer, &node.CallCount, &node.P50Duration, &node.P90Duration, &node.P99Duration, &node.ErrorCount, &node.ShedCount, &node.FastFail)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -191,7 +199,7 @@ func main() {
 		parentNodeID, existsParent := traceNodeMap[traceID][parentID]
 
 		if existsCurrent && existsParent {
-			graph.AddEdge(parentNodeID, currentNodeID, duration, isError, "sync", "")
+			graph.AddEdge(parentNodeID, currentNodeID, duration, isError, "sync", "", "")
 		}
 
 		// **Добавляем асинхронные вызовы**
@@ -201,7 +209,8 @@ func main() {
 					if existsCurrent {
 						protocol := link.Attributes["link.protocol"]
 						typ := link.Attributes["link.type"]
-						graph.AddEdge(linkedNodeID, currentNodeID, duration, isError, typ, protocol)
+						eventType := link.Attributes["link.event.type"]
+						graph.AddEdge(linkedNodeID, currentNodeID, duration, isError, typ, protocol, eventType)
 					}
 				}
 			}
@@ -230,6 +239,8 @@ func main() {
 				// Агрегируем метрики
 				existing.CallCount = max(existing.CallCount, node.CallCount)
 				existing.ErrorCount += node.ErrorCount
+				existing.ShedCount += node.ShedCount
+				existing.FastFail += node.FastFail
 				entryPoints[service] = existing
 			} else {
 				// Создаём новый агрегированный узел
@@ -241,6 +252,8 @@ func main() {
 					SubLayer:    node.SubLayer,
 					CallCount:   node.CallCount,
 					ErrorCount:  node.ErrorCount,
+					ShedCount:   node.ShedCount,
+					FastFail:    node.FastFail,
 				}
 			}
 		}
@@ -270,6 +283,9 @@ func main() {
 			aggMetrics.ErrorCount += metrics.ErrorCount
 			aggMetrics.Type = metrics.Type
 			aggMetrics.Protocol = metrics.Protocol
+			if metrics.EventType != "" {
+				aggMetrics.EventType = metrics.EventType
+			}
 
 			collapsedEdges[srcService][dstService] = aggMetrics
 		}
@@ -280,8 +296,16 @@ func main() {
 
 	// **Вывод узлов (по одному на микросервис)**
 	for _, node := range entryPoints {
-		fmt.Printf("  \"%s\" [label=\"%s\\nCalls: %d\\nErrors: %d\", shape=box];\n",
-			node.ServiceName, node.NodeName, node.CallCount, node.ErrorCount)
+		// Как и в подробном графе, счетчик отказов выводится, только если отказы были
+		shedLabel := ""
+		if node.ShedCount > 0 {
+			shedLabel = fmt.Sprintf("\\nShed: %d", node.ShedCount)
+		}
+		if node.FastFail > 0 {
+			shedLabel += fmt.Sprintf("\\nFast-fail: %d", node.FastFail)
+		}
+		fmt.Printf("  \"%s\" [label=\"%s\\nCalls: %d\\nErrors: %d%s\", shape=box];\n",
+			node.ServiceName, node.NodeName, node.CallCount, node.ErrorCount, shedLabel)
 	}
 
 	// **Вывод рёбер (связи между микросервисами)**
@@ -292,13 +316,23 @@ func main() {
 			if metrics.ErrorCount > 0 {
 				color = "red"
 			}
+			if metrics.Type == "cancel" {
+				color = "orange" // Отмена заказа покупателем прерывает сагу
+			}
 			if metrics.Type == "async" {
 				style = "dashed"
 			}
+			if metrics.Type == "batch" {
+				style = "bold" // Fan-out пачки на отдельные трейсы заказов
+			}
 			protocolLabel := ""
 			if metrics.Protocol != "" {
 				protocolLabel = fmt.Sprintf(", label=\"%s\"", metrics.Protocol)
 			}
+			if metrics.EventType != "" {
+				// Асинхронное ребро подписывается типом события, а не только транспортом
+				protocolLabel = fmt.Sprintf(", label=\"%s: %s\"", metrics.Protocol, metrics.EventType)
+			}
 			fmt.Printf("  \"%s\" -> \"%s\" [label=\"%s, %d calls, avg %d ms, %d errors\"%s, color=%s, style=%s];\n",
 				src, dst, metrics.Type, metrics.Count, metrics.TotalTime/metrics.Count/1e6, metrics.ErrorCount, protocolLabel, color, style)
 		}
@@ -21,12 +21,15 @@ type Node struct {
 	P90Duration uint64
 	P99Duration uint64
 	ErrorCount  uint64
+	ShedCount   uint64 // Запросы, отклоненные лимитами и сбросом нагрузки (не ошибки)
+	FastFail    uint64 // Ошибки без обращения к сервису: отказ circuit breaker или bulkhead
 }
 
 // EdgeMetrics агрегирует количество вызовов, время выполнения и ошибки
 type EdgeMetrics struct {
 	Protocol   string
 	Type       string
+	EventType  string // Тип CloudEvents-события для асинхронных связей
 	Count      int64
 	ErrorCount int64
 	TotalTime  int64
@@ -59,7 +62,7 @@ func (g *Graph) AddNode(node Node) {
 	g.Subgraphs[node.ServiceName] = append(g.Subgraphs[node.ServiceName], node.NodeID)
 }
 
-func (g *Graph) AddEdge(from, to uint32, duration int64, isError bool, callType, protocol string) {
+func (g *Graph) AddEdge(from, to uint32, duration int64, isError bool, callType, protocol, eventType string) {
 	if g.Edges[from] == nil {
 		g.Edges[from] = make(map[uint32]EdgeMetrics)
 	}
@@ -75,6 +78,9 @@ func (g *Graph) AddEdge(from, to uint32, duration int64, isError bool, callType,
 	if protocol != "" {
 		metrics.Protocol = protocol
 	}
+	if eventType != "" {
+		metrics.EventType = eventType
+	}
 	g.Edges[from][to] = metrics
 }
 
@@ -97,7 +103,9 @@ func main() {
 			toUInt64(quantilesMerge(0.50)(P50Duration)[1]) AS P50Duration,
 			toUInt64(quantilesMerge(0.90)(P90Duration)[1]) AS P90Duration,
 			toUInt64(quantilesMerge(0.99)(P99Duration)[1]) AS P99Duration,
-			sumMerge(ErrorCount) AS ErrorCount
+			sumMerge(ErrorCount) AS ErrorCount,
+			sumMerge(ShedCount) AS ShedCount,
+			sumMerge(FastFailCount) AS FastFailCount
 		FROM NodeDictionary FINAL
 		GROUP BY NodeId, NodeUniqueName, ServiceName, Layer, SubLayer;
 `)
@@ -110,7 +118,7 @@ func main() {
 
 	for rows.Next() {
 		var node Node
-		err := rows.Scan(&node.NodeID, &node.NodeName, &node.ServiceName, &node.Layer, &node.SubLayer, &node.CallCount, &node.P50Duration, &node.P90Duration, &node.P99Duration, &node.ErrorCount)
+		err := rows.Scan(&node.NodeID, &node.NodeName, &node.ServiceName, &node.Layer, &node.SubLayer, &node.CallCount, &node.P50Duration, &node.P90Duration, &node.P99Duration, &node.ErrorCount, &node.ShedCount, &node.FastFail)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -192,7 +200,7 @@ func main() {
 		parentNodeID, existsParent := traceNodeMap[traceID][parentID]
 
 		if existsCurrent && existsParent {
-			graph.AddEdge(parentNodeID, currentNodeID, duration, isError, "sync", "")
+			graph.AddEdge(parentNodeID, currentNodeID, duration, isError, "sync", "", "")
 		}
 
 		// **Добавляем асинхронные вызовы**
@@ -202,7 +210,8 @@ func main() {
 					if existsCurrent {
 						protocol := link.Attributes["link.protocol"]
 						typ := link.Attributes["link.type"]
-						graph.AddEdge(linkedNodeID, currentNodeID, duration, isError, typ, protocol)
+						eventType := link.Attributes["link.event.type"]
+						graph.AddEdge(linkedNodeID, currentNodeID, duration, isError, typ, protocol, eventType)
 					}
 				}
 			}
@@ -218,8 +227,16 @@ func main() {
 		fmt.Printf("    label=\"%s\";\n", serviceName)
 		for _, nodeID := range nodes {
 			node := graph.Nodes[nodeID]
-			fmt.Printf("    \"%d\" [label=\"%s\\nCalls: %d\\nP50: %dms\\nP90: %dms\\nP99: %dms\\nErrors: %d\", shape=box];\n",
-				nodeID, extractShortName(node.NodeName), node.CallCount, node.P50Duration/1e6, node.P90Duration/1e6, node.P99Duration/1e6, node.ErrorCount)
+			shedLabel := ""
+			if node.ShedCount > 0 {
+				shedLabel = fmt.Sprintf("\\nShed: %d", node.ShedCount)
+			}
+			if node.FastFail > 0 {
+				// Быстрые отказы входят в Errors; отдельный счетчик отличает их от медленных сбоев сервиса
+				shedLabel += fmt.Sprintf("\\nFast-fail: %d", node.FastFail)
+			}
+			fmt.Printf("    \"%d\" [label=\"%s\\nCalls: %d\\nP50: %dms\\nP90: %dms\\nP99: %dms\\nErrors: %d%s\", shape=box];\n",
+				nodeID, extractShortName(node.NodeName), node.CallCount, node.P50Duration/1e6, node.P90Duration/1e6, node.P99Duration/1e6, node.ErrorCount, shedLabel)
 		}
 		fmt.Println("  }")
 	}
@@ -235,13 +252,37 @@ func main() {
 			if metrics.Type == "saga" {
 				color = "blue"
 			}
+			if metrics.Type == "cancel" {
+				color = "orange" // Отмена заказа покупателем прерывает сагу
+			}
+			if metrics.Type == "retry" {
+				color = "purple" // Повтор шага саги после временной ошибки; calls - число повторов
+			}
+			if metrics.Type == "redrive" {
+				color = "darkgreen" // Оператор перезапустил компенсации зависшей саги
+			}
+			if metrics.Type == "fork" || metrics.Type == "join" {
+				color = "blue" // Разветвление саги на параллельные шаги и их слияние
+				style = "bold"
+			}
+			if metrics.Type == "replay" {
+				color = "brown" // Оператор вернул сообщение из DLQ в исходный топик
+				style = "dashed"
+			}
 			if metrics.Type == "async" {
 				style = "dashed" // Делаем пунктирную линию для асинхронных вызовов
 			}
+			if metrics.Type == "batch" {
+				style = "bold" // Fan-out пачки на отдельные трейсы заказов
+			}
 			protocolLabel := ""
 			if metrics.Protocol != "" {
 				protocolLabel = fmt.Sprintf(", label=\"%s\"", metrics.Protocol)
 			}
+			if metrics.EventType != "" {
+				// Асинхронное ребро подписывается типом события, а не только транспортом
+				protocolLabel = fmt.Sprintf(", label=\"%s: %s\"", metrics.Protocol, metrics.EventType)
+			}
 			fmt.Printf("  \"%d\" -> \"%d\" [label=\"%s, %d calls, avg %d ms, %d errors\"%s, color=%s, style=%s];\n",
 				src, dst, metrics.Type, metrics.Count, metrics.TotalTime/metrics.Count/1e6, metrics.ErrorCount, protocolLabel, color, style)
 		}